@@ -20,6 +20,11 @@ func main() {
 			src.InitServer()
 		case "license":
 			fmt.Println(src.GenerateLicenseKey())
+		case "cache":
+			if err := src.RunCacheCommand(os.Args[2:], os.Stdout); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
 		default:
 			fmt.Println("unsupported command")
 		}
@@ -0,0 +1,8 @@
+-- Monthly spending caps per license.
+ALTER TABLE public.licenses
+    ADD COLUMN soft_cap int DEFAULT 0,
+    ADD COLUMN hard_cap int DEFAULT 0,
+    ADD COLUMN period_usage int DEFAULT 0,
+    ADD COLUMN period_start timestamp,
+    ADD COLUMN period_end timestamp,
+    ADD COLUMN soft_cap_notified boolean DEFAULT false;
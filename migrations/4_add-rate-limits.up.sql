@@ -0,0 +1,19 @@
+-- License plans select per license rate limits. Licenses without a plan get
+-- the trial limits if they are trials and the standard limits otherwise.
+ALTER TABLE public.licenses
+    ADD COLUMN plan text;
+
+-- Token buckets for the postgres rate limit backend.
+CREATE TABLE public.rate_limit_buckets
+(
+    key text NOT NULL,
+    tokens double precision NOT NULL,
+    updated_at timestamp NOT NULL,
+    full_at timestamp NOT NULL,
+    PRIMARY KEY (key)
+);
+
+CREATE INDEX rate_limit_buckets_full_at_idx ON public.rate_limit_buckets (full_at);
+
+ALTER TABLE public.rate_limit_buckets
+    OWNER to postgres;
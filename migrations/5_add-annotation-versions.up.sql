@@ -0,0 +1,16 @@
+-- Provider and model version of each annotation, when it was last checked
+-- against the origin, and the origin's validators for conditional requests.
+ALTER TABLE public.image_annotations
+    ADD COLUMN provider text,
+    ADD COLUMN model_version text,
+    ADD COLUMN validated_at timestamp,
+    ADD COLUMN etag text,
+    ADD COLUMN last_modified text;
+
+-- Existing annotations count as validated now, so they expire gradually over
+-- the cache TTL instead of all at once on deploy.
+UPDATE public.image_annotations SET validated_at = now();
+
+ALTER TABLE public.image_annotations
+    ALTER COLUMN validated_at SET DEFAULT CURRENT_TIMESTAMP,
+    ALTER COLUMN validated_at SET NOT NULL;
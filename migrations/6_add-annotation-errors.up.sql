@@ -0,0 +1,8 @@
+-- Kind of error of annotations that could not be classified, and how many
+-- times in a row classifying the image failed.
+ALTER TABLE public.image_annotations
+    ADD COLUMN error_kind text,
+    ADD COLUMN retry_count int NOT NULL DEFAULT 0;
+
+-- Errors were all reported as failed fetches until now.
+UPDATE public.image_annotations SET error_kind = 'fetch_failed' WHERE error IS NOT NULL;
@@ -0,0 +1,19 @@
+-- Annotations are looked up by the hash of their URI, which leads the primary
+-- key, so rows hashed otherwise are rehashed. Rows that would then duplicate
+-- one already hashed by URI, or another rehashed row, are dropped.
+DELETE FROM public.image_annotations a
+    USING public.image_annotations b
+    WHERE a.hash <> encode(sha256(convert_to(a.uri, 'UTF8')), 'hex')
+      AND b.uri = a.uri
+      AND b.hash = encode(sha256(convert_to(b.uri, 'UTF8')), 'hex');
+
+DELETE FROM public.image_annotations a
+    USING public.image_annotations b
+    WHERE a.hash <> encode(sha256(convert_to(a.uri, 'UTF8')), 'hex')
+      AND b.hash <> encode(sha256(convert_to(b.uri, 'UTF8')), 'hex')
+      AND b.uri = a.uri
+      AND (b.validated_at > a.validated_at OR (b.validated_at = a.validated_at AND b.ctid > a.ctid));
+
+UPDATE public.image_annotations
+    SET hash = encode(sha256(convert_to(uri, 'UTF8')), 'hex')
+    WHERE hash <> encode(sha256(convert_to(uri, 'UTF8')), 'hex');
@@ -0,0 +1,27 @@
+-- Verdicts pinned by an admin over the classifier's, which keep the original
+-- scores of the annotation for auditing.
+ALTER TABLE public.image_annotations
+    ADD COLUMN override_verdict text,
+    ADD COLUMN override_reason text,
+    ADD COLUMN overridden_at timestamp;
+
+-- Images clients reported as misclassified, queued for review by an admin.
+CREATE TABLE public.misclassification_reports
+(
+    id bigint GENERATED ALWAYS AS IDENTITY,
+    hash text NOT NULL,
+    uri text NOT NULL,
+    license_id text NOT NULL,
+    expected_verdict text NOT NULL,
+    comment text,
+    status text NOT NULL DEFAULT 'pending',
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    resolved_at timestamp,
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX misclassification_reports_status_idx
+    ON public.misclassification_reports (status, created_at);
+
+ALTER TABLE public.misclassification_reports
+    OWNER to postgres;
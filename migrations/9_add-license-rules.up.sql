@@ -0,0 +1,15 @@
+-- Per license domain and URL rules that allow or block images without
+-- classifying them.
+CREATE TABLE public.license_rules
+(
+    id bigint GENERATED ALWAYS AS IDENTITY,
+    license_id text NOT NULL REFERENCES public.licenses (id) ON DELETE CASCADE,
+    pattern text NOT NULL,
+    action text NOT NULL,
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    CONSTRAINT unique_license_pattern UNIQUE (license_id, pattern)
+);
+
+ALTER TABLE public.license_rules
+    OWNER to postgres;
@@ -0,0 +1,545 @@
+package src
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// registerAdminRoutes registers the admin API on r. It manages the
+// annotation cache and is authorized by the admin token instead of a license.
+func registerAdminRoutes(ctx appContext, r *mux.Router) {
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(adminMiddleware(ctx))
+	admin.Handle("/cache/annotations", &appHandler{ctx, handleAdminGetAnnotations}).Methods("GET")
+	admin.Handle("/cache/annotations", &appHandler{ctx, handleAdminPurgeAnnotations}).Methods("DELETE")
+	admin.Handle("/cache/reclassify", &appHandler{ctx, handleAdminReclassify}).Methods("POST")
+	admin.Handle("/cache/stats", &appHandler{ctx, handleAdminCacheStats}).Methods("GET")
+	admin.Handle("/cache/override", &appHandler{ctx, handleAdminSetOverride}).Methods("PUT")
+	admin.Handle("/cache/override", &appHandler{ctx, handleAdminDeleteOverride}).Methods("DELETE")
+	admin.Handle("/reports", &appHandler{ctx, handleAdminGetReports}).Methods("GET")
+	admin.Handle("/reports/{id}/resolve", &appHandler{ctx, handleAdminResolveReport}).Methods("POST")
+}
+
+// adminMiddleware rejects requests without the admin token as a bearer
+// token. Without a configured token the admin API doesn't exist.
+func adminMiddleware(ctx appContext) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ctx.config.AdminToken == "" {
+				writeError(w, r, http.StatusNotFound, nil)
+				return
+			}
+
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(ctx.config.AdminToken)) != 1 {
+				writeError(w, r, http.StatusUnauthorized, newAppError(codeUnauthorized, "invalid admin token"))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// adminAnnotation shows an annotation with the cache bookkeeping hidden from
+// filter results.
+type adminAnnotation struct {
+	*ImageAnnotation
+	RetryCount   int       `json:"retryCount"`
+	ValidatedAt  time.Time `json:"validatedAt"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+
+	OverrideVerdict string     `json:"overrideVerdict,omitempty"`
+	OverrideReason  string     `json:"overrideReason,omitempty"`
+	OverriddenAt    *time.Time `json:"overriddenAt,omitempty"`
+}
+
+func newAdminAnnotation(anno *ImageAnnotation) adminAnnotation {
+	res := adminAnnotation{
+		ImageAnnotation: anno,
+		RetryCount:      anno.RetryCount,
+		ValidatedAt:     anno.ValidatedAt,
+		ETag:            anno.ETag,
+		LastModified:    anno.LastModified,
+		OverrideVerdict: anno.OverrideVerdict,
+		OverrideReason:  anno.OverrideReason,
+	}
+	if !anno.OverriddenAt.IsZero() {
+		res.OverriddenAt = &anno.OverriddenAt
+	}
+	return res
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) (int, error) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// handleAdminGetAnnotations looks up the cached annotations of the uri and
+// hash query parameters.
+func handleAdminGetAnnotations(ctx appContext, w http.ResponseWriter, req *http.Request) (int, error) {
+	query := req.URL.Query()
+	hashes := query["hash"]
+	for _, uri := range query["uri"] {
+		hashes = append(hashes, Hash(uri))
+	}
+	if len(hashes) == 0 {
+		return http.StatusBadRequest, newAppError(codeBadRequest, "uri or hash query parameter is required")
+	}
+
+	c, cancel := withTimeout(req.Context(), ctx.config.DBTimeout)
+	defer cancel()
+	annos, err := FindAnnotationsByHash(c, ctx.db, hashes)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to find annotations: %v", err)
+	}
+	if len(annos) == 0 {
+		return http.StatusNotFound, newAppError(codeNotFound, "no cached annotations found")
+	}
+
+	res := make([]adminAnnotation, len(annos))
+	for i := range annos {
+		res[i] = newAdminAnnotation(&annos[i])
+	}
+	return writeAdminJSON(w, res)
+}
+
+// domainPattern matches a domain, optionally prefixed by "*." to include its
+// subdomains.
+var domainPattern = regexp.MustCompile(`^(\*\.)?[a-z0-9-]+(\.[a-z0-9-]+)*$`)
+
+// parseAnnotationFilter reads the annotations to purge from the uri, hash,
+// domain, after and before query parameters. Dates are RFC 3339 timestamps
+// or plain dates.
+func parseAnnotationFilter(query url.Values) (AnnotationFilter, error) {
+	filter := AnnotationFilter{
+		URIs:   query["uri"],
+		Hashes: query["hash"],
+		Domain: strings.ToLower(query.Get("domain")),
+	}
+	if filter.Domain != "" && !domainPattern.MatchString(filter.Domain) {
+		return filter, newAppError(codeBadRequest, fmt.Sprintf("%q is not a domain", filter.Domain))
+	}
+
+	for name, dst := range map[string]*time.Time{"after": &filter.After, "before": &filter.Before} {
+		val := query.Get(name)
+		if val == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, val)
+		if err != nil {
+			if t, err = time.Parse(time.DateOnly, val); err != nil {
+				return filter, newAppError(codeBadRequest, fmt.Sprintf("%s must be an RFC 3339 timestamp or a date", name))
+			}
+		}
+		*dst = t
+	}
+
+	if filter.empty() {
+		return filter, newAppError(codeBadRequest, "uri, hash, domain, after or before query parameter is required")
+	}
+	return filter, nil
+}
+
+// handleAdminPurgeAnnotations deletes the cached annotations matching the
+// query, so their images are classified again when next filtered.
+func handleAdminPurgeAnnotations(ctx appContext, w http.ResponseWriter, req *http.Request) (int, error) {
+	filter, err := parseAnnotationFilter(req.URL.Query())
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	c, cancel := withTimeout(req.Context(), ctx.config.DBTimeout)
+	defer cancel()
+	uris, err := DeleteAnnotations(c, ctx.db, filter)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to purge annotations: %v", err)
+	}
+	ctx.lru.Invalidate(uris...)
+	ctx.logger.Info().Msgf("purged %d cached annotations", len(uris))
+
+	return writeAdminJSON(w, map[string]int{"deleted": len(uris)})
+}
+
+// maxReclassifyImages is the most images one reclassification may classify,
+// as they aren't billed to any license.
+const maxReclassifyImages = 10 * MAX_IMAGES_PER_REQUEST
+
+// handleAdminReclassify classifies the images of the request again, whether
+// or not they are cached, and caches the new annotations. It isn't billed to
+// any license.
+func handleAdminReclassify(ctx appContext, w http.ResponseWriter, req *http.Request) (int, error) {
+	var payload AnnotateReq
+	if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+		return http.StatusBadRequest, newAppError(codeInvalidJSON, "JSON body missing or malformed")
+	}
+	if len(payload.ImgURIList) == 0 {
+		return http.StatusBadRequest, newAppError(codeBadRequest, "ImgUriList cannot be empty")
+	}
+
+	uris := removeDuplicates(ctx.logger, payload.ImgURIList)
+	if len(uris) > maxReclassifyImages {
+		return http.StatusBadRequest, newAppError(codeBadRequest, fmt.Sprintf("at most %d images can be reclassified at once", maxReclassifyImages))
+	}
+	for _, uri := range uris {
+		if _, err := url.ParseRequestURI(uri); err != nil {
+			return http.StatusBadRequest, newAppError(codeInvalidURI, fmt.Sprintf("%s is not a valid URI", uri))
+		}
+	}
+
+	res := make([]adminAnnotation, 0, len(uris))
+	for i := 0; i < len(uris); i += MAX_IMAGES_PER_REQUEST {
+		page := uris[i:min(i+MAX_IMAGES_PER_REQUEST, len(uris))]
+		annos, err := classifyImages(req.Context(), ctx, page, nil)
+		if err != nil {
+			return http.StatusServiceUnavailable, &AppError{Code: codeUnavailable, Message: "classifier request failed", Err: err}
+		}
+		if err := cacheAnnotations(req.Context(), ctx, annos); err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("failed to cache annotations: %v", err)
+		}
+		for _, anno := range annos {
+			res = append(res, newAdminAnnotation(anno))
+		}
+	}
+	ctx.logger.Info().Msgf("reclassified %d images", len(res))
+
+	return writeAdminJSON(w, res)
+}
+
+// OverrideReq pins a verdict over the scores of an image, identified by its
+// URI or by the hash of a cached image.
+type OverrideReq struct {
+	URI     string `json:"uri"`
+	Hash    string `json:"hash"`
+	Verdict string `json:"verdict"`
+	Reason  string `json:"reason"`
+}
+
+// placeholderValidatedAt is when placeholder annotations, cached without
+// scores to carry a pinned verdict, were validated. Once unpinned they are
+// expired, and any classification of the image replaces them.
+var placeholderValidatedAt = time.Unix(0, 0).UTC()
+
+// pinVerdict overrides the verdict of the image with the hash, or unpins it
+// if verdict is empty. An image that isn't cached yet is cached without
+// scores so the verdict applies from its first request, which takes its uri.
+// It returns the URIs of the images changed, which the caller drops from the
+// in-memory cache once conn's writes are committed.
+func pinVerdict(c context.Context, conn orm.DB, hash string, uri string, verdict string, reason string) ([]string, error) {
+	if verdict != "" && uri != "" {
+		now := time.Now()
+		placeholder := &ImageAnnotation{
+			Hash:            hash,
+			URI:             uri,
+			DateAdded:       now,
+			ValidatedAt:     placeholderValidatedAt,
+			OverrideVerdict: verdict,
+			OverrideReason:  reason,
+			OverriddenAt:    now,
+		}
+		if err := PinOverride(c, conn, placeholder); err != nil {
+			return nil, err
+		}
+		return []string{uri}, nil
+	}
+	return OverrideVerdict(c, conn, hash, verdict, reason)
+}
+
+// setOverride pins verdict on the image with the hash, or unpins it if verdict
+// is empty, and reports whether any image was changed.
+func setOverride(c context.Context, ctx appContext, hash string, uri string, verdict string, reason string) (bool, error) {
+	c, cancel := withTimeout(c, ctx.config.DBTimeout)
+	defer cancel()
+
+	uris, err := pinVerdict(c, &ctx.db, hash, uri, verdict, reason)
+	if err != nil {
+		return false, err
+	}
+	ctx.lru.Invalidate(uris...)
+
+	ctx.logger.Info().Msgf("set verdict override of %s to %q", hash, verdict)
+	return len(uris) > 0, nil
+}
+
+// handleAdminSetOverride pins a verdict over the scores of an image, so the
+// filter returns it instead of the classifier's.
+func handleAdminSetOverride(ctx appContext, w http.ResponseWriter, req *http.Request) (int, error) {
+	var payload OverrideReq
+	if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+		return http.StatusBadRequest, newAppError(codeInvalidJSON, "JSON body missing or malformed")
+	}
+	if payload.Verdict != verdictAllow && payload.Verdict != verdictBlock {
+		return http.StatusBadRequest, newAppError(codeBadRequest, "verdict must be \"allow\" or \"block\"")
+	}
+
+	hash := payload.Hash
+	switch {
+	case payload.URI != "":
+		if _, err := url.ParseRequestURI(payload.URI); err != nil {
+			return http.StatusBadRequest, newAppError(codeInvalidURI, fmt.Sprintf("%s is not a valid URI", payload.URI))
+		}
+		hash = Hash(payload.URI)
+	case hash == "":
+		return http.StatusBadRequest, newAppError(codeBadRequest, "uri or hash is required")
+	}
+
+	found, err := setOverride(req.Context(), ctx, hash, payload.URI, payload.Verdict, payload.Reason)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to override verdict: %v", err)
+	}
+	if !found {
+		return http.StatusNotFound, newAppError(codeNotFound, "no cached image has the hash, give its uri to pin it before it is cached")
+	}
+	return writeAdminJSON(w, map[string]string{"hash": hash, "verdict": payload.Verdict})
+}
+
+// handleAdminDeleteOverride unpins the verdict of the image of the uri or
+// hash query parameter, so its scores apply again.
+func handleAdminDeleteOverride(ctx appContext, w http.ResponseWriter, req *http.Request) (int, error) {
+	hash := req.URL.Query().Get("hash")
+	if uri := req.URL.Query().Get("uri"); uri != "" {
+		hash = Hash(uri)
+	}
+	if hash == "" {
+		return http.StatusBadRequest, newAppError(codeBadRequest, "uri or hash query parameter is required")
+	}
+
+	found, err := setOverride(req.Context(), ctx, hash, "", "", "")
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to delete verdict override: %v", err)
+	}
+	if !found {
+		return http.StatusNotFound, newAppError(codeNotFound, "no cached image has the hash")
+	}
+	return writeAdminJSON(w, map[string]string{"hash": hash})
+}
+
+// reviewItem is a report in the review queue along with the image's current
+// annotation, if it is cached.
+type reviewItem struct {
+	MisclassificationReport
+	Annotation *adminAnnotation `json:"annotation,omitempty"`
+}
+
+// handleAdminGetReports lists the misclassification reports with the status
+// query parameter, pending by default, oldest first.
+func handleAdminGetReports(ctx appContext, w http.ResponseWriter, req *http.Request) (int, error) {
+	status := req.URL.Query().Get("status")
+	if status == "" {
+		status = reportStatusPending
+	}
+	if status != reportStatusPending && status != reportStatusAccepted && status != reportStatusRejected {
+		return http.StatusBadRequest, newAppError(codeBadRequest, "status must be \"pending\", \"accepted\" or \"rejected\"")
+	}
+	limit := 50
+	if val := req.URL.Query().Get("limit"); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 1 || n > 1000 {
+			return http.StatusBadRequest, newAppError(codeBadRequest, "limit must be an integer between 1 and 1000")
+		}
+		limit = n
+	}
+
+	c, cancel := withTimeout(req.Context(), ctx.config.DBTimeout)
+	defer cancel()
+	reports, err := FindReportsByStatus(c, ctx.db, status, limit)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to find reports: %v", err)
+	}
+
+	res := make([]reviewItem, len(reports))
+	hashes := make([]string, len(reports))
+	for i, report := range reports {
+		res[i].MisclassificationReport = report
+		hashes[i] = report.Hash
+	}
+	if len(hashes) > 0 {
+		annos, err := FindAnnotationsByHash(c, ctx.db, hashes)
+		if err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("failed to find annotations: %v", err)
+		}
+		found, _ := matchAnnotations(reportURIs(reports), hashes, annos)
+		byURI := make(map[string]*ImageAnnotation, len(found))
+		for _, anno := range found {
+			byURI[anno.URI] = anno
+		}
+		for i := range res {
+			if anno := byURI[res[i].URI]; anno != nil {
+				view := newAdminAnnotation(anno)
+				res[i].Annotation = &view
+			}
+		}
+	}
+	return writeAdminJSON(w, res)
+}
+
+func reportURIs(reports []MisclassificationReport) []string {
+	res := make([]string, len(reports))
+	for i, report := range reports {
+		res[i] = report.URI
+	}
+	return res
+}
+
+// ResolveReq resolves a misclassification report. Accepting it pins the
+// verdict the client expected, or Verdict if set.
+type ResolveReq struct {
+	Action  string `json:"action"`
+	Verdict string `json:"verdict"`
+	Reason  string `json:"reason"`
+}
+
+// handleAdminResolveReport accepts or rejects a report, resolving the other
+// pending reports of the image with it.
+func handleAdminResolveReport(ctx appContext, w http.ResponseWriter, req *http.Request) (int, error) {
+	id, err := strconv.ParseInt(mux.Vars(req)["id"], 10, 64)
+	if err != nil {
+		return http.StatusBadRequest, newAppError(codeBadRequest, "report ID must be an integer")
+	}
+	var payload ResolveReq
+	if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+		return http.StatusBadRequest, newAppError(codeInvalidJSON, "JSON body missing or malformed")
+	}
+	if payload.Action != "accept" && payload.Action != "reject" {
+		return http.StatusBadRequest, newAppError(codeBadRequest, "action must be \"accept\" or \"reject\"")
+	}
+	if payload.Verdict != "" && payload.Verdict != verdictAllow && payload.Verdict != verdictBlock {
+		return http.StatusBadRequest, newAppError(codeBadRequest, "verdict must be \"allow\" or \"block\"")
+	}
+
+	c, cancel := withTimeout(req.Context(), ctx.config.DBTimeout)
+	defer cancel()
+	report, err := FindReportByID(c, ctx.db, id)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to find report: %v", err)
+	}
+	if report == nil {
+		return http.StatusNotFound, newAppError(codeNotFound, "report not found")
+	}
+
+	// The verdict is pinned and the reports resolved together, so a failure
+	// leaves the report pending with no override to retry.
+	status := reportStatusRejected
+	verdict, reason := "", payload.Reason
+	if payload.Action == "accept" {
+		status = reportStatusAccepted
+		verdict = payload.Verdict
+		if verdict == "" {
+			verdict = report.ExpectedVerdict
+		}
+		if reason == "" {
+			reason = fmt.Sprintf("misclassification report %d", report.ID)
+		}
+	}
+	var uris []string
+	var resolved int
+	err = ctx.db.RunInTransaction(c, func(tx *pg.Tx) error {
+		if verdict != "" {
+			if uris, err = pinVerdict(c, tx, report.Hash, report.URI, verdict, reason); err != nil {
+				return fmt.Errorf("failed to override verdict: %v", err)
+			}
+		}
+		if resolved, err = ResolveReports(c, tx, report.Hash, status); err != nil {
+			return fmt.Errorf("failed to resolve reports: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	ctx.lru.Invalidate(uris...)
+	if verdict != "" {
+		ctx.logger.Info().Msgf("set verdict override of %s to %q", report.Hash, verdict)
+	}
+	return writeAdminJSON(w, map[string]interface{}{"status": status, "resolved": resolved})
+}
+
+// cacheStatsRes is the response of the cache statistics. The hit ratios are
+// of this instance since it started.
+type cacheStatsRes struct {
+	AnnotationStats
+	Oldest      []adminAnnotation `json:"oldest"`
+	HitRatio    float64           `json:"hitRatio"`
+	LRUEntries  int               `json:"lruEntries"`
+	LRUHitRatio float64           `json:"lruHitRatio"`
+}
+
+// handleAdminCacheStats reports the size and hit ratio of the cache, along
+// with its oldest annotations, as many as the oldest query parameter.
+func handleAdminCacheStats(ctx appContext, w http.ResponseWriter, req *http.Request) (int, error) {
+	oldest := 10
+	if val := req.URL.Query().Get("oldest"); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 || n > 1000 {
+			return http.StatusBadRequest, newAppError(codeBadRequest, "oldest must be an integer between 0 and 1000")
+		}
+		oldest = n
+	}
+
+	c, cancel := withTimeout(req.Context(), ctx.config.DBTimeout)
+	defer cancel()
+	stats, err := GetAnnotationStats(c, ctx.db, oldest)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to get cache stats: %v", err)
+	}
+
+	res := cacheStatsRes{
+		AnnotationStats: stats,
+		Oldest:          make([]adminAnnotation, len(stats.Oldest)),
+		HitRatio: hitRatio(
+			[]prometheus.Counter{filterCacheLookupsTotal.WithLabelValues("hit"), filterCacheLookupsTotal.WithLabelValues("stale")},
+			[]prometheus.Counter{filterCacheLookupsTotal.WithLabelValues("expired"), filterCacheLookupsTotal.WithLabelValues("miss")},
+		),
+		LRUEntries: ctx.lru.Len(),
+		LRUHitRatio: hitRatio(
+			[]prometheus.Counter{annotationLRULookupsTotal.WithLabelValues("hit")},
+			[]prometheus.Counter{annotationLRULookupsTotal.WithLabelValues("miss")},
+		),
+	}
+	for i := range stats.Oldest {
+		res.Oldest[i] = newAdminAnnotation(&stats.Oldest[i])
+	}
+	return writeAdminJSON(w, res)
+}
+
+// hitRatio returns the share of lookups counted by hits, or 0 before any.
+func hitRatio(hits, misses []prometheus.Counter) float64 {
+	var hit, total float64
+	for _, c := range hits {
+		hit += counterValue(c)
+	}
+	total = hit
+	for _, c := range misses {
+		total += counterValue(c)
+	}
+	if total == 0 {
+		return 0
+	}
+	return hit / total
+}
+
+func counterValue(c prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		return 0
+	}
+	return m.GetCounter().GetValue()
+}
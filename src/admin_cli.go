@@ -0,0 +1,170 @@
+package src
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const cacheUsage = `usage: purity cache <command> [flags]
+
+commands:
+  lookup [-hash] <uri or hash>...   show the cached annotations of images
+  purge [flags]                     delete cached annotations
+        -uri, -hash (repeatable), -domain example.com or *.example.com,
+        -after, -before (RFC 3339 timestamp or date)
+  reclassify <uri>...               classify images again and cache the result
+  stats [-oldest n]                 show cache statistics
+
+The commands call the admin API of the server at PURITY_ADMIN_URL
+(default http://localhost:8080) with the token in PURITY_ADMIN_TOKEN.`
+
+// stringsFlag is a flag that can be given several times.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(val string) error {
+	*f = append(*f, val)
+	return nil
+}
+
+// RunCacheCommand runs the cache management command of args, writing the
+// server's response to out.
+func RunCacheCommand(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(cacheUsage)
+	}
+
+	token := os.Getenv("PURITY_ADMIN_TOKEN")
+	if token == "" {
+		return missingEnvErr("PURITY_ADMIN_TOKEN")
+	}
+	client := adminClient{
+		baseURL: strings.TrimSuffix(getEnvWithDefault("PURITY_ADMIN_URL", "http://localhost:8080"), "/") + "/v1/admin",
+		token:   token,
+		http:    &http.Client{Timeout: 5 * time.Minute},
+	}
+
+	req, err := newCacheCommandRequest(args, client.baseURL)
+	if err != nil {
+		return err
+	}
+	return client.do(req, out)
+}
+
+// newCacheCommandRequest returns the admin API request of the command args.
+func newCacheCommandRequest(args []string, baseURL string) (*http.Request, error) {
+	cmd := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	cmd.SetOutput(io.Discard)
+	query := url.Values{}
+
+	switch args[0] {
+	case "lookup":
+		byHash := cmd.Bool("hash", false, "look up by hash instead of URI")
+		if err := cmd.Parse(args[1:]); err != nil {
+			return nil, err
+		}
+		if cmd.NArg() == 0 {
+			return nil, fmt.Errorf("lookup needs at least one URI or hash")
+		}
+		param := "uri"
+		if *byHash {
+			param = "hash"
+		}
+		query[param] = cmd.Args()
+		return http.NewRequest(http.MethodGet, baseURL+"/cache/annotations?"+query.Encode(), nil)
+	case "purge":
+		var uris, hashes stringsFlag
+		cmd.Var(&uris, "uri", "purge the image with the URI")
+		cmd.Var(&hashes, "hash", "purge the image with the hash")
+		domain := cmd.String("domain", "", "purge the images on the domain")
+		after := cmd.String("after", "", "purge the images cached at or after the time")
+		before := cmd.String("before", "", "purge the images cached before the time")
+		if err := cmd.Parse(args[1:]); err != nil {
+			return nil, err
+		}
+		query["uri"], query["hash"] = uris, hashes
+		for name, val := range map[string]string{"domain": *domain, "after": *after, "before": *before} {
+			if val != "" {
+				query.Set(name, val)
+			}
+		}
+		if len(query.Encode()) == 0 {
+			return nil, fmt.Errorf("purge needs at least one of -uri, -hash, -domain, -after or -before")
+		}
+		return http.NewRequest(http.MethodDelete, baseURL+"/cache/annotations?"+query.Encode(), nil)
+	case "reclassify":
+		if len(args) < 2 {
+			return nil, fmt.Errorf("reclassify needs at least one URI")
+		}
+		body, err := json.Marshal(AnnotateReq{ImgURIList: args[1:]})
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(http.MethodPost, baseURL+"/cache/reclassify", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	case "stats":
+		oldest := cmd.Int("oldest", 10, "how many of the oldest annotations to show")
+		if err := cmd.Parse(args[1:]); err != nil {
+			return nil, err
+		}
+		query.Set("oldest", strconv.Itoa(*oldest))
+		return http.NewRequest(http.MethodGet, baseURL+"/cache/stats?"+query.Encode(), nil)
+	default:
+		return nil, fmt.Errorf("unsupported cache command %q\n\n%s", args[0], cacheUsage)
+	}
+}
+
+// adminClient calls the admin API of a running server, so cache changes
+// also reach its in-memory cache.
+type adminClient struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// do sends req and writes the indented JSON response to out, or returns the
+// error the server responded with.
+func (ac adminClient) do(req *http.Request, out io.Writer) error {
+	req.Header.Set("Authorization", "Bearer "+ac.token)
+	res, err := ac.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		var errRes errorBody
+		if json.Unmarshal(body, &errRes) == nil && errRes.Error.Message != "" {
+			return fmt.Errorf("%s: %s", res.Status, errRes.Error.Message)
+		}
+		return fmt.Errorf("%s", res.Status)
+	}
+
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, body, "", "  "); err != nil {
+		return err
+	}
+	_, err = indented.WriteTo(out)
+	return err
+}
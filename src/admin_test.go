@@ -0,0 +1,214 @@
+package src
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestAdminAuth(t *testing.T) {
+	newCtx := func(token string) appContext {
+		return appContext{
+			logger:       zerolog.Nop(),
+			licenseStore: newFakeLicenseStore(),
+			rateLimiter:  NewMemoryRateLimitStore(),
+			config:       Config{IPRateLimit: RateLimit{Rate: 1, Burst: 100}, AdminToken: token},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		status int
+	}{
+		{"disabled without a token", "", "Bearer ", http.StatusNotFound},
+		{"rejects a missing token", "secret", "", http.StatusUnauthorized},
+		{"rejects a wrong token", "secret", "Bearer wrong", http.StatusUnauthorized},
+		// The handler rejects the lookup without parameters.
+		{"accepts the token", "secret", "Bearer secret", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/admin/cache/annotations", nil)
+			if test.header != "" {
+				req.Header.Set("Authorization", test.header)
+			}
+			rec := httptest.NewRecorder()
+			newRouter(newCtx(test.token)).ServeHTTP(rec, req)
+			if rec.Code != test.status {
+				t.Fatalf("expected status %d but got %d: %s", test.status, rec.Code, rec.Body)
+			}
+		})
+	}
+
+	t.Run("isn't on unversioned routes", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/admin/cache/stats", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		newRouter(newCtx("secret")).ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotFound {
+			t.Fatalf("expected status 404 but got %d", rec.Code)
+		}
+	})
+}
+
+func TestAdminValidation(t *testing.T) {
+	ctx := appContext{
+		logger:       zerolog.Nop(),
+		licenseStore: newFakeLicenseStore(),
+		rateLimiter:  NewMemoryRateLimitStore(),
+		config:       Config{IPRateLimit: RateLimit{Rate: 1, Burst: 100}, AdminToken: "secret"},
+	}
+	router := newRouter(ctx)
+
+	uris := make([]string, maxReclassifyImages+1)
+	for i := range uris {
+		uris[i] = fmt.Sprintf("https://example.com/%d.jpg", i)
+	}
+	body, _ := json.Marshal(AnnotateReq{ImgURIList: uris})
+	tooMany := string(body)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+	}{
+		{"override with a bad verdict", http.MethodPut, "/v1/admin/cache/override", `{"uri": "https://example.com/a.jpg", "verdict": "maybe"}`},
+		{"override without an image", http.MethodPut, "/v1/admin/cache/override", `{"verdict": "allow"}`},
+		{"reclassify too many images", http.MethodPost, "/v1/admin/cache/reclassify", tooMany},
+		{"delete override without an image", http.MethodDelete, "/v1/admin/cache/override", ""},
+		{"reports with a bad status", http.MethodGet, "/v1/admin/reports?status=open", ""},
+		{"reports with a bad limit", http.MethodGet, "/v1/admin/reports?limit=0", ""},
+		{"resolve with a bad ID", http.MethodPost, "/v1/admin/reports/abc/resolve", `{"action": "accept"}`},
+		{"resolve with a bad action", http.MethodPost, "/v1/admin/reports/1/resolve", `{"action": "ignore"}`},
+		{"resolve with a bad verdict", http.MethodPost, "/v1/admin/reports/1/resolve", `{"action": "accept", "verdict": "maybe"}`},
+		{"stats with a bad count", http.MethodGet, "/v1/admin/cache/stats?oldest=-1", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+			req.Header.Set("Authorization", "Bearer secret")
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("expected status 400 but got %d: %s", rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestParseAnnotationFilter(t *testing.T) {
+	t.Run("parses every condition", func(t *testing.T) {
+		query := url.Values{
+			"uri":    {"https://example.com/a.jpg", "https://example.com/b.jpg"},
+			"hash":   {"abc"},
+			"domain": {"*.Example.com"},
+			"after":  {"2024-01-02"},
+			"before": {"2024-02-01T10:00:00Z"},
+		}
+		filter, err := parseAnnotationFilter(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(filter.URIs) != 2 || len(filter.Hashes) != 1 || filter.Domain != "*.example.com" {
+			t.Fatalf("unexpected filter %+v", filter)
+		}
+		if !filter.After.Equal(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)) || !filter.Before.Equal(time.Date(2024, 2, 1, 10, 0, 0, 0, time.UTC)) {
+			t.Fatalf("unexpected date range %s to %s", filter.After, filter.Before)
+		}
+	})
+
+	for name, query := range map[string]url.Values{
+		"empty":          {},
+		"invalid domain": {"domain": {"example.com/%"}},
+		"inner wildcard": {"domain": {"a.*.example.com"}},
+		"invalid date":   {"before": {"yesterday"}},
+	} {
+		t.Run("rejects "+name, func(t *testing.T) {
+			if _, err := parseAnnotationFilter(query); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestCacheCommand(t *testing.T) {
+	var got *http.Request
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			writeError(w, r, http.StatusUnauthorized, newAppError(codeUnauthorized, "invalid admin token"))
+			return
+		}
+		w.Write([]byte(`{"deleted":2}`))
+	}))
+	defer srv.Close()
+	t.Setenv("PURITY_ADMIN_URL", srv.URL+"/")
+	t.Setenv("PURITY_ADMIN_TOKEN", "secret")
+
+	tests := []struct {
+		args   []string
+		method string
+		path   string
+		query  url.Values
+	}{
+		{[]string{"lookup", "https://example.com/a.jpg"}, http.MethodGet, "/v1/admin/cache/annotations", url.Values{"uri": {"https://example.com/a.jpg"}}},
+		{[]string{"lookup", "-hash", "abc", "def"}, http.MethodGet, "/v1/admin/cache/annotations", url.Values{"hash": {"abc", "def"}}},
+		{[]string{"purge", "-domain", "*.example.com", "-uri", "a", "-uri", "b"}, http.MethodDelete, "/v1/admin/cache/annotations", url.Values{"domain": {"*.example.com"}, "uri": {"a", "b"}}},
+		{[]string{"stats", "-oldest", "3"}, http.MethodGet, "/v1/admin/cache/stats", url.Values{"oldest": {"3"}}},
+		{[]string{"reclassify", "https://example.com/a.jpg"}, http.MethodPost, "/v1/admin/cache/reclassify", url.Values{}},
+	}
+	for _, test := range tests {
+		t.Run(strings.Join(test.args, " "), func(t *testing.T) {
+			var out bytes.Buffer
+			if err := RunCacheCommand(test.args, &out); err != nil {
+				t.Fatal(err)
+			}
+			if got.Method != test.method || got.URL.Path != test.path || got.URL.Query().Encode() != test.query.Encode() {
+				t.Fatalf("expected %s %s?%s but got %s %s", test.method, test.path, test.query.Encode(), got.Method, got.URL)
+			}
+			if !strings.Contains(out.String(), `"deleted": 2`) {
+				t.Fatalf("expected the indented response but got %q", out.String())
+			}
+		})
+	}
+
+	t.Run("sends the URIs to reclassify", func(t *testing.T) {
+		if err := RunCacheCommand([]string{"reclassify", "a", "b"}, new(bytes.Buffer)); err != nil {
+			t.Fatal(err)
+		}
+		var req AnnotateReq
+		if err := json.Unmarshal(body, &req); err != nil || len(req.ImgURIList) != 2 {
+			t.Fatalf("expected 2 URIs but got %s", body)
+		}
+	})
+
+	t.Run("rejects bad commands", func(t *testing.T) {
+		for _, args := range [][]string{{}, {"drop"}, {"purge"}, {"lookup"}, {"reclassify"}} {
+			if err := RunCacheCommand(args, new(bytes.Buffer)); err == nil {
+				t.Fatalf("expected %v to fail", args)
+			}
+		}
+	})
+
+	t.Run("reports server errors", func(t *testing.T) {
+		t.Setenv("PURITY_ADMIN_TOKEN", "wrong")
+		err := RunCacheCommand([]string{"stats"}, new(bytes.Buffer))
+		if err == nil || !strings.Contains(err.Error(), "invalid admin token") {
+			t.Fatalf("expected the server's error but got %v", err)
+		}
+	})
+}
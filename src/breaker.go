@@ -0,0 +1,125 @@
+package src
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of calling a provider whose circuit
+// breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// circuitBreaker fails calls fast after threshold consecutive failures. Once
+// cooldown has passed a single probe call is let through; it closes the
+// breaker if it succeeds and reopens it otherwise. A zero threshold disables
+// the breaker.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     breakerState
+	failures  int
+	openedAt  time.Time
+	probing   bool
+
+	now      func() time.Time
+	onChange func(breakerState)
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration, onChange func(breakerState)) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now, onChange: onChange}
+}
+
+// Allow returns ErrCircuitOpen if a call must not be made. Every allowed
+// call must be followed by Done.
+func (b *circuitBreaker) Allow() error {
+	if b.threshold <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return ErrCircuitOpen
+		}
+		b.setState(breakerHalfOpen)
+	case breakerHalfOpen:
+		if b.probing {
+			return ErrCircuitOpen
+		}
+	}
+	if b.state == breakerHalfOpen {
+		b.probing = true
+	}
+	return nil
+}
+
+// Done records the outcome of an allowed call. Calls abandoned by the
+// caller are not held against the provider and should pass counted false.
+func (b *circuitBreaker) Done(err error, counted bool) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wasProbe := b.state == breakerHalfOpen && b.probing
+	if wasProbe {
+		b.probing = false
+	}
+	if !counted {
+		return
+	}
+
+	if err == nil {
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+
+	b.failures++
+	if wasProbe || b.failures >= b.threshold {
+		b.openedAt = b.now()
+		b.setState(breakerOpen)
+	}
+}
+
+// State returns the current state of the breaker.
+func (b *circuitBreaker) State() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *circuitBreaker) setState(state breakerState) {
+	if b.state == state {
+		return
+	}
+	b.state = state
+	if b.onChange != nil {
+		b.onChange(state)
+	}
+}
@@ -0,0 +1,71 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	errProvider := errors.New("provider down")
+	now := time.Now()
+	b := newCircuitBreaker(2, time.Minute, nil)
+	b.now = func() time.Time { return now }
+
+	call := func(err error) error {
+		if allowErr := b.Allow(); allowErr != nil {
+			return allowErr
+		}
+		b.Done(err, true)
+		return err
+	}
+
+	t.Run("opens after consecutive failures", func(t *testing.T) {
+		_ = call(errProvider)
+		if b.State() != breakerClosed {
+			t.Fatalf("expected closed after one failure but got %s", b.State())
+		}
+		_ = call(errProvider)
+		if b.State() != breakerOpen {
+			t.Fatalf("expected open after two failures but got %s", b.State())
+		}
+		if err := call(nil); !errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("expected open breaker to fail fast but got %v", err)
+		}
+	})
+
+	t.Run("lets a single probe through after the cooldown", func(t *testing.T) {
+		now = now.Add(time.Minute)
+		if err := b.Allow(); err != nil {
+			t.Fatalf("expected probe to be allowed but got %v", err)
+		}
+		if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("expected second call during the probe to fail fast but got %v", err)
+		}
+		b.Done(errProvider, true)
+		if b.State() != breakerOpen {
+			t.Fatalf("expected failed probe to reopen the breaker but got %s", b.State())
+		}
+	})
+
+	t.Run("ignores calls abandoned by the caller", func(t *testing.T) {
+		now = now.Add(time.Minute)
+		if err := b.Allow(); err != nil {
+			t.Fatal(err)
+		}
+		b.Done(context.Canceled, false)
+		if b.State() != breakerHalfOpen {
+			t.Fatalf("expected breaker to stay half-open but got %s", b.State())
+		}
+	})
+
+	t.Run("closes after a successful probe", func(t *testing.T) {
+		if err := call(nil); err != nil {
+			t.Fatal(err)
+		}
+		if b.State() != breakerClosed {
+			t.Fatalf("expected closed after a successful probe but got %s", b.State())
+		}
+	})
+}
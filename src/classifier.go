@@ -0,0 +1,396 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+// Classification strategies for combining several providers.
+const (
+	strategyFallback = "fallback" // Use the first provider that answers, in configured order.
+	strategyCheapest = "cheapest" // Start with the cheapest provider, escalating borderline images.
+	strategyEnsemble = "ensemble" // Ask every provider and take a vote per category.
+)
+
+// Kinds of errors classifying a single image.
+const (
+	errorKindFetchFailed       = "fetch_failed"       // The image could not be downloaded from its origin.
+	errorKindUnsupportedFormat = "unsupported_format" // The image is not in a format the provider reads.
+	errorKindProviderError     = "provider_error"     // The provider failed to classify the image.
+)
+
+// Classification is a provider's verdict on one image, on the SafeSearch
+// likelihood scale of ImageAnnotation: 0 unknown, then 1 very unlikely up to
+// 5 very likely. Categories a provider doesn't rate are left unknown.
+type Classification struct {
+	Adult    int16
+	Spoof    int16
+	Medical  int16
+	Violence int16
+	Racy     int16
+	Error    string // Error is set when the image could not be classified, such as when it can't be fetched.
+	Provider string // Provider names the providers that classified the image, joined by "+".
+
+	ErrorKind    string          // ErrorKind classifies Error.
+	ModelVersion string          // ModelVersion is the version of the providers' models, joined by "+".
+	Validators   imageValidators // Validators are the origin's validators, for providers that fetch the image.
+}
+
+// categories returns pointers to the category scores of c.
+func (c *Classification) categories() []*int16 {
+	return []*int16{&c.Adult, &c.Spoof, &c.Medical, &c.Violence, &c.Racy}
+}
+
+// Classifier classifies batches of images by URI.
+type Classifier interface {
+	// Classify returns one classification per URI, in the same order. Errors
+	// with single images are set on their classification; an error return
+	// means the whole batch failed.
+	Classify(ctx context.Context, uris []string) ([]Classification, error)
+	// Check returns an error if the classifier can't currently serve.
+	Check(ctx context.Context) error
+	Close() error
+}
+
+// likelihoodThresholds are the probabilities from which an image is rated
+// unlikely, possible, likely and very likely. Below the first it is very
+// unlikely.
+type likelihoodThresholds [4]float64
+
+var defaultLikelihoodThresholds = likelihoodThresholds{0.2, 0.4, 0.6, 0.8}
+
+// likelihood maps the probability p onto the likelihood scale.
+func (t likelihoodThresholds) likelihood(p float64) int16 {
+	l := pb.Likelihood_VERY_UNLIKELY
+	for i, threshold := range t {
+		if p >= threshold {
+			l = pb.Likelihood_UNLIKELY + pb.Likelihood(i)
+		}
+	}
+	return int16(l)
+}
+
+// NewClassifier returns the classifier for the configured providers and
+// strategy.
+func NewClassifier(ctx context.Context, config Config) (Classifier, error) {
+	providers := make([]*guardedClassifier, 0, len(config.ClassifierProviders))
+	for _, name := range config.ClassifierProviders {
+		var (
+			c   Classifier
+			err error
+		)
+		switch name {
+		case "google":
+			c, err = NewVisionClassifier(ctx, config)
+		case "aws":
+			c, err = NewRekognitionClassifier(ctx, config)
+		case "http":
+			c, err = NewModelServerClassifier(config)
+		default:
+			err = fmt.Errorf("unsupported classifier provider %q", name)
+		}
+		if err != nil {
+			for _, p := range providers {
+				p.Close()
+			}
+			return nil, fmt.Errorf("failed to create %s classifier: %v", name, err)
+		}
+		providers = append(providers, guardClassifier(name, c, config))
+	}
+
+	return newStrategyClassifier(config, providers)
+}
+
+// newStrategyClassifier combines providers with the configured strategy.
+func newStrategyClassifier(config Config, providers []*guardedClassifier) (Classifier, error) {
+	if len(providers) == 0 {
+		return nil, errors.New("no classifier providers configured")
+	}
+
+	switch config.ClassifierStrategy {
+	case strategyFallback:
+		return &fallbackClassifier{providers: providers}, nil
+	case strategyCheapest:
+		byCost := append([]*guardedClassifier(nil), providers...)
+		sort.SliceStable(byCost, func(i, j int) bool { return byCost[i].cost < byCost[j].cost })
+		return &escalatingClassifier{
+			providers:     byCost,
+			borderlineMin: int16(config.ClassifierBorderlineMin),
+			borderlineMax: int16(config.ClassifierBorderlineMax),
+		}, nil
+	case strategyEnsemble:
+		return &ensembleClassifier{providers: providers}, nil
+	}
+	return nil, fmt.Errorf("unsupported classifier strategy %q", config.ClassifierStrategy)
+}
+
+// guardedClassifier wraps a provider with a circuit breaker and metrics.
+type guardedClassifier struct {
+	Classifier
+	name    string
+	cost    float64
+	breaker *circuitBreaker
+}
+
+func guardClassifier(name string, c Classifier, config Config) *guardedClassifier {
+	return &guardedClassifier{
+		Classifier: c,
+		name:       name,
+		cost:       config.ClassifierCosts[name],
+		breaker: newCircuitBreaker(config.ClassifierBreakerThreshold, config.ClassifierBreakerCooldown, func(state breakerState) {
+			open := 0.0
+			if state == breakerOpen {
+				open = 1
+			}
+			classifierCircuitOpen.WithLabelValues(name).Set(open)
+		}),
+	}
+}
+
+func (g *guardedClassifier) Classify(ctx context.Context, uris []string) ([]Classification, error) {
+	if err := g.breaker.Allow(); err != nil {
+		classifierErrorsTotal.WithLabelValues(g.name).Inc()
+		return nil, fmt.Errorf("%s: %w", g.name, err)
+	}
+
+	start := time.Now()
+	res, err := g.Classifier.Classify(ctx, uris)
+	classifierBatchDuration.WithLabelValues(g.name).Observe(time.Since(start).Seconds())
+	if err == nil && len(res) != len(uris) {
+		err = fmt.Errorf("returned %d classifications for %d images", len(res), len(uris))
+	}
+
+	// A request abandoned by its caller says nothing about the provider's health.
+	g.breaker.Done(err, ctx.Err() == nil)
+	if err != nil {
+		classifierErrorsTotal.WithLabelValues(g.name).Inc()
+		return nil, fmt.Errorf("%s: %w", g.name, err)
+	}
+
+	for i := range res {
+		res[i].Provider = g.name
+	}
+	return res, nil
+}
+
+func (g *guardedClassifier) Check(ctx context.Context) error {
+	if g.breaker.State() == breakerOpen {
+		return fmt.Errorf("%s: %w", g.name, ErrCircuitOpen)
+	}
+	if err := g.Classifier.Check(ctx); err != nil {
+		return fmt.Errorf("%s: %w", g.name, err)
+	}
+	return nil
+}
+
+// providerSet implements Check and Close for strategies over providers.
+type providerSet []*guardedClassifier
+
+// Check fails if any provider is down, as the strategy is then degraded.
+func (ps providerSet) Check(ctx context.Context) error {
+	var errs []error
+	for _, p := range ps {
+		if err := p.Check(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (ps providerSet) Close() error {
+	var errs []error
+	for _, p := range ps {
+		if err := p.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// fallbackClassifier uses the first provider, in configured order, that
+// classifies the batch.
+type fallbackClassifier struct {
+	providers providerSet
+}
+
+func (fc *fallbackClassifier) Classify(ctx context.Context, uris []string) ([]Classification, error) {
+	var errs []error
+	for _, p := range fc.providers {
+		res, err := p.Classify(ctx, uris)
+		if err == nil {
+			return res, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (fc *fallbackClassifier) Check(ctx context.Context) error { return fc.providers.Check(ctx) }
+func (fc *fallbackClassifier) Close() error                    { return fc.providers.Close() }
+
+// escalatingClassifier classifies with the cheapest provider first and sends
+// images it rates borderline, or can't classify, on to the next cheapest.
+// Images keep their last verdict if a more expensive provider fails.
+type escalatingClassifier struct {
+	providers     providerSet // providers ordered by cost.
+	borderlineMin int16
+	borderlineMax int16
+}
+
+func (ec *escalatingClassifier) Classify(ctx context.Context, uris []string) ([]Classification, error) {
+	res := make([]Classification, len(uris))
+	classified := false
+	pending := make([]int, len(uris))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	var errs []error
+	for i, p := range ec.providers {
+		batch := make([]string, len(pending))
+		for j, idx := range pending {
+			batch[j] = uris[idx]
+		}
+
+		got, err := p.Classify(ctx, batch)
+		if err != nil {
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		classified = true
+
+		var next []int
+		for j, idx := range pending {
+			res[idx] = got[j]
+			if i < len(ec.providers)-1 && ec.needsEscalation(got[j]) {
+				next = append(next, idx)
+			}
+		}
+		if len(next) == 0 {
+			break
+		}
+		pending = next
+	}
+
+	if !classified {
+		return nil, errors.Join(errs...)
+	}
+	return res, nil
+}
+
+// needsEscalation reports whether a more expensive provider should have a
+// look at the image. Only the categories content is filtered on count.
+func (ec *escalatingClassifier) needsEscalation(c Classification) bool {
+	if c.Error != "" {
+		return true
+	}
+	for _, score := range []int16{c.Adult, c.Racy, c.Violence} {
+		if score >= ec.borderlineMin && score <= ec.borderlineMax {
+			return true
+		}
+	}
+	return false
+}
+
+func (ec *escalatingClassifier) Check(ctx context.Context) error { return ec.providers.Check(ctx) }
+func (ec *escalatingClassifier) Close() error                    { return ec.providers.Close() }
+
+// ensembleClassifier asks every provider concurrently and settles each
+// category of an image by vote. Providers that fail are left out of the vote.
+type ensembleClassifier struct {
+	providers providerSet
+}
+
+func (ec *ensembleClassifier) Classify(ctx context.Context, uris []string) ([]Classification, error) {
+	results := make([][]Classification, len(ec.providers))
+	errs := make([]error, len(ec.providers))
+
+	var wg sync.WaitGroup
+	for i, p := range ec.providers {
+		wg.Add(1)
+		go func(i int, p *guardedClassifier) {
+			defer wg.Done()
+			results[i], errs[i] = p.Classify(ctx, uris)
+		}(i, p)
+	}
+	wg.Wait()
+
+	var answered [][]Classification
+	for i := range results {
+		if errs[i] == nil {
+			answered = append(answered, results[i])
+		}
+	}
+	if len(answered) == 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	res := make([]Classification, len(uris))
+	for i := range uris {
+		votes := make([]Classification, 0, len(answered))
+		for _, r := range answered {
+			votes = append(votes, r[i])
+		}
+		res[i] = voteClassification(votes)
+	}
+	return res, nil
+}
+
+func (ec *ensembleClassifier) Check(ctx context.Context) error { return ec.providers.Check(ctx) }
+func (ec *ensembleClassifier) Close() error                    { return ec.providers.Close() }
+
+// voteClassification settles each category by the upper median of the
+// providers that rated it, so a tie leans towards filtering the image.
+// Votes with errors are ignored unless no provider classified the image.
+func voteClassification(votes []Classification) Classification {
+	var valid []Classification
+	for _, v := range votes {
+		if v.Error == "" {
+			valid = append(valid, v)
+		}
+	}
+	if len(valid) == 0 {
+		return votes[0]
+	}
+
+	var res Classification
+	providers := make([]string, 0, len(valid))
+	versions := make([]string, 0, len(valid))
+	for _, v := range valid {
+		providers = append(providers, v.Provider)
+		versions = append(versions, v.ModelVersion)
+		if res.Validators == (imageValidators{}) {
+			res.Validators = v.Validators
+		}
+	}
+	res.Provider = strings.Join(providers, "+")
+	res.ModelVersion = strings.Join(versions, "+")
+
+	for c, category := range res.categories() {
+		var scores []int16
+		for i := range valid {
+			if score := *valid[i].categories()[c]; score != int16(pb.Likelihood_UNKNOWN) {
+				scores = append(scores, score)
+			}
+		}
+		if len(scores) == 0 {
+			continue
+		}
+		sort.Slice(scores, func(i, j int) bool { return scores[i] < scores[j] })
+		*category = scores[len(scores)/2]
+	}
+	return res
+}
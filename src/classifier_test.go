@@ -0,0 +1,372 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+// fakeClassifier rates every image with the same score, or fails with err.
+type fakeClassifier struct {
+	score int16
+	err   error
+	calls [][]string
+}
+
+func (fc *fakeClassifier) Classify(ctx context.Context, uris []string) ([]Classification, error) {
+	fc.calls = append(fc.calls, uris)
+	if fc.err != nil {
+		return nil, fc.err
+	}
+	res := make([]Classification, len(uris))
+	for i := range res {
+		res[i] = Classification{Adult: fc.score, Spoof: fc.score, Medical: fc.score, Violence: fc.score, Racy: fc.score}
+	}
+	return res, nil
+}
+
+func (fc *fakeClassifier) Check(ctx context.Context) error { return fc.err }
+func (fc *fakeClassifier) Close() error                    { return nil }
+
+// scoreByURI rates each image by its URI, to tell images apart in a batch.
+type scoreByURI map[string]int16
+
+func (s scoreByURI) Classify(ctx context.Context, uris []string) ([]Classification, error) {
+	res := make([]Classification, len(uris))
+	for i, uri := range uris {
+		res[i] = Classification{Adult: s[uri], Racy: s[uri], Violence: s[uri]}
+	}
+	return res, nil
+}
+
+func (s scoreByURI) Check(ctx context.Context) error { return nil }
+func (s scoreByURI) Close() error                    { return nil }
+
+func TestClassifierStrategies(t *testing.T) {
+	uris := []string{"https://example.com/a.jpg", "https://example.com/b.jpg"}
+	possible := int16(pb.Likelihood_POSSIBLE)
+	likely := int16(pb.Likelihood_LIKELY)
+	veryLikely := int16(pb.Likelihood_VERY_LIKELY)
+
+	t.Run("fallback uses the next provider on failure", func(t *testing.T) {
+		config := Config{ClassifierStrategy: strategyFallback}
+		first := &fakeClassifier{err: errors.New("unavailable")}
+		second := &fakeClassifier{score: likely}
+		c, err := newStrategyClassifier(config, []*guardedClassifier{
+			guardClassifier("google", first, config),
+			guardClassifier("aws", second, config),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := c.Classify(context.Background(), uris)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res[0].Adult != likely || res[0].Provider != "aws" {
+			t.Fatalf("expected a likely verdict from aws but got %d from %q", res[0].Adult, res[0].Provider)
+		}
+		if c.Check(context.Background()) == nil {
+			t.Fatal("expected the check to report the failing provider")
+		}
+	})
+
+	t.Run("fallback fails when every provider fails", func(t *testing.T) {
+		config := Config{ClassifierStrategy: strategyFallback}
+		c, err := newStrategyClassifier(config, []*guardedClassifier{
+			guardClassifier("google", &fakeClassifier{err: errors.New("unavailable")}, config),
+			guardClassifier("aws", &fakeClassifier{err: errors.New("throttled")}, config),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Classify(context.Background(), uris); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("cheapest escalates only borderline images", func(t *testing.T) {
+		config := Config{
+			ClassifierStrategy:      strategyCheapest,
+			ClassifierCosts:         map[string]float64{"google": 1.5, "aws": 1},
+			ClassifierBorderlineMin: int(possible),
+			ClassifierBorderlineMax: int(possible),
+		}
+		cheap := scoreByURI{uris[0]: possible, uris[1]: veryLikely}
+		expensive := &fakeClassifier{score: likely}
+		c, err := newStrategyClassifier(config, []*guardedClassifier{
+			guardClassifier("google", expensive, config),
+			guardClassifier("aws", cheap, config),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := c.Classify(context.Background(), uris)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(expensive.calls) != 1 || len(expensive.calls[0]) != 1 || expensive.calls[0][0] != uris[0] {
+			t.Fatalf("expected only the borderline image to be escalated but got %v", expensive.calls)
+		}
+		if res[0].Adult != likely || res[0].Provider != "google" {
+			t.Errorf("expected the escalated verdict from google but got %d from %q", res[0].Adult, res[0].Provider)
+		}
+		if res[1].Adult != veryLikely || res[1].Provider != "aws" {
+			t.Errorf("expected the cheap verdict from aws but got %d from %q", res[1].Adult, res[1].Provider)
+		}
+	})
+
+	t.Run("cheapest keeps the cheap verdict if escalation fails", func(t *testing.T) {
+		config := Config{
+			ClassifierStrategy:      strategyCheapest,
+			ClassifierCosts:         map[string]float64{"google": 1.5, "aws": 1},
+			ClassifierBorderlineMin: int(possible),
+			ClassifierBorderlineMax: int(possible),
+		}
+		c, err := newStrategyClassifier(config, []*guardedClassifier{
+			guardClassifier("google", &fakeClassifier{err: errors.New("unavailable")}, config),
+			guardClassifier("aws", &fakeClassifier{score: possible}, config),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := c.Classify(context.Background(), uris)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res[0].Adult != possible || res[0].Provider != "aws" {
+			t.Fatalf("expected the cheap verdict but got %d from %q", res[0].Adult, res[0].Provider)
+		}
+	})
+
+	t.Run("ensemble takes the upper median", func(t *testing.T) {
+		config := Config{ClassifierStrategy: strategyEnsemble}
+		c, err := newStrategyClassifier(config, []*guardedClassifier{
+			guardClassifier("google", &fakeClassifier{score: possible}, config),
+			guardClassifier("aws", &fakeClassifier{score: veryLikely}, config),
+			guardClassifier("http", &fakeClassifier{err: errors.New("unavailable")}, config),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := c.Classify(context.Background(), uris)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res[0].Adult != veryLikely || res[0].Provider != "google+aws" {
+			t.Fatalf("expected a very likely verdict from google+aws but got %d from %q", res[0].Adult, res[0].Provider)
+		}
+	})
+
+	t.Run("ensemble ignores unrated categories", func(t *testing.T) {
+		votes := []Classification{
+			{Adult: likely, Medical: int16(pb.Likelihood_UNKNOWN), Provider: "aws"},
+			{Adult: possible, Medical: possible, Provider: "google"},
+			{Error: "failed to fetch image", Provider: "http"},
+		}
+		res := voteClassification(votes)
+		if res.Adult != likely || res.Medical != possible {
+			t.Fatalf("expected likely adult and possible medical but got %d and %d", res.Adult, res.Medical)
+		}
+	})
+
+	t.Run("rejects unknown strategies", func(t *testing.T) {
+		config := Config{ClassifierStrategy: "random"}
+		if _, err := newStrategyClassifier(config, []*guardedClassifier{guardClassifier("google", &fakeClassifier{}, config)}); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
+
+func TestLikelihoodThresholds(t *testing.T) {
+	tests := []struct {
+		p    float64
+		want pb.Likelihood
+	}{
+		{0, pb.Likelihood_VERY_UNLIKELY},
+		{0.2, pb.Likelihood_UNLIKELY},
+		{0.5, pb.Likelihood_POSSIBLE},
+		{0.79, pb.Likelihood_LIKELY},
+		{1, pb.Likelihood_VERY_LIKELY},
+	}
+	for _, test := range tests {
+		if got := defaultLikelihoodThresholds.likelihood(test.p); got != int16(test.want) {
+			t.Errorf("expected %s for %v but got %d", test.want, test.p, got)
+		}
+	}
+}
+
+func TestRekognitionClassifier(t *testing.T) {
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.jpg" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("not really a jpeg"))
+	}))
+	defer images.Close()
+
+	rekognition := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") != "RekognitionService.DetectModerationLabels" {
+			http.Error(w, "unexpected operation", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.Write([]byte(`{"ModerationLabels":[{"Name":"Explicit Nudity","Confidence":95,"ParentName":""}]}`))
+	}))
+	defer rekognition.Close()
+
+	cfg := aws.Config{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("key", "secret", ""),
+	}
+	rc := newRekognitionClassifier(cfg, Config{
+		AWSRekognitionEndpoint: rekognition.URL,
+		ImageFetchAllowPrivate: true,
+		ClassifierTimeout:      time.Second,
+	})
+	defer rc.Close()
+
+	res, err := rc.Classify(context.Background(), []string{images.URL + "/a.jpg", images.URL + "/missing.jpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[0].Adult != int16(pb.Likelihood_VERY_LIKELY) || res[0].Racy != int16(pb.Likelihood_VERY_UNLIKELY) || res[0].Medical != int16(pb.Likelihood_UNKNOWN) {
+		t.Errorf("expected very likely adult, very unlikely racy and unknown medical but got %+v", res[0])
+	}
+	if res[1].Error == "" {
+		t.Error("expected an error for the missing image")
+	}
+	if err := rc.Check(context.Background()); err != nil {
+		t.Error(err)
+	}
+
+	t.Run("refuses private addresses", func(t *testing.T) {
+		rc := newRekognitionClassifier(cfg, Config{AWSRekognitionEndpoint: rekognition.URL, ClassifierTimeout: time.Second})
+		defer rc.Close()
+
+		res, err := rc.Classify(context.Background(), []string{images.URL + "/a.jpg"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res[0].Error == "" {
+			t.Fatal("expected the loopback image to be refused")
+		}
+	})
+}
+
+func TestRekognitionClassifierRetries(t *testing.T) {
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer images.Close()
+
+	var mu sync.Mutex
+	calls := map[string]int{}
+	rekognition := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input struct{ Image struct{ Bytes []byte } }
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		img := string(input.Image.Bytes)
+		mu.Lock()
+		calls[img]++
+		n := calls[img]
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		switch {
+		case img == "/throttled.jpg" && n == 1:
+			w.Header().Set("X-Amzn-ErrorType", "ThrottlingException")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"ThrottlingException","message":"slow down"}`))
+		case img == "/down.jpg":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{}`))
+		default:
+			w.Write([]byte(`{"ModerationLabels":[]}`))
+		}
+	}))
+	defer rekognition.Close()
+
+	cfg := aws.Config{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("key", "secret", ""),
+	}
+	rc := newRekognitionClassifier(cfg, Config{
+		AWSRekognitionEndpoint: rekognition.URL,
+		ImageFetchAllowPrivate: true,
+		ClassifierTimeout:      time.Second,
+		ClassifierMaxRetries:   2,
+		ClassifierRetryBackoff: time.Millisecond,
+	})
+	defer rc.Close()
+
+	t.Run("retries throttling and server errors per image", func(t *testing.T) {
+		res, err := rc.Classify(context.Background(), []string{images.URL + "/throttled.jpg", images.URL + "/down.jpg"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res[0].Error != "" {
+			t.Errorf("expected the throttled image to succeed on retry but got %q", res[0].Error)
+		}
+		if res[1].Error == "" || res[1].ErrorKind != errorKindProviderError {
+			t.Errorf("expected a provider error for the image that kept failing but got %+v", res[1])
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if calls["/throttled.jpg"] != 2 {
+			t.Errorf("expected 2 calls for the throttled image but got %d", calls["/throttled.jpg"])
+		}
+		if calls["/down.jpg"] != 3 {
+			t.Errorf("expected 3 calls for the failing image but got %d", calls["/down.jpg"])
+		}
+	})
+
+	t.Run("fails the batch when every image fails", func(t *testing.T) {
+		if _, err := rc.Classify(context.Background(), []string{images.URL + "/down.jpg"}); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
+
+func TestIsPublicAddress(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+		{"100.128.0.1", true},
+		{"::1", false},
+		{"fd00::1", false},
+	}
+	for _, test := range tests {
+		if got := isPublicAddress(net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("expected %v for %s but got %v", test.want, test.ip, got)
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package src
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/rs/zerolog"
 )
@@ -16,12 +19,71 @@ type Config struct {
 	DBPassword           string // DBPassword is the password for the DBUser postgres account.
 	DBSSLMode            string // DBSSLMode sets the SSL mode of the postgres client.
 	LogLevel             string // LogLevel is the level of logging for the application.
+	LogFormat            string // LogFormat is the log output format, "console" or "json".
 	StripeKey            string // StripeKey is for making Stripe API requests.
 	EmailName            string // Name on email license delivery.
 	SendgridAPIKey       string // SendgridAPIKey is for sending emails.
 	StripeWebhookSecret  string // Stripe webhook secret.
 	EmailFrom            string // From address for email license delivery.
 	TrialLicenseMaxUsage int    // TrialLicenseMaxUsage is the maximum image filters for a trial license.
+
+	RateLimitBackend    string    // RateLimitBackend is where rate limit buckets are kept, "memory" or "postgres".
+	RateLimitTrustProxy bool      // RateLimitTrustProxy keys IP rate limits on X-Forwarded-For instead of the remote address.
+	RateLimitProxyHops  int       // RateLimitProxyHops is how many trusted proxies append to X-Forwarded-For in front of the server.
+	IPRateLimit         RateLimit // IPRateLimit is the per client IP limit for every route, checked before any license.
+
+	ReadTimeout       time.Duration // ReadTimeout is the maximum duration for reading an entire request.
+	ReadHeaderTimeout time.Duration // ReadHeaderTimeout is the maximum duration for reading request headers.
+	WriteTimeout      time.Duration // WriteTimeout is the maximum duration before timing out writes of the response.
+	IdleTimeout       time.Duration // IdleTimeout is how long keep-alive connections are kept idle.
+	ShutdownTimeout   time.Duration // ShutdownTimeout is how long shutdown waits for in-flight work.
+	ShutdownDelay     time.Duration // ShutdownDelay is how long the server keeps accepting connections while it reports unready, before shutting down.
+
+	DBTimeout         time.Duration // DBTimeout bounds each database call. 0 leaves it to the request.
+	ClassifierTimeout time.Duration // ClassifierTimeout bounds each classifier batch request. 0 leaves it to the request.
+
+	ClassifierProviders     []string           // ClassifierProviders are the classification providers, "google", "aws" or "http", in order of preference.
+	ClassifierStrategy      string             // ClassifierStrategy combines the providers, "fallback", "cheapest" or "ensemble".
+	ClassifierCosts         map[string]float64 // ClassifierCosts is the price per 1000 images of each provider, used by the cheapest strategy.
+	ClassifierBorderlineMin int                // ClassifierBorderlineMin is the lowest likelihood the cheapest strategy escalates.
+	ClassifierBorderlineMax int                // ClassifierBorderlineMax is the highest likelihood the cheapest strategy escalates.
+
+	ClassifierConnPool         int           // ClassifierConnPool is the number of gRPC connections to Vision.
+	ClassifierMaxRetries       int           // ClassifierMaxRetries is how often a batch failing with a transient error is retried.
+	ClassifierRetryBackoff     time.Duration // ClassifierRetryBackoff is the delay before the first retry, doubled for each further one.
+	ClassifierBreakerThreshold int           // ClassifierBreakerThreshold is the consecutive failures that open the circuit breaker. 0 disables it.
+	ClassifierBreakerCooldown  time.Duration // ClassifierBreakerCooldown is how long the open breaker fails fast before probing again.
+
+	DegradedPolicy string // DegradedPolicy settles images that can't be classified, "unknown", "fail-open" or "fail-closed".
+
+	CacheTTL                  time.Duration // CacheTTL is how long annotations are served before they are stale. 0 keeps them forever.
+	CacheStaleWhileRevalidate time.Duration // CacheStaleWhileRevalidate is how long past CacheTTL stale annotations are served while revalidated in the background.
+	CacheErrorTTL             time.Duration // CacheErrorTTL is how long an image that failed to classify is served from the cache before it is retried, doubled on each retry.
+	CacheErrorMaxRetries      int           // CacheErrorMaxRetries is how many times an image is retried before its error is kept like a verdict. 0 keeps errors at once.
+	CacheLRUSize              int           // CacheLRUSize is how many annotations are kept in memory in front of the database. 0 disables it.
+	CacheLRUTTL               time.Duration // CacheLRUTTL is how long annotations are kept in memory, bounding how long changes made by other instances go unseen.
+	CoalescedBilling          string        // CoalescedBilling bills images classified once for several requests, "leader" or "split".
+	RuleCacheTTL              time.Duration // RuleCacheTTL is how long license rules are kept in memory, bounding how long changes made by other instances go unseen. 0 disables it.
+
+	AWSRegion              string                          // AWSRegion is the region of the Rekognition API.
+	AWSRekognitionEndpoint string                          // AWSRekognitionEndpoint overrides the Rekognition endpoint, such as for a local stand-in.
+	ModelServerURL         string                          // ModelServerURL is the classify endpoint of the self-hosted model server.
+	ModelServerThresholds  map[string]likelihoodThresholds // ModelServerThresholds calibrate the model server's probabilities per category.
+	ImageFetchAllowPrivate bool                            // ImageFetchAllowPrivate lets providers that fetch images themselves reach private addresses.
+
+	AdminToken string // AdminToken is the bearer token of the admin API. The admin API is off when empty.
+
+	TLSCertFile       string        // TLSCertFile is the PEM certificate to serve TLS with. TLS is off when empty.
+	TLSKeyFile        string        // TLSKeyFile is the PEM private key of TLSCertFile.
+	TLSMinVersion     uint16        // TLSMinVersion is the minimum accepted TLS version.
+	TLSClientCAFile   string        // TLSClientCAFile is the PEM CA bundle client certificates are verified against.
+	TLSRequireClient  bool          // TLSRequireClient rejects clients without a valid certificate instead of only verifying given ones.
+	TLSReloadInterval time.Duration // TLSReloadInterval is how often the certificate files are checked for changes.
+
+	TracingExporter    string  // TracingExporter is where traces are sent, "none", "stdout" or "otlp".
+	TracingSampleRatio float64 // TracingSampleRatio is the fraction of new traces that are sampled.
+
+	MetricsAddr string // MetricsAddr is the address of the metrics listener, kept apart from the API port. Metrics are off when empty.
 }
 
 func missingEnvErr(envVar string) error {
@@ -37,10 +99,6 @@ func newConfig() (Config, error) {
 		SendgridAPIKey      = os.Getenv("SENDGRID_API_KEY")
 	)
 
-	if os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") == "" {
-		return Config{}, missingEnvErr("GOOGLE_APPLICATION_CREDENTIALS")
-	}
-
 	if StripeKey == "" {
 		return Config{}, missingEnvErr("STRIPE_KEY")
 	}
@@ -61,6 +119,242 @@ func newConfig() (Config, error) {
 		return Config{}, missingEnvErr("SENDGRID_API_KEY")
 	}
 
+	rateLimitBackend := getEnvWithDefault("PURITY_RATE_LIMIT_BACKEND", "memory")
+	if rateLimitBackend != "memory" && rateLimitBackend != "postgres" {
+		return Config{}, fmt.Errorf("PURITY_RATE_LIMIT_BACKEND must be \"memory\" or \"postgres\", got %q", rateLimitBackend)
+	}
+
+	ipRate, err := getEnvFloatWithDefault("PURITY_IP_RATE_LIMIT", 2)
+	if err != nil {
+		return Config{}, err
+	}
+
+	ipBurst, err := getEnvIntWithDefault("PURITY_IP_RATE_LIMIT_BURST", 20)
+	if err != nil {
+		return Config{}, err
+	}
+
+	trustProxy, err := getEnvBoolWithDefault("PURITY_RATE_LIMIT_TRUST_PROXY", false)
+	if err != nil {
+		return Config{}, err
+	}
+
+	proxyHops, err := getEnvIntWithDefault("PURITY_RATE_LIMIT_PROXY_HOPS", 1)
+	if err != nil {
+		return Config{}, err
+	}
+	if proxyHops < 1 {
+		return Config{}, fmt.Errorf("PURITY_RATE_LIMIT_PROXY_HOPS must be at least 1, got %d", proxyHops)
+	}
+
+	readTimeout, err := getEnvDurationWithDefault("PURITY_HTTP_READ_TIMEOUT", 15*time.Second)
+	if err != nil {
+		return Config{}, err
+	}
+
+	readHeaderTimeout, err := getEnvDurationWithDefault("PURITY_HTTP_READ_HEADER_TIMEOUT", 5*time.Second)
+	if err != nil {
+		return Config{}, err
+	}
+
+	writeTimeout, err := getEnvDurationWithDefault("PURITY_HTTP_WRITE_TIMEOUT", 60*time.Second)
+	if err != nil {
+		return Config{}, err
+	}
+
+	idleTimeout, err := getEnvDurationWithDefault("PURITY_HTTP_IDLE_TIMEOUT", 120*time.Second)
+	if err != nil {
+		return Config{}, err
+	}
+
+	shutdownTimeout, err := getEnvDurationWithDefault("PURITY_SHUTDOWN_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return Config{}, err
+	}
+
+	shutdownDelay, err := getEnvDurationWithDefault("PURITY_SHUTDOWN_DELAY", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	dbTimeout, err := getEnvDurationWithDefault("PURITY_DB_TIMEOUT", 5*time.Second)
+	if err != nil {
+		return Config{}, err
+	}
+
+	classifierTimeout, err := getEnvDurationWithDefault("PURITY_CLASSIFIER_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return Config{}, err
+	}
+
+	classifierProviders := getEnvListWithDefault("PURITY_CLASSIFIER_PROVIDERS", []string{"google"})
+	for _, provider := range classifierProviders {
+		if provider != "google" && provider != "aws" && provider != "http" {
+			return Config{}, fmt.Errorf("PURITY_CLASSIFIER_PROVIDERS must only list \"google\", \"aws\" or \"http\", got %q", provider)
+		}
+	}
+
+	classifierStrategy := getEnvWithDefault("PURITY_CLASSIFIER_STRATEGY", strategyFallback)
+	if classifierStrategy != strategyFallback && classifierStrategy != strategyCheapest && classifierStrategy != strategyEnsemble {
+		return Config{}, fmt.Errorf("PURITY_CLASSIFIER_STRATEGY must be \"fallback\", \"cheapest\" or \"ensemble\", got %q", classifierStrategy)
+	}
+
+	classifierCosts, err := getEnvFloatMapWithDefault("PURITY_CLASSIFIER_COSTS", map[string]float64{"google": 1.5, "aws": 1, "http": 0})
+	if err != nil {
+		return Config{}, err
+	}
+
+	classifierBorderlineMin, err := getEnvIntWithDefault("PURITY_CLASSIFIER_BORDERLINE_MIN", 3)
+	if err != nil {
+		return Config{}, err
+	}
+
+	classifierBorderlineMax, err := getEnvIntWithDefault("PURITY_CLASSIFIER_BORDERLINE_MAX", 3)
+	if err != nil {
+		return Config{}, err
+	}
+
+	modelServerURL := getEnvWithDefault("PURITY_MODEL_SERVER_URL", "")
+	for _, provider := range classifierProviders {
+		if provider == "google" && os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") == "" {
+			return Config{}, missingEnvErr("GOOGLE_APPLICATION_CREDENTIALS")
+		}
+		if provider == "http" && modelServerURL == "" {
+			return Config{}, missingEnvErr("PURITY_MODEL_SERVER_URL")
+		}
+	}
+
+	modelServerThresholds := make(map[string]likelihoodThresholds)
+	defaultThresholds, err := getEnvThresholdsWithDefault("PURITY_MODEL_SERVER_THRESHOLDS", defaultLikelihoodThresholds)
+	if err != nil {
+		return Config{}, err
+	}
+	for _, category := range []string{"adult", "spoof", "medical", "violence", "racy"} {
+		thresholds, err := getEnvThresholdsWithDefault("PURITY_MODEL_SERVER_THRESHOLDS_"+strings.ToUpper(category), defaultThresholds)
+		if err != nil {
+			return Config{}, err
+		}
+		modelServerThresholds[category] = thresholds
+	}
+
+	cacheTTL, err := getEnvDurationWithDefault("PURITY_CACHE_TTL", 30*24*time.Hour)
+	if err != nil {
+		return Config{}, err
+	}
+
+	cacheStaleWhileRevalidate, err := getEnvDurationWithDefault("PURITY_CACHE_STALE_WHILE_REVALIDATE", 7*24*time.Hour)
+	if err != nil {
+		return Config{}, err
+	}
+
+	cacheErrorTTL, err := getEnvDurationWithDefault("PURITY_CACHE_ERROR_TTL", 10*time.Minute)
+	if err != nil {
+		return Config{}, err
+	}
+
+	cacheErrorMaxRetries, err := getEnvIntWithDefault("PURITY_CACHE_ERROR_MAX_RETRIES", 5)
+	if err != nil {
+		return Config{}, err
+	}
+
+	cacheLRUSize, err := getEnvIntWithDefault("PURITY_CACHE_LRU_SIZE", 10000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	cacheLRUTTL, err := getEnvDurationWithDefault("PURITY_CACHE_LRU_TTL", time.Minute)
+	if err != nil {
+		return Config{}, err
+	}
+
+	ruleCacheTTL, err := getEnvDurationWithDefault("PURITY_RULE_CACHE_TTL", time.Minute)
+	if err != nil {
+		return Config{}, err
+	}
+
+	coalescedBilling := getEnvWithDefault("PURITY_COALESCED_BILLING", coalescedBillingLeader)
+	if coalescedBilling != coalescedBillingLeader && coalescedBilling != coalescedBillingSplit {
+		return Config{}, fmt.Errorf("PURITY_COALESCED_BILLING must be \"leader\" or \"split\", got %q", coalescedBilling)
+	}
+
+	imageFetchAllowPrivate, err := getEnvBoolWithDefault("PURITY_IMAGE_FETCH_ALLOW_PRIVATE", false)
+	if err != nil {
+		return Config{}, err
+	}
+
+	classifierConnPool, err := getEnvIntWithDefault("PURITY_CLASSIFIER_CONN_POOL", 4)
+	if err != nil {
+		return Config{}, err
+	}
+	if classifierConnPool < 1 {
+		return Config{}, errors.New("PURITY_CLASSIFIER_CONN_POOL must be at least 1")
+	}
+
+	classifierMaxRetries, err := getEnvIntWithDefault("PURITY_CLASSIFIER_MAX_RETRIES", 2)
+	if err != nil {
+		return Config{}, err
+	}
+
+	classifierRetryBackoff, err := getEnvDurationWithDefault("PURITY_CLASSIFIER_RETRY_BACKOFF", 200*time.Millisecond)
+	if err != nil {
+		return Config{}, err
+	}
+
+	classifierBreakerThreshold, err := getEnvIntWithDefault("PURITY_CLASSIFIER_BREAKER_THRESHOLD", 5)
+	if err != nil {
+		return Config{}, err
+	}
+
+	classifierBreakerCooldown, err := getEnvDurationWithDefault("PURITY_CLASSIFIER_BREAKER_COOLDOWN", 30*time.Second)
+	if err != nil {
+		return Config{}, err
+	}
+
+	degradedPolicy := getEnvWithDefault("PURITY_DEGRADED_POLICY", degradedPolicyUnknown)
+	if degradedPolicy != degradedPolicyUnknown && degradedPolicy != degradedPolicyOpen && degradedPolicy != degradedPolicyClosed {
+		return Config{}, fmt.Errorf("PURITY_DEGRADED_POLICY must be \"unknown\", \"fail-open\" or \"fail-closed\", got %q", degradedPolicy)
+	}
+
+	tlsCertFile := os.Getenv("PURITY_TLS_CERT_FILE")
+	tlsKeyFile := os.Getenv("PURITY_TLS_KEY_FILE")
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		return Config{}, errors.New("PURITY_TLS_CERT_FILE and PURITY_TLS_KEY_FILE must be set together")
+	}
+
+	tlsMinVersion, err := parseTLSVersion(getEnvWithDefault("PURITY_TLS_MIN_VERSION", "1.2"))
+	if err != nil {
+		return Config{}, err
+	}
+
+	tlsClientCAFile := os.Getenv("PURITY_TLS_CLIENT_CA_FILE")
+	tlsRequireClient, err := getEnvBoolWithDefault("PURITY_TLS_REQUIRE_CLIENT_CERT", false)
+	if err != nil {
+		return Config{}, err
+	}
+	if tlsRequireClient && tlsClientCAFile == "" {
+		return Config{}, missingEnvErr("PURITY_TLS_CLIENT_CA_FILE")
+	}
+
+	tlsReloadInterval, err := getEnvDurationWithDefault("PURITY_TLS_RELOAD_INTERVAL", 10*time.Second)
+	if err != nil {
+		return Config{}, err
+	}
+
+	logFormat := getEnvWithDefault("PURITY_LOG_FORMAT", "console")
+	if logFormat != "console" && logFormat != "json" {
+		return Config{}, fmt.Errorf("PURITY_LOG_FORMAT must be \"console\" or \"json\", got %q", logFormat)
+	}
+
+	tracingExporter := getEnvWithDefault("PURITY_TRACING_EXPORTER", "none")
+	if tracingExporter != "none" && tracingExporter != "stdout" && tracingExporter != "otlp" {
+		return Config{}, fmt.Errorf("PURITY_TRACING_EXPORTER must be \"none\", \"stdout\" or \"otlp\", got %q", tracingExporter)
+	}
+
+	tracingSampleRatio, err := getEnvFloatWithDefault("PURITY_TRACING_SAMPLE_RATIO", 1)
+	if err != nil {
+		return Config{}, err
+	}
+
 	return Config{
 		DBHost:               getEnvWithDefault("PURITY_DB_HOST", "localhost"),
 		DBPort:               getEnvWithDefault("PURITY_DB_PORT", "5432"),
@@ -69,12 +363,67 @@ func newConfig() (Config, error) {
 		DBPassword:           getEnvWithDefault("PURITY_DB_PASS", ""),
 		DBSSLMode:            getEnvWithDefault("PURITY_DB_SSL_MODE", "disable"),
 		LogLevel:             getEnvWithDefault("PURITY_LOG_LEVEL", strconv.Itoa(int(zerolog.InfoLevel))),
+		LogFormat:            logFormat,
 		StripeKey:            StripeKey,
 		StripeWebhookSecret:  StripeWebhookSecret,
 		EmailName:            EmailName,
 		EmailFrom:            EmailFrom,
 		SendgridAPIKey:       SendgridAPIKey,
 		TrialLicenseMaxUsage: 1000,
+		RateLimitBackend:     rateLimitBackend,
+		RateLimitTrustProxy:  trustProxy,
+		RateLimitProxyHops:   proxyHops,
+		IPRateLimit:          RateLimit{Rate: ipRate, Burst: ipBurst},
+		ReadTimeout:          readTimeout,
+		ReadHeaderTimeout:    readHeaderTimeout,
+		WriteTimeout:         writeTimeout,
+		IdleTimeout:          idleTimeout,
+		ShutdownTimeout:      shutdownTimeout,
+		ShutdownDelay:        shutdownDelay,
+		DBTimeout:            dbTimeout,
+		ClassifierTimeout:    classifierTimeout,
+
+		ClassifierProviders:     classifierProviders,
+		ClassifierStrategy:      classifierStrategy,
+		ClassifierCosts:         classifierCosts,
+		ClassifierBorderlineMin: classifierBorderlineMin,
+		ClassifierBorderlineMax: classifierBorderlineMax,
+
+		ClassifierConnPool:         classifierConnPool,
+		ClassifierMaxRetries:       classifierMaxRetries,
+		ClassifierRetryBackoff:     classifierRetryBackoff,
+		ClassifierBreakerThreshold: classifierBreakerThreshold,
+		ClassifierBreakerCooldown:  classifierBreakerCooldown,
+
+		DegradedPolicy: degradedPolicy,
+
+		CacheTTL:                  cacheTTL,
+		CacheStaleWhileRevalidate: cacheStaleWhileRevalidate,
+		CacheErrorTTL:             cacheErrorTTL,
+		CacheErrorMaxRetries:      cacheErrorMaxRetries,
+		CacheLRUSize:              cacheLRUSize,
+		CacheLRUTTL:               cacheLRUTTL,
+		CoalescedBilling:          coalescedBilling,
+		RuleCacheTTL:              ruleCacheTTL,
+
+		AWSRegion:              getEnvWithDefault("PURITY_AWS_REGION", "us-east-1"),
+		AWSRekognitionEndpoint: getEnvWithDefault("PURITY_AWS_REKOGNITION_ENDPOINT", ""),
+		ModelServerURL:         modelServerURL,
+		ModelServerThresholds:  modelServerThresholds,
+		ImageFetchAllowPrivate: imageFetchAllowPrivate,
+
+		AdminToken: os.Getenv("PURITY_ADMIN_TOKEN"),
+
+		TLSCertFile:        tlsCertFile,
+		TLSKeyFile:         tlsKeyFile,
+		TLSMinVersion:      tlsMinVersion,
+		TLSClientCAFile:    tlsClientCAFile,
+		TLSRequireClient:   tlsRequireClient,
+		TLSReloadInterval:  tlsReloadInterval,
+		TracingExporter:    tracingExporter,
+		TracingSampleRatio: tracingSampleRatio,
+
+		MetricsAddr: getEnvWithDefault("PURITY_METRICS_ADDR", ":9091"),
 	}, nil
 }
 
@@ -85,3 +434,120 @@ func getEnvWithDefault(name string, def string) string {
 	}
 	return res
 }
+
+func getEnvIntWithDefault(name string, def int) (int, error) {
+	res, found := os.LookupEnv(name)
+	if !found {
+		return def, nil
+	}
+	val, err := strconv.Atoi(res)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be an integer: %v", name, err)
+	}
+	return val, nil
+}
+
+func getEnvFloatWithDefault(name string, def float64) (float64, error) {
+	res, found := os.LookupEnv(name)
+	if !found {
+		return def, nil
+	}
+	val, err := strconv.ParseFloat(res, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a number: %v", name, err)
+	}
+	return val, nil
+}
+
+func getEnvBoolWithDefault(name string, def bool) (bool, error) {
+	res, found := os.LookupEnv(name)
+	if !found {
+		return def, nil
+	}
+	val, err := strconv.ParseBool(res)
+	if err != nil {
+		return false, fmt.Errorf("%s must be a boolean: %v", name, err)
+	}
+	return val, nil
+}
+
+func getEnvDurationWithDefault(name string, def time.Duration) (time.Duration, error) {
+	res, found := os.LookupEnv(name)
+	if !found {
+		return def, nil
+	}
+	val, err := time.ParseDuration(res)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a duration such as \"30s\": %v", name, err)
+	}
+	return val, nil
+}
+
+// getEnvListWithDefault parses a comma separated list.
+func getEnvListWithDefault(name string, def []string) []string {
+	res, found := os.LookupEnv(name)
+	if !found {
+		return def
+	}
+
+	var vals []string
+	for _, val := range strings.Split(res, ",") {
+		if val = strings.TrimSpace(val); val != "" {
+			vals = append(vals, val)
+		}
+	}
+	return vals
+}
+
+// getEnvFloatMapWithDefault parses a comma separated list of key=number
+// pairs. Keys missing from the variable keep their default.
+func getEnvFloatMapWithDefault(name string, def map[string]float64) (map[string]float64, error) {
+	vals := make(map[string]float64, len(def))
+	for key, val := range def {
+		vals[key] = val
+	}
+
+	res, found := os.LookupEnv(name)
+	if !found {
+		return vals, nil
+	}
+	for _, pair := range getEnvListWithDefault(name, nil) {
+		key, val, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s must be a list of key=number pairs, got %q", name, res)
+		}
+		num, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a list of key=number pairs: %v", name, err)
+		}
+		vals[strings.TrimSpace(key)] = num
+	}
+	return vals, nil
+}
+
+// getEnvThresholdsWithDefault parses the four comma separated, ascending
+// probabilities from which a category is rated unlikely, possible, likely
+// and very likely.
+func getEnvThresholdsWithDefault(name string, def likelihoodThresholds) (likelihoodThresholds, error) {
+	res, found := os.LookupEnv(name)
+	if !found {
+		return def, nil
+	}
+
+	var thresholds likelihoodThresholds
+	vals := getEnvListWithDefault(name, nil)
+	if len(vals) != len(thresholds) {
+		return thresholds, fmt.Errorf("%s must be %d comma separated probabilities, got %q", name, len(thresholds), res)
+	}
+	for i, val := range vals {
+		p, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return thresholds, fmt.Errorf("%s must be %d comma separated probabilities: %v", name, len(thresholds), err)
+		}
+		if p < 0 || p > 1 || (i > 0 && p < thresholds[i-1]) {
+			return thresholds, fmt.Errorf("%s must be ascending probabilities from 0 to 1, got %q", name, res)
+		}
+		thresholds[i] = p
+	}
+	return thresholds, nil
+}
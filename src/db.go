@@ -3,7 +3,7 @@ package src
 import (
 	"context"
 	"fmt"
-	"os"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -35,6 +35,7 @@ func InitDB(config Config) (*pg.DB, error) {
 
 	// Print SQL queries to logger if loglevel is set to debug.
 	conn.AddQueryHook(loggerHook{})
+	conn.AddQueryHook(metricsHook{})
 
 	err := conn.Ping(context.Background())
 	if err != nil {
@@ -44,25 +45,30 @@ func InitDB(config Config) (*pg.DB, error) {
 	return conn, nil
 }
 
+// loggerHook logs every query at debug level through the request logger of
+// the query context, or the global logger outside of requests.
 type loggerHook struct{}
 
-func (h loggerHook) BeforeQuery(ctx context.Context, evt *pg.QueryEvent) (context.Context, error) {
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, NoColor: true}).With().Caller().Logger()
+func (loggerHook) BeforeQuery(ctx context.Context, evt *pg.QueryEvent) (context.Context, error) {
+	return ctx, nil
+}
+
+func (loggerHook) AfterQuery(ctx context.Context, evt *pg.QueryEvent) error {
+	logger := loggerFromContext(ctx, log.Logger)
+	if logger.GetLevel() > zerolog.DebugLevel || zerolog.GlobalLevel() > zerolog.DebugLevel {
+		return nil
+	}
 
 	q, err := evt.FormattedQuery()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if evt.Err != nil {
-		log.Debug().Msgf("%s executing a query:\n%s\n", evt.Err, q)
+	if evt.Err != nil && evt.Err != pg.ErrNoRows {
+		logger.Debug().Err(evt.Err).Dur("duration", time.Since(evt.StartTime)).Msg(string(q))
 	} else {
-		log.Debug().Msg(string(q))
+		logger.Debug().Dur("duration", time.Since(evt.StartTime)).Msg(string(q))
 	}
 
-	return ctx, nil
-}
-
-func (loggerHook) AfterQuery(context.Context, *pg.QueryEvent) error {
 	return nil
 }
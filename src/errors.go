@@ -0,0 +1,158 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Stable, machine readable error codes returned to clients.
+const (
+	codeBadRequest       = "bad_request"
+	codeInvalidJSON      = "invalid_json"
+	codeInvalidURI       = "invalid_uri"
+	codeUnauthorized     = "unauthorized"
+	codeInvalidLicense   = "invalid_license"
+	codeLicenseExpired   = "license_expired"
+	codePaymentRequired  = "payment_required"
+	codeNotFound         = "not_found"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeRateLimited      = "rate_limited"
+	codeInternal         = "internal_error"
+	codeUnavailable      = "unavailable"
+)
+
+// AppError is an error meant to be shown to API clients. Code is stable and
+// machine readable, Message is for humans and Details carries optional
+// structured context.
+type AppError struct {
+	Code    string
+	Message string
+	Details map[string]interface{}
+	Err     error // Err is the underlying cause. It is logged but never shown to clients.
+}
+
+func (e *AppError) Error() string {
+	return e.Message
+}
+
+func (e *AppError) Unwrap() error {
+	return e.Err
+}
+
+// newAppError returns an AppError with the given code and message.
+func newAppError(code string, message string) *AppError {
+	return &AppError{Code: code, Message: message}
+}
+
+// WithDetails returns a copy of the error with the detail key set to val.
+func (e *AppError) WithDetails(key string, val interface{}) *AppError {
+	res := *e
+	res.Details = make(map[string]interface{}, len(e.Details)+1)
+	for k, v := range e.Details {
+		res.Details[k] = v
+	}
+	res.Details[key] = val
+	return &res
+}
+
+// errorBody is the JSON envelope every error response is written in.
+type errorBody struct {
+	Error errorBodyError `json:"error"`
+}
+
+type errorBodyError struct {
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// problemBody is an RFC 7807 problem details object, written when the
+// client accepts application/problem+json.
+type problemBody struct {
+	Type    string                 `json:"type"`
+	Title   string                 `json:"title"`
+	Status  int                    `json:"status"`
+	Detail  string                 `json:"detail"`
+	Code    string                 `json:"code"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// statusCode returns the default error code for an HTTP status.
+func statusCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return codeBadRequest
+	case http.StatusUnauthorized:
+		return codeUnauthorized
+	case http.StatusPaymentRequired:
+		return codePaymentRequired
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusMethodNotAllowed:
+		return codeMethodNotAllowed
+	case http.StatusTooManyRequests:
+		return codeRateLimited
+	case http.StatusServiceUnavailable:
+		return codeUnavailable
+	}
+	if status >= 500 {
+		return codeInternal
+	}
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+// toAppError converts err into an AppError for the response status. Errors
+// that are not AppErrors keep their message for client errors, but server
+// errors are reduced to the status text so internals don't leak.
+func toAppError(status int, err error) *AppError {
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		return appErr
+	}
+
+	message := http.StatusText(status)
+	if status < 500 && err != nil {
+		message = err.Error()
+	}
+	return &AppError{Code: statusCode(status), Message: message, Err: err}
+}
+
+// writeError writes err to w as the JSON error envelope, or as problem+json
+// if the client asked for it.
+func writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	appErr := toAppError(status, err)
+
+	var body interface{}
+	if strings.Contains(r.Header.Get("Accept"), "application/problem+json") {
+		w.Header().Set("Content-Type", "application/problem+json")
+		body = problemBody{
+			Type:    "about:blank",
+			Title:   http.StatusText(status),
+			Status:  status,
+			Detail:  appErr.Message,
+			Code:    appErr.Code,
+			Details: appErr.Details,
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		body = errorBody{Error: errorBodyError{
+			Code:    appErr.Code,
+			Message: appErr.Message,
+			Details: appErr.Details,
+		}}
+	}
+
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// statusHandler writes a JSON error for status. It is used for the router's
+// not found and method not allowed responses.
+func statusHandler(status int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, status, nil)
+	})
+}
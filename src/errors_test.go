@@ -0,0 +1,82 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestErrorResponses(t *testing.T) {
+	t.Run("renders app errors in the JSON envelope", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		rr := httptest.NewRecorder()
+
+		writeError(rr, req, http.StatusBadRequest, newAppError(codeInvalidURI, "foo is not a valid URI").WithDetails("uri", "foo"))
+
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400 but got %d", rr.Code)
+		}
+		if rr.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected content type %q", rr.Header().Get("Content-Type"))
+		}
+
+		var body errorBody
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Error.Code != codeInvalidURI || body.Error.Message != "foo is not a valid URI" {
+			t.Errorf("unexpected error body: %+v", body.Error)
+		}
+		if body.Error.Details["uri"] != "foo" {
+			t.Errorf("expected uri detail but got %v", body.Error.Details)
+		}
+	})
+
+	t.Run("renders problem+json when accepted", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", "application/problem+json")
+		rr := httptest.NewRecorder()
+
+		writeError(rr, req, http.StatusUnauthorized, newAppError(codeLicenseExpired, "expired license"))
+
+		if rr.Header().Get("Content-Type") != "application/problem+json" {
+			t.Errorf("unexpected content type %q", rr.Header().Get("Content-Type"))
+		}
+
+		var body problemBody
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Status != http.StatusUnauthorized || body.Code != codeLicenseExpired || body.Detail != "expired license" {
+			t.Errorf("unexpected problem body: %+v", body)
+		}
+	})
+
+	t.Run("hides internal error messages", func(t *testing.T) {
+		h := &appHandler{appContext{logger: zerolog.Nop()}, func(appContext, http.ResponseWriter, *http.Request) (int, error) {
+			return http.StatusInternalServerError, errors.New("pg: connection refused")
+		}}
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+		var body errorBody
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Error.Code != codeInternal || body.Error.Message != http.StatusText(http.StatusInternalServerError) {
+			t.Errorf("unexpected error body: %+v", body.Error)
+		}
+	})
+
+	t.Run("keeps plain client error messages", func(t *testing.T) {
+		appErr := toAppError(http.StatusBadRequest, errors.New("ImgUriList cannot be empty"))
+		if appErr.Code != codeBadRequest || appErr.Message != "ImgUriList cannot be empty" {
+			t.Errorf("unexpected app error: %+v", appErr)
+		}
+	})
+}
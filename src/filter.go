@@ -1,152 +1,440 @@
 package src
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
 )
 
+// ErrTrialExhausted is returned by filterImages when a trial license has used
+// all of its image filters. Any cached results are still returned alongside it.
+var ErrTrialExhausted = errors.New("trial exhausted")
+
+// ErrClassifierUnavailable is returned by filterImages when the classifier
+// failed, along with any cached results.
+var ErrClassifierUnavailable = errors.New("classifier unavailable")
+
 // return URIs that are not cached in annotations
-func getCachedSSAs(ctx appContext, uris []string) ([]*ImageAnnotation, []string, error) {
-	var res []*ImageAnnotation
-	cachedSSAs, err := FindAnnotationsByURI(ctx.db, uris)
+func getCachedSSAs(c context.Context, ctx appContext, uris []string) ([]*ImageAnnotation, []string, error) {
+	c, span := tracer.Start(c, "cache.lookup", trace.WithAttributes(imageCountAttr(len(uris))))
+	c, cancel := withTimeout(c, ctx.config.DBTimeout)
+	defer cancel()
+
+	// Popular images are served from memory without a query.
+	res, uris := ctx.lru.GetAll(uris)
+	if len(uris) == 0 {
+		span.SetAttributes(attribute.Int("purity.cache_hits", len(res)))
+		endSpan(span, nil)
+		return res, nil, nil
+	}
+	lruHits := len(res)
+
+	hashes := make([]string, len(uris))
+	for i, uri := range uris {
+		hashes[i] = Hash(uri)
+	}
+	var cachedSSAs []ImageAnnotation
+	var err error
+	if ctx.annotationStore != nil {
+		cachedSSAs, err = getStoredAnnotations(ctx.annotationStore, uris)
+	} else {
+		cachedSSAs, err = FindAnnotationsByHash(c, ctx.db, hashes)
+	}
 	if err != nil {
+		endSpan(span, err)
 		return nil, nil, err
 	}
 
-	uncachedURIs := make([]string, 0, len(uris))
+	found, uncachedURIs := matchAnnotations(uris, hashes, cachedSSAs)
+	res = append(res, found...)
+	ctx.lru.AddAll(res[lruHits:])
 
-	for _, uri := range uris {
-		found := false
-		for _, cachedSSA := range cachedSSAs {
-			if cachedSSA.URI == uri {
-				res = append(res, &cachedSSA)
-				found = true
-				ctx.logger.Debug().Msgf("found cached image: %s", uri)
-				break
-			}
-		}
-		if !found {
-			uncachedURIs = append(uncachedURIs, uri)
+	span.SetAttributes(attribute.Int("purity.cache_hits", len(res)))
+	endSpan(span, nil)
+	return res, uncachedURIs, nil
+}
+
+func getStoredAnnotations(store AnnotationStore, uris []string) ([]ImageAnnotation, error) {
+	stored, err := store.GetAnnotations(uris)
+	if err != nil {
+		return nil, err
+	}
+	annos := make([]ImageAnnotation, len(stored))
+	for i, anno := range stored {
+		annos[i] = *anno
+	}
+	return annos, nil
+}
+
+// matchAnnotations pairs uris, whose hashes are at the same index of hashes,
+// with their annotations, returning the annotations found and the URIs that
+// have none.
+func matchAnnotations(uris, hashes []string, annos []ImageAnnotation) ([]*ImageAnnotation, []string) {
+	// Rows are keyed by URI too, in case of rows hashed differently, which
+	// can share a hash. There can be more rows than URIs.
+	type key struct{ hash, uri string }
+	byKey := make(map[key]*ImageAnnotation, len(annos))
+	for i := range annos {
+		byKey[key{annos[i].Hash, annos[i].URI}] = &annos[i]
+	}
+
+	found := make([]*ImageAnnotation, 0, len(uris))
+	missing := make([]string, 0, len(uris))
+	for i, uri := range uris {
+		if anno, ok := byKey[key{hashes[i], uri}]; ok {
+			found = append(found, anno)
+			continue
 		}
+		missing = append(missing, uri)
+	}
+	return found, missing
+}
+
+// Statuses of a single image in a batch filter response.
+const (
+	filterStatusOK                = "ok"
+	filterStatusInvalidURI        = "invalid_uri"
+	filterStatusFetchFailed       = "fetch_failed"
+	filterStatusQuotaExceeded     = "quota_exceeded"
+	filterStatusProviderError     = "provider_error"
+	filterStatusUnsupportedFormat = "unsupported_format"
+	filterStatusUnknown           = "unknown"
+)
+
+// DegradedHeader is set on filter responses in which some images could not be
+// classified because the classifier is unavailable.
+const DegradedHeader = "X-Purity-Degraded"
+
+// Policies for images that can't be classified while the classifier is down.
+const (
+	degradedPolicyUnknown = "unknown"     // Report the image as unknown without a verdict.
+	degradedPolicyOpen    = "fail-open"   // Allow the image.
+	degradedPolicyClosed  = "fail-closed" // Block the image.
+)
+
+// Verdicts applied to unclassified images by the degraded policy, or pinned
+// by an override.
+const (
+	verdictAllow = "allow"
+	verdictBlock = "block"
+)
+
+// Sources of verdicts that don't come from the classifier's scores.
+const (
+	verdictSourceOverride = "override" // An admin pinned the verdict.
+	verdictSourceRule     = "rule"     // A rule of the license settled the image.
+)
+
+// FilterResult is the outcome of filtering a single image in a batch. The
+// annotation fields are inlined so clients reading plain annotations keep
+// working; images that could not be classified have UNKNOWN (0) scores.
+type FilterResult struct {
+	*ImageAnnotation
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+	Verdict string `json:"verdict,omitempty"`
+	Source  string `json:"source,omitempty"`
+}
+
+// newFilterResult returns the result for an image that has no annotation.
+func newFilterResult(uri string, status string, message string) *FilterResult {
+	return &FilterResult{
+		ImageAnnotation: &ImageAnnotation{
+			Hash:  Hash(uri),
+			URI:   uri,
+			Error: sql.NullString{String: message, Valid: true},
+		},
+		Status:  status,
+		Message: message,
 	}
+}
 
-	return res, uncachedURIs, nil
+// degradedResult returns the result for an image that could not be classified
+// because the classifier is unavailable. The scores carry the policy's
+// verdict so clients that only read scores honor it too.
+func degradedResult(uri string, reason string, policy string) *FilterResult {
+	res := newFilterResult(uri, filterStatusUnknown, reason)
+
+	switch policy {
+	case degradedPolicyOpen:
+		setVerdict(res, verdictAllow)
+	case degradedPolicyClosed:
+		setVerdict(res, verdictBlock)
+	}
+	return res
+}
+
+// setVerdict sets the verdict of res and scores that carry it.
+func setVerdict(res *FilterResult, verdict string) {
+	likelihood := pb.Likelihood_VERY_UNLIKELY
+	if verdict == verdictBlock {
+		likelihood = pb.Likelihood_VERY_LIKELY
+	}
+
+	res.Verdict = verdict
+	score := int16(likelihood)
+	res.Adult, res.Spoof, res.Medical, res.Violence, res.Racy = score, score, score, score, score
 }
 
-func filterImages(ctx appContext, uris []string, licenseID string) ([]*ImageAnnotation, error) {
-	res, uris, err := getCachedSSAs(ctx, uris)
+// annotationResult returns the result for an annotated image. Annotations
+// with an error get the status of their error kind, and overridden ones the
+// pinned verdict instead of their scores.
+func annotationResult(anno *ImageAnnotation) *FilterResult {
+	if anno.OverrideVerdict != "" {
+		// The cached annotation keeps the classified scores.
+		copied := *anno
+		copied.Error = sql.NullString{}
+		copied.ErrorKind = ""
+		res := &FilterResult{ImageAnnotation: &copied, Status: filterStatusOK, Source: verdictSourceOverride}
+		setVerdict(res, anno.OverrideVerdict)
+		return res
+	}
+	if anno.Error.Valid {
+		status := filterStatusFetchFailed
+		switch anno.ErrorKind {
+		case errorKindUnsupportedFormat:
+			status = filterStatusUnsupportedFormat
+		case errorKindProviderError:
+			status = filterStatusProviderError
+		}
+		return &FilterResult{ImageAnnotation: anno, Status: status, Message: anno.Error.String}
+	}
+	return &FilterResult{ImageAnnotation: anno, Status: filterStatusOK}
+}
+
+// filterImages returns the annotations of uris, classifying those that aren't
+// cached and billing them to license, which is updated in place.
+func filterImages(c context.Context, ctx appContext, uris []string, license *License) ([]*ImageAnnotation, error) {
+	cached, uris, err := getCachedSSAs(c, ctx, uris)
 	if err != nil {
 		return nil, err
 	}
+	res, stale, expired := splitByFreshness(cached, time.Now(), ctx.config)
+	if stats := statsFromContext(c); stats != nil {
+		stats.CacheHits += len(res)
+	}
+	filterCacheLookupsTotal.WithLabelValues("hit").Add(float64(len(res) - len(stale)))
+	filterCacheLookupsTotal.WithLabelValues("stale").Add(float64(len(stale)))
+	filterCacheLookupsTotal.WithLabelValues("expired").Add(float64(len(expired)))
+	filterCacheLookupsTotal.WithLabelValues("miss").Add(float64(len(uris)))
+	// Annotations from an older model are served while they are classified
+	// again in the background.
+	ctx.revalidator.Revalidate(c, ctx, append(stale, ctx.revalidator.Outdated(res)...))
+	previous := make(map[string]*ImageAnnotation, len(expired))
+	for _, anno := range expired {
+		previous[anno.URI] = anno
+		uris = append(uris, anno.URI)
+	}
 	if len(uris) == 0 {
 		return res, nil
 	}
 
-	license, err := ctx.licenseStore.GetLicenseByID(licenseID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch license: %s", err.Error())
-	}
-	if license == nil {
-		return nil, errors.New("license not found")
-	}
+	// quotaErr is returned along with the results when only some of the
+	// uncached images could be classified.
+	var quotaErr error
 	if license.IsTrial {
 		remainingUsage := ctx.config.TrialLicenseMaxUsage - license.RequestCount
-		if remainingUsage < len(uris) {
-			uris = uris[:remainingUsage]
-		}
 		if remainingUsage <= 0 { // return early if trial license is expired
-			license, err = ctx.licenseStore.ExpireTrial(license)
+			license, err = ctx.licenseStore.ExpireTrial(c, license)
 			if err != nil {
 				return res, fmt.Errorf("failed to mark trial license as expired: %s", err.Error())
 			} else {
-				return res, fmt.Errorf("trial license %s has reached max usage and is now invalid", license.ID)
+				return res, fmt.Errorf("trial license %s has reached max usage and is now invalid: %w", redactLicenseID(license.ID), ErrTrialExhausted)
 			}
 		}
+		if remainingUsage < len(uris) {
+			uris = uris[:remainingUsage]
+			quotaErr = fmt.Errorf("trial license %s has reached max usage: %w", redactLicenseID(license.ID), ErrTrialExhausted)
+		}
+	}
+
+	if rolloverBillingPeriod(ctx, license, time.Now()) {
+		if err = ctx.licenseStore.StartBillingPeriod(c, license); err != nil {
+			ctx.logger.Error().Msgf("failed to update license billing period: %s", err)
+		}
+	}
+	allowed := hardCapAllowance(license, len(uris))
+	if allowed == 0 {
+		return res, fmt.Errorf("license %s: %w", redactLicenseID(license.ID), ErrHardCapReached)
+	}
+	if allowed < len(uris) {
+		uris = uris[:allowed]
+		quotaErr = fmt.Errorf("license %s: %w", redactLicenseID(license.ID), ErrHardCapReached)
 	}
 
-	annotateImageResponses, err := GetURIAnnotations(uris)
+	annos, err := classifyCoalesced(c, ctx, uris, previous, license)
+	res = append(res, annos...)
 	if err != nil {
-		return nil, err
+		return res, err
 	}
+	return res, quotaErr
+}
 
-	if len(annotateImageResponses) > 0 {
-		license.RequestCount += len(annotateImageResponses)
-		if err = ctx.licenseStore.UpdateLicense(license); err != nil {
-			ctx.logger.Error().Msgf("failed to update license request count: %s", err)
+// classifyCoalesced classifies uris and bills them to license. Images another
+// request is already classifying are waited for rather than classified again,
+// and billed by the coalesced billing policy.
+func classifyCoalesced(c context.Context, ctx appContext, uris []string, previous map[string]*ImageAnnotation, license *License) ([]*ImageAnnotation, error) {
+	claim, uris, flights := ctx.flights.Claim(uris, license.ID)
+	defer ctx.flights.Finish(claim, uris, nil, nil)
+	// Returning before waiting leaves the flights, so the license isn't picked
+	// to pay for images it doesn't get.
+	defer func() {
+		if flights != nil {
+			billLicense(context.WithoutCancel(c), ctx, license, ctx.flights.Leave(claim, flights))
 		}
-		if err = IncrementSubscriptionMeter(ctx.config.StripeKey, license, int64(len(annotateImageResponses))); err != nil {
-			ctx.logger.Error().Msgf("failed to update stripe subscription usage: %s", err.Error())
+	}()
+
+	var res []*ImageAnnotation
+	if len(uris) > 0 {
+		annos, err := classifyImages(c, ctx, uris, previous)
+		if err != nil {
+			ctx.flights.Finish(claim, uris, nil, err)
+			return res, fmt.Errorf("%w: %w", ErrClassifierUnavailable, err)
+		}
+		billed := ctx.flights.Finish(claim, uris, annos, nil)
+		res = append(res, annos...)
+
+		// The images are classified and billed by the provider now, so the
+		// usage and cache writes must not be cancelled by the client going away.
+		detached := context.WithoutCancel(c)
+		billLicense(detached, ctx, license, billed)
+
+		insertCtx, span := tracer.Start(detached, "cache.insert", trace.WithAttributes(imageCountAttr(len(annos))))
+		err = cacheAnnotations(insertCtx, ctx, annos)
+		endSpan(span, err)
+		if err != nil {
+			ctx.logger.Error().Msgf("failed to cache with uris: %v", uris)
 		}
 	}
 
-	var buildSSARes = func(annotations []*pb.AnnotateImageResponse) []*ImageAnnotation {
-		var annoRes []*ImageAnnotation
-		for i, annotation := range annotations {
-			if annotation == nil {
-				continue
+	if len(flights) > 0 {
+		waited, billed, err := ctx.flights.Wait(c, claim, flights)
+		flights = nil
+		res = append(res, waited...)
+		if stats := statsFromContext(c); stats != nil {
+			stats.CacheHits += len(waited)
+		}
+		filterCoalescedTotal.Add(float64(len(waited)))
+		billLicense(context.WithoutCancel(c), ctx, license, billed)
+		if err != nil {
+			if c.Err() != nil {
+				return res, err
 			}
-			uri := uris[i]
-			annoRes = append(annoRes, annotationToSafeSearchResponseRes(uri, annotation))
+			return res, fmt.Errorf("%w: %w", ErrClassifierUnavailable, err)
 		}
-		return annoRes
 	}
 
-	safeSearchAnnotationsRes := buildSSARes(annotateImageResponses)
-	res = append(res, safeSearchAnnotationsRes...)
+	return res, nil
+}
 
-	err = cacheAnnotations(ctx, safeSearchAnnotationsRes)
+// classifyImages classifies uris. previous holds the expired annotations of
+// images that are classified again.
+func classifyImages(c context.Context, ctx appContext, uris []string, previous map[string]*ImageAnnotation) ([]*ImageAnnotation, error) {
+	c, span := tracer.Start(c, "classifier.classify", trace.WithAttributes(imageCountAttr(len(uris))))
+	classifications, err := ctx.classifier.Classify(c, uris)
+	endSpan(span, err)
 	if err != nil {
-		ctx.logger.Error().Msgf("failed to cache with uris: %v", uris)
+		return nil, err
+	}
+	ctx.revalidator.ObserveModels(classifications)
+
+	annos := make([]*ImageAnnotation, 0, len(classifications))
+	for i, classification := range classifications {
+		anno := classificationToAnnotation(uris[i], classification)
+		// Count consecutive failures so retries of an errored image back off.
+		if prev := previous[anno.URI]; prev != nil && prev.Error.Valid && anno.Error.Valid {
+			anno.RetryCount = prev.RetryCount + 1
+		}
+		annos = append(annos, anno)
 	}
+	return annos, nil
+}
 
-	ctx.logger.Info().Msgf("license: %s added %d to request count", licenseID, len(annotateImageResponses))
+// billLicense adds n classified images to the usage of license and meters
+// them on its subscription.
+func billLicense(c context.Context, ctx appContext, license *License, n int) {
+	if n == 0 {
+		return
+	}
 
-	return res, nil
+	updateCtx, span := tracer.Start(c, "license.update")
+	err := ctx.licenseStore.AddUsage(updateCtx, license, n)
+	endSpan(span, err)
+	if err != nil {
+		ctx.logger.Error().Msgf("failed to update license request count: %s", err)
+	} else if notifySoftCap(ctx, license) {
+		if err = ctx.licenseStore.UpdateLicense(c, license, "soft_cap_notified"); err != nil {
+			ctx.logger.Error().Msgf("failed to record soft cap warning: %s", err)
+		}
+	}
+	// Metering is synchronous so no usage is lost if the server shuts down
+	// before a background task could send it.
+	_, span = tracer.Start(c, "stripe.increment_meter", trace.WithAttributes(imageCountAttr(n)))
+	err = IncrementSubscriptionMeter(ctx.config.StripeKey, license, int64(n))
+	endSpan(span, err)
+	if err != nil {
+		stripeErrorsTotal.WithLabelValues("usage_record").Inc()
+		ctx.logger.Error().Msgf("failed to update stripe subscription usage: %s", err.Error())
+	}
+
+	ctx.logger.Info().Msgf("license: %s added %d to request count", redactLicenseID(license.ID), n)
 }
 
-func annotationToSafeSearchResponseRes(uri string, annotation *pb.AnnotateImageResponse) *ImageAnnotation {
+func classificationToAnnotation(uri string, classification Classification) *ImageAnnotation {
 	var err sql.NullString
-	if annotation.Error != nil {
-		err = sql.NullString{String: annotation.Error.Message, Valid: true}
-	} else {
-		err = sql.NullString{String: "", Valid: false}
-	}
-
-	if annotation == nil || annotation.SafeSearchAnnotation == nil {
-		return &ImageAnnotation{
-			Hash:      Hash(uri),
-			URI:       uri,
-			Error:     err,
-			DateAdded: time.Now(),
-			Adult:     0,
-			Spoof:     0,
-			Medical:   0,
-			Violence:  0,
-			Racy:      0,
+	var errorKind string
+	if classification.Error != "" {
+		err = sql.NullString{String: classification.Error, Valid: true}
+		errorKind = classification.ErrorKind
+		if errorKind == "" {
+			errorKind = errorKindProviderError
 		}
 	}
 
+	now := time.Now()
 	return &ImageAnnotation{
 		Hash:      Hash(uri),
 		URI:       uri,
 		Error:     err,
-		DateAdded: time.Now(),
-		Adult:     int16(annotation.SafeSearchAnnotation.Adult),
-		Spoof:     int16(annotation.SafeSearchAnnotation.Spoof),
-		Medical:   int16(annotation.SafeSearchAnnotation.Medical),
-		Violence:  int16(annotation.SafeSearchAnnotation.Violence),
-		Racy:      int16(annotation.SafeSearchAnnotation.Racy),
+		DateAdded: now,
+		ErrorKind: errorKind,
+		Adult:     classification.Adult,
+		Spoof:     classification.Spoof,
+		Medical:   classification.Medical,
+		Violence:  classification.Violence,
+		Racy:      classification.Racy,
+
+		Provider:     classification.Provider,
+		ModelVersion: classification.ModelVersion,
+		ValidatedAt:  now,
+		ETag:         classification.Validators.ETag,
+		LastModified: classification.Validators.LastModified,
 	}
 }
 
-func cacheAnnotations(ctx appContext, annos []*ImageAnnotation) error {
-	if err := InsertAll(ctx.db, annos); err != nil {
+func cacheAnnotations(c context.Context, ctx appContext, annos []*ImageAnnotation) error {
+	c, cancel := withTimeout(c, ctx.config.DBTimeout)
+	defer cancel()
+
+	// Only the rows written are cached in memory, not those that lost to a
+	// more recent annotation.
+	written := annos
+	var err error
+	if ctx.annotationStore != nil {
+		err = ctx.annotationStore.PutAnnotations(annos)
+	} else {
+		written, err = InsertAll(c, ctx.db, annos)
+	}
+	if err != nil {
 		return err
 	}
+	ctx.lru.AddAll(written)
 
 	for _, anno := range annos {
 		ctx.logger.Info().Msgf("adding %s to DB cache", anno.URI)
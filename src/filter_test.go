@@ -0,0 +1,245 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+func TestDegradedResult(t *testing.T) {
+	tests := []struct {
+		policy  string
+		verdict string
+		score   int16
+	}{
+		{policy: degradedPolicyUnknown, verdict: "", score: int16(pb.Likelihood_UNKNOWN)},
+		{policy: degradedPolicyOpen, verdict: verdictAllow, score: int16(pb.Likelihood_VERY_UNLIKELY)},
+		{policy: degradedPolicyClosed, verdict: verdictBlock, score: int16(pb.Likelihood_VERY_LIKELY)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			res := degradedResult("https://example.com/a.jpg", "classifier request failed", test.policy)
+			if res.Status != filterStatusUnknown || res.Message != "classifier request failed" {
+				t.Errorf("expected unknown status with a reason but got %q, %q", res.Status, res.Message)
+			}
+			if res.Verdict != test.verdict {
+				t.Errorf("expected verdict %q but got %q", test.verdict, res.Verdict)
+			}
+			for _, score := range []int16{res.Adult, res.Spoof, res.Medical, res.Violence, res.Racy} {
+				if score != test.score {
+					t.Errorf("expected scores of %d but got %d", test.score, score)
+				}
+			}
+		})
+	}
+}
+
+func TestAnnotationResultOverride(t *testing.T) {
+	anno := &ImageAnnotation{URI: "https://example.com/a.jpg", Adult: 5, Racy: 4, OverrideVerdict: verdictAllow}
+
+	res := annotationResult(anno)
+	if res.Status != filterStatusOK || res.Verdict != verdictAllow || res.Source != verdictSourceOverride {
+		t.Fatalf("expected the pinned verdict but got %q, %q, %q", res.Status, res.Verdict, res.Source)
+	}
+	if res.Adult != int16(pb.Likelihood_VERY_UNLIKELY) || res.Racy != int16(pb.Likelihood_VERY_UNLIKELY) {
+		t.Fatalf("expected the scores to carry the verdict but got %d, %d", res.Adult, res.Racy)
+	}
+	if anno.Adult != 5 || anno.Racy != 4 {
+		t.Fatal("expected the annotation to keep its original scores")
+	}
+
+	anno.OverrideVerdict = ""
+	if res := annotationResult(anno); res.Verdict != "" || res.Source != "" || res.Adult != 5 {
+		t.Fatalf("expected the scores without an override but got %+v", res)
+	}
+}
+
+func TestMatchAnnotations(t *testing.T) {
+	uris := []string{"https://example.com/a.jpg", "https://example.com/b.jpg", "https://example.com/c.jpg"}
+	hashes := []string{Hash(uris[0]), Hash(uris[1]), Hash(uris[2])}
+	annos := []ImageAnnotation{
+		{Hash: hashes[2], URI: uris[2], Adult: 3},
+		{Hash: hashes[0], URI: uris[0], Adult: 1},
+		{Hash: "content-hash", URI: uris[1]},
+	}
+
+	found, missing := matchAnnotations(uris, hashes, annos)
+	if len(found) != 2 || found[0].URI != uris[0] || found[0].Adult != 1 || found[1].URI != uris[2] || found[1].Adult != 3 {
+		t.Fatalf("expected the annotations of a and c in request order but got %+v", found)
+	}
+	if found[0] == found[1] {
+		t.Fatal("expected distinct annotations")
+	}
+	if len(missing) != 1 || missing[0] != uris[1] {
+		t.Fatalf("expected b to be missing but got %v", missing)
+	}
+
+	t.Run("more rows than URIs", func(t *testing.T) {
+		rows := append(annos, ImageAnnotation{Hash: hashes[0], URI: "https://example.com/other.jpg"}, ImageAnnotation{Hash: "other", URI: uris[1]})
+		found, missing := matchAnnotations(uris[:1], hashes[:1], rows)
+		if len(found) != 1 || len(missing) != 0 {
+			t.Fatalf("expected a to be found but got %v, %v", found, missing)
+		}
+	})
+}
+
+func BenchmarkMatchAnnotations(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		uris := make([]string, n)
+		hashes := make([]string, n)
+		for i := range uris {
+			uris[i] = fmt.Sprintf("https://example.com/%d.jpg", i)
+			hashes[i] = Hash(uris[i])
+		}
+		// Half the images are cached.
+		annos := make([]ImageAnnotation, 0, n/2)
+		for i := 0; i < n; i += 2 {
+			annos = append(annos, ImageAnnotation{Hash: hashes[i], URI: uris[i]})
+		}
+
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				matchAnnotations(uris, hashes, annos)
+			}
+		})
+	}
+}
+
+// memoryAnnotationStore is an in memory AnnotationStore for tests that don't
+// need a database.
+type memoryAnnotationStore struct {
+	mu    sync.Mutex
+	annos map[string]*ImageAnnotation
+}
+
+func (store *memoryAnnotationStore) GetAnnotations(uris []string) ([]*ImageAnnotation, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var res []*ImageAnnotation
+	for _, uri := range uris {
+		if anno, found := store.annos[uri]; found {
+			copied := *anno
+			res = append(res, &copied)
+		}
+	}
+	return res, nil
+}
+
+func (store *memoryAnnotationStore) PutAnnotations(annos []*ImageAnnotation) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, anno := range annos {
+		copied := *anno
+		store.annos[anno.URI] = &copied
+	}
+	return nil
+}
+
+// TestFilterImagesOffline runs the filter pipeline against a local model
+// server, with no database or cloud provider.
+func TestFilterImagesOffline(t *testing.T) {
+	images := newStubImageServer(t, map[string][]byte{
+		"/safe.jpg": []byte("a landscape"),
+		"/nsfw.jpg": []byte("something nsfw"),
+	})
+	t.Setenv("PURITY_CLASSIFIER_PROVIDERS", "http")
+	t.Setenv("PURITY_MODEL_SERVER_URL", newStubModelServer(t).URL)
+	t.Setenv("PURITY_IMAGE_FETCH_ALLOW_PRIVATE", "true")
+	t.Setenv("STRIPE_KEY", "sk_test_offline")
+	t.Setenv("STRIPE_WEBHOOK_SECRET", "whsec_offline")
+	t.Setenv("SENDGRID_API_KEY", "SG.offline")
+
+	config, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without a Stripe key usage is not metered, so nothing leaves the host.
+	config.StripeKey = ""
+	classifier, err := NewClassifier(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer classifier.Close()
+
+	license := &License{ID: testLicenseID, IsValid: true, Plan: "standard", HardCap: 100}
+	ctx := appContext{
+		logger:          zerolog.Nop(),
+		config:          config,
+		licenseStore:    newFakeLicenseStore(license),
+		annotationStore: &memoryAnnotationStore{annos: make(map[string]*ImageAnnotation)},
+		classifier:      classifier,
+		revalidator:     newCacheRevalidator(config),
+		flights:         newClassifyFlights(config.CoalescedBilling),
+		workers:         newWorkerGroup(),
+	}
+
+	uris := []string{images.URL + "/safe.jpg", images.URL + "/nsfw.jpg"}
+	annos, err := filterImages(context.Background(), ctx, uris, license)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(annos) != len(uris) {
+		t.Fatalf("expected %d annotations but got %d", len(uris), len(annos))
+	}
+	scores := map[string]int16{}
+	for _, anno := range annos {
+		scores[anno.URI] = anno.Adult
+	}
+	if scores[uris[0]] != int16(pb.Likelihood_VERY_UNLIKELY) || scores[uris[1]] != int16(pb.Likelihood_VERY_LIKELY) {
+		t.Fatalf("expected the nsfw image alone to be very likely adult but got %v", scores)
+	}
+	if license.PeriodUsage != len(uris) {
+		t.Fatalf("expected %d images to be billed but got %d", len(uris), license.PeriodUsage)
+	}
+
+	cached, uncached, err := getCachedSSAs(context.Background(), ctx, uris)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cached) != len(uris) || len(uncached) != 0 {
+		t.Fatalf("expected all images to be cached but got %d cached, %d uncached", len(cached), len(uncached))
+	}
+}
+
+func TestClassifyCoalescedClassifierError(t *testing.T) {
+	ctx := appContext{
+		logger:       zerolog.Nop(),
+		classifier:   &fakeClassifier{err: errors.New("unavailable")},
+		licenseStore: newFakeLicenseStore(&License{ID: testLicenseID, IsValid: true}),
+		flights:      newClassifyFlights(coalescedBillingSplit),
+	}
+
+	// Another request is classifying the shared images when this one fails
+	// to classify the image it leads.
+	shared := make([]string, 100)
+	for i := range shared {
+		shared[i] = fmt.Sprintf("https://example.com/%d.jpg", i)
+	}
+	other, lead, _ := ctx.flights.Claim(shared, "other")
+
+	license := &License{ID: testLicenseID, IsValid: true}
+	uris := append([]string{"https://example.com/own.jpg"}, shared...)
+	if _, err := classifyCoalesced(context.Background(), ctx, uris, nil, license); !errors.Is(err, ErrClassifierUnavailable) {
+		t.Fatalf("expected the classifier error but got %v", err)
+	}
+
+	annos := make([]*ImageAnnotation, len(lead))
+	for i, uri := range lead {
+		annos[i] = &ImageAnnotation{URI: uri}
+	}
+	if billed := ctx.flights.Finish(other, lead, annos, nil); billed != len(shared) {
+		t.Fatalf("expected the request that got the images to pay for all %d but got %d", len(shared), billed)
+	}
+	if license.PeriodUsage != 0 {
+		t.Fatalf("expected the failed request not to be billed but got %d", license.PeriodUsage)
+	}
+}
@@ -7,16 +7,19 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"os"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/zerolog"
 	"github.com/stripe/stripe-go/v74"
 	"github.com/stripe/stripe-go/v74/customer"
 	"github.com/stripe/stripe-go/v74/webhook"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func handleHealth(ctx appContext, w http.ResponseWriter, req *http.Request) (int, error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(200)
 	if _, err := w.Write([]byte("All Good ☮️")); err != nil {
 		return http.StatusInternalServerError, fmt.Errorf("failed to write response: %v", err)
@@ -48,50 +51,233 @@ func handleBatchFilter(ctx appContext, w http.ResponseWriter, req *http.Request)
 
 	decoder := json.NewDecoder(req.Body)
 	if err := decoder.Decode(&filterReqPayload); err != nil {
-		return http.StatusBadRequest, errors.New("JSON body missing or malformed")
+		return http.StatusBadRequest, newAppError(codeInvalidJSON, "JSON body missing or malformed")
 	}
 
 	if len(filterReqPayload.ImgURIList) == 0 {
-		return http.StatusBadRequest, errors.New("ImgUriList cannot be empty")
+		return http.StatusBadRequest, newAppError(codeBadRequest, "ImgUriList cannot be empty")
 	}
 
-	var res []*ImageAnnotation
+	license := licenseFromContext(req.Context())
+	if license == nil {
+		return http.StatusUnauthorized, newAppError(codeInvalidLicense, "invalid license")
+	}
 
 	uris := removeDuplicates(ctx.logger, filterReqPayload.ImgURIList)
+	if stats := statsFromContext(req.Context()); stats != nil {
+		stats.Images = len(uris)
+	}
 
+	// Each image gets its own result so one failure doesn't fail the batch.
+	results := make(map[string]*FilterResult, len(uris))
+	validURIs := make([]string, 0, len(uris))
 	for _, uri := range uris {
 		if _, err := url.ParseRequestURI(uri); err != nil {
-			return http.StatusBadRequest, fmt.Errorf("%s is not a valid URI", uri)
+			results[uri] = newFilterResult(uri, filterStatusInvalidURI, fmt.Sprintf("%s is not a valid URI", uri))
+			continue
 		}
+		validURIs = append(validURIs, uri)
 	}
 
+	// Images settled by the license's rules are neither looked up nor
+	// classified, so they aren't billed.
+	if len(validURIs) > 0 {
+		rules, err := ctx.ruleStore.GetRules(req.Context(), license.ID)
+		if cancelErr := req.Context().Err(); cancelErr != nil {
+			return http.StatusServiceUnavailable, &AppError{Code: codeUnavailable, Message: "request cancelled", Err: cancelErr}
+		}
+		if err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("failed to get license rules: %v", err)
+		}
+		unmatched := validURIs[:0]
+		for _, uri := range validURIs {
+			if rule := matchRule(rules, uri); rule != nil {
+				results[uri] = ruleResult(uri, rule)
+				filterRuleMatchesTotal.WithLabelValues(rule.Action).Inc()
+				continue
+			}
+			unmatched = append(unmatched, uri)
+		}
+		validURIs = unmatched
+	}
+
+	degraded := false
+	// quotaErr is set once the license's quota ran out. The remaining pages
+	// aren't filtered, so the license isn't checked or updated again.
+	var quotaErr error
+
 	// Filter images in pages of size MAX_IMAGES_PER_REQUEST.
-	for i := 0; i < len(uris); {
+	for i := 0; i < len(validURIs); i += MAX_IMAGES_PER_REQUEST {
+		// Stop paging once the client is gone or the server is shutting down.
+		if err := req.Context().Err(); err != nil {
+			return http.StatusServiceUnavailable, &AppError{Code: codeUnavailable, Message: "request cancelled", Err: err}
+		}
+
 		var endIdx int
-		if i+MAX_IMAGES_PER_REQUEST > len(uris)-1 {
-			endIdx = len(uris)
+		if i+MAX_IMAGES_PER_REQUEST > len(validURIs)-1 {
+			endIdx = len(validURIs)
 		} else {
 			endIdx = i + MAX_IMAGES_PER_REQUEST
 		}
+		page := validURIs[i:endIdx]
 
-		temp, err := filterImages(ctx, uris[i:endIdx], req.Header.Get("LicenseID"))
-		if err != nil {
-			return http.StatusInternalServerError, fmt.Errorf("error while filtering: %s", err)
+		if quotaErr != nil {
+			for _, uri := range page {
+				results[uri] = newFilterResult(uri, filterStatusQuotaExceeded, quotaErr.Error())
+			}
+			continue
 		}
 
-		res = append(res, temp...)
+		c, span := tracer.Start(req.Context(), "filter.page", trace.WithAttributes(
+			attribute.Int("purity.page", i/MAX_IMAGES_PER_REQUEST),
+			imageCountAttr(len(page)),
+		))
+		annotations, err := filterImages(c, ctx, page, license)
+		endSpan(span, err)
+		for _, anno := range annotations {
+			results[anno.URI] = annotationResult(anno)
+		}
 
-		i += MAX_IMAGES_PER_REQUEST
+		// Images in the page without an annotation failed as a whole.
+		pageDegraded := false
+		missing := func(uri string) *FilterResult {
+			return newFilterResult(uri, filterStatusProviderError, "image could not be classified")
+		}
+		switch {
+		case errors.Is(err, ErrHardCapReached) || errors.Is(err, ErrTrialExhausted):
+			// Only the images left unserved exceed the quota.
+			ctx.logger.Info().Msg(err.Error())
+			quotaErr = err
+			missing = func(uri string) *FilterResult {
+				return newFilterResult(uri, filterStatusQuotaExceeded, err.Error())
+			}
+		case errors.Is(err, ErrClassifierUnavailable):
+			// Serve cache hits and settle the rest by the degraded policy.
+			ctx.logger.Warn().Msgf("serving degraded results: %s", err)
+			pageDegraded = true
+			reason := "classifier request failed"
+			if errors.Is(err, ErrCircuitOpen) {
+				reason = "classifier is temporarily unavailable"
+			}
+			missing = func(uri string) *FilterResult {
+				return degradedResult(uri, reason, ctx.config.DegradedPolicy)
+			}
+		case err != nil:
+			ctx.logger.Error().Msgf("error while filtering: %s", err)
+		}
+		for _, uri := range page {
+			if results[uri] == nil {
+				results[uri] = missing(uri)
+				if pageDegraded {
+					filterDegradedTotal.WithLabelValues(ctx.config.DegradedPolicy).Inc()
+				}
+			}
+		}
+		// The response is marked degraded if any of its pages was.
+		degraded = degraded || pageDegraded
+	}
+
+	res := make([]*FilterResult, 0, len(uris))
+	for _, uri := range uris {
+		res = append(res, results[uri])
 	}
 
+	// filterImages billed the license in place, so it has the usage to report.
+	setSpendingCapHeaders(w, license)
+
+	if degraded {
+		w.Header().Set(DegradedHeader, "classifier")
+	}
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(res); err != nil {
 		return http.StatusInternalServerError, err
 	}
 	return http.StatusOK, nil
 }
 
-func handleWebhook(ctx appContext, w http.ResponseWriter, req *http.Request) (int, error) {
+// ReportReq is the payload of a misclassification report. The image is
+// identified by its URI, or by the hash of a cached image.
+type ReportReq struct {
+	URI             string `json:"uri"`
+	Hash            string `json:"hash"`
+	ExpectedVerdict string `json:"expectedVerdict"`
+	Comment         string `json:"comment"`
+}
+
+const maxReportCommentLength = 1000
+
+// handleReportMisclassification queues a client's report that an image got
+// the wrong verdict for review by an admin.
+func handleReportMisclassification(ctx appContext, w http.ResponseWriter, req *http.Request) (int, error) {
+	var payload ReportReq
+	if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+		return http.StatusBadRequest, newAppError(codeInvalidJSON, "JSON body missing or malformed")
+	}
+	if payload.ExpectedVerdict != verdictAllow && payload.ExpectedVerdict != verdictBlock {
+		return http.StatusBadRequest, newAppError(codeBadRequest, "expectedVerdict must be \"allow\" or \"block\"")
+	}
+	if len(payload.Comment) > maxReportCommentLength {
+		return http.StatusBadRequest, newAppError(codeBadRequest, fmt.Sprintf("comment cannot be longer than %d bytes", maxReportCommentLength))
+	}
+
+	c, cancel := withTimeout(req.Context(), ctx.config.DBTimeout)
+	defer cancel()
+
+	report := &MisclassificationReport{
+		URI:             payload.URI,
+		Hash:            payload.Hash,
+		ExpectedVerdict: payload.ExpectedVerdict,
+		Comment:         payload.Comment,
+	}
+	switch {
+	case payload.URI != "":
+		if _, err := url.ParseRequestURI(payload.URI); err != nil {
+			return http.StatusBadRequest, newAppError(codeInvalidURI, fmt.Sprintf("%s is not a valid URI", payload.URI))
+		}
+		report.Hash = Hash(payload.URI)
+	case payload.Hash != "":
+		annos, err := FindAnnotationsByHash(c, ctx.db, []string{payload.Hash})
+		if err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("failed to find annotation: %v", err)
+		}
+		if len(annos) == 0 {
+			return http.StatusNotFound, newAppError(codeNotFound, "no cached image with the hash")
+		}
+		report.URI = annos[0].URI
+	default:
+		return http.StatusBadRequest, newAppError(codeBadRequest, "uri or hash is required")
+	}
+	if license := licenseFromContext(req.Context()); license != nil {
+		report.LicenseID = license.ID
+	}
+
+	if err := InsertReport(c, ctx.db, report); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to save report: %v", err)
+	}
+	misclassificationReportsTotal.WithLabelValues(report.ExpectedVerdict).Inc()
+	ctx.logger.Info().Msgf("image %s reported as misclassified, expected %s", report.URI, report.ExpectedVerdict)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusCreated, nil
+}
+
+func handleWebhook(ctx appContext, w http.ResponseWriter, req *http.Request) (status int, retErr error) {
+	eventType, handled := "unknown", true
+	defer func() {
+		outcome := "ok"
+		if retErr != nil {
+			outcome = "error"
+		} else if !handled {
+			outcome = "unhandled"
+		}
+		webhookEventsTotal.WithLabelValues(eventType, outcome).Inc()
+	}()
+
 	const MaxBodyBytes = int64(65536)
 	req.Body = http.MaxBytesReader(w, req.Body, MaxBodyBytes)
 	payload, err := io.ReadAll(req.Body)
@@ -105,6 +291,7 @@ func handleWebhook(ctx appContext, w http.ResponseWriter, req *http.Request) (in
 	if err != nil {
 		return http.StatusBadRequest, fmt.Errorf("error verifying webhook signature: %v", err)
 	}
+	eventType = string(event.Type)
 
 	// Unmarshal the event data into an appropriate struct depending on its Type
 	switch event.Type {
@@ -120,7 +307,7 @@ func handleWebhook(ctx appContext, w http.ResponseWriter, req *http.Request) (in
 		stripeID := session.Customer.ID
 		email := session.CustomerDetails.Email
 
-		license, err := ctx.licenseStore.GetLicenseByStripeID(stripeID)
+		license, err := ctx.licenseStore.GetLicenseByStripeID(req.Context(), stripeID)
 		if err != nil {
 			return http.StatusInternalServerError, fmt.Errorf("error fetching license: %v", err)
 		}
@@ -129,7 +316,7 @@ func handleWebhook(ctx appContext, w http.ResponseWriter, req *http.Request) (in
 		if license != nil {
 			ctx.logger.Debug().Msg("existing license found, ensuring IsValid is true")
 			license.IsValid = true
-			if err = ctx.licenseStore.UpdateLicense(license); err != nil {
+			if err = ctx.licenseStore.UpdateLicense(req.Context(), license, "is_valid"); err != nil {
 				return http.StatusInternalServerError, errors.New("")
 			}
 			// TODO: email person to remind them their subscription is renewed.
@@ -138,7 +325,7 @@ func handleWebhook(ctx appContext, w http.ResponseWriter, req *http.Request) (in
 
 		// else create new license and store in db
 		licenseID := GenerateLicenseKey()
-		ctx.logger.Info().Msgf("generating new license: %s", licenseID)
+		ctx.logger.Info().Msgf("generating new license: %s", redactLicenseID(licenseID))
 
 		license = &License{
 			ID:             licenseID,
@@ -161,6 +348,7 @@ func handleWebhook(ctx appContext, w http.ResponseWriter, req *http.Request) (in
 		if _, err = customer.Update(session.Customer.ID, &stripe.CustomerParams{
 			Params: stripe.Params{Metadata: metadata},
 		}); err != nil {
+			stripeErrorsTotal.WithLabelValues("customer_update").Inc()
 			return http.StatusInternalServerError, fmt.Errorf("error adding license to customer metadata: %v", err)
 		}
 
@@ -175,7 +363,7 @@ func handleWebhook(ctx appContext, w http.ResponseWriter, req *http.Request) (in
 			return http.StatusBadRequest, fmt.Errorf("error parsing webhook JSON: %v", err)
 		}
 
-		license, err := ctx.licenseStore.GetLicenseByStripeID(sub.Customer.ID)
+		license, err := ctx.licenseStore.GetLicenseByStripeID(req.Context(), sub.Customer.ID)
 		if err != nil {
 			return http.StatusInternalServerError, fmt.Errorf("error finding license for valid subscriber: %v", err)
 		}
@@ -183,21 +371,28 @@ func handleWebhook(ctx appContext, w http.ResponseWriter, req *http.Request) (in
 			return http.StatusInternalServerError, errors.New("failed to find license")
 		}
 
+		if sub.CurrentPeriodEnd != 0 && setBillingPeriod(license, time.Unix(sub.CurrentPeriodStart, 0).UTC(), time.Unix(sub.CurrentPeriodEnd, 0).UTC()) {
+			if err = ctx.licenseStore.StartBillingPeriod(req.Context(), license); err != nil {
+				return http.StatusInternalServerError, fmt.Errorf("error updating license billing period: %v", err)
+			}
+		}
+
 		if sub.CancellationDetails.Reason != "" {
 			license.IsValid = false
 			license.ValidityReason = fmt.Sprintf("subscription was cancelled: %s", sub.CancellationDetails.Reason)
-			ctx.logger.Info().Msgf("invalidated license: %s", license.ID)
+			ctx.logger.Info().Msgf("invalidated license: %s", redactLicenseID(license.ID))
 		} else {
 			license.IsValid = true
 			license.ValidityReason = ""
-			ctx.logger.Info().Msgf("activated license: %s", license.ID)
+			ctx.logger.Info().Msgf("activated license: %s", redactLicenseID(license.ID))
 		}
 
-		if err = ctx.licenseStore.UpdateLicense(license); err != nil {
+		if err = ctx.licenseStore.UpdateLicense(req.Context(), license, "is_valid", "validity_reason"); err != nil {
 			return http.StatusInternalServerError, fmt.Errorf("error updating license: %v", err)
 		}
 	default:
-		fmt.Fprintf(os.Stderr, "Unhandled event type: %s", event.Type)
+		handled = false
+		ctx.logger.Warn().Str("event_type", string(event.Type)).Msg("unhandled webhook event type")
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -209,21 +404,19 @@ func handleGetLicense(ctx appContext, w http.ResponseWriter, req *http.Request)
 	licenseID := vars["id"]
 
 	if licenseID == "" {
-		return http.StatusBadRequest, errors.New("licenseID path parameter was empty")
+		return http.StatusBadRequest, newAppError(codeBadRequest, "licenseID path parameter was empty")
 	}
 
-	ctx.logger.Info().Msgf("verifying license: %s", licenseID)
+	ctx.logger.Info().Msgf("verifying license: %s", redactLicenseID(licenseID))
 
-	license, err := ctx.licenseStore.GetLicenseByID(licenseID)
+	license, err := ctx.licenseStore.GetLicenseByID(req.Context(), licenseID)
 	if err != nil {
 		return http.StatusInternalServerError, fmt.Errorf("failed to get license: %s", err.Error())
 	}
 
-	// if license == nil {
-	// 	w.WriteHeader(http.StatusBadRequest)
-	// 	fmt.Fprintf(w, "License %s was not found", licenseID)
-	// 	return
-	// }
+	if license == nil {
+		return http.StatusNotFound, newAppError(codeNotFound, "license not found")
+	}
 
 	if err := json.NewEncoder(w).Encode(license); err != nil {
 		return http.StatusInternalServerError, err
@@ -275,7 +468,7 @@ type TrialRegisterReq struct {
 
 func RegisterNewUser(ctx appContext, email string) error {
 	licenseID := GenerateLicenseKey()
-	ctx.logger.Info().Msgf("generated license: %s", licenseID)
+	ctx.logger.Info().Msgf("generated license: %s", redactLicenseID(licenseID))
 
 	license := &License{
 		ID:             licenseID,
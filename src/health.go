@@ -0,0 +1,182 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"golang.org/x/oauth2/google"
+)
+
+// readinessCheckTimeout bounds how long a single readiness check may take.
+const readinessCheckTimeout = 2 * time.Second
+
+const (
+	healthStatusOK       = "ok"
+	healthStatusDegraded = "degraded"
+	healthStatusFail     = "fail"
+)
+
+// healthCheck is a dependency check run by the readiness endpoint. A failing
+// critical check makes the server unready; other failures only degrade it.
+type healthCheck struct {
+	Name     string
+	Critical bool
+	Check    func(context.Context) error
+}
+
+// CheckResult is the outcome of a single readiness check.
+type CheckResult struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// ReadinessRes is the response of the readiness endpoint.
+type ReadinessRes struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// newHealthChecks returns the readiness checks for the server's dependencies.
+func newHealthChecks(ctx appContext, conn *pg.DB) []healthCheck {
+	return []healthCheck{
+		{Name: "database", Critical: true, Check: conn.Ping},
+		{Name: "classifier", Critical: false, Check: ctx.classifier.Check},
+		{Name: "mail", Critical: false, Check: func(context.Context) error { return checkMailConfig(ctx.config) }},
+		{Name: "workers", Critical: true, Check: ctx.workers.Check},
+	}
+}
+
+// checkVisionCredentials returns a check that the Google credentials can be
+// found and exchanged for an access token. Tokens are reused until they
+// expire, so the check only reaches Google when a token must be refreshed.
+func checkVisionCredentials() func(context.Context) error {
+	var (
+		mu    sync.Mutex
+		creds *google.Credentials
+	)
+
+	return func(c context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if creds == nil {
+			found, err := google.FindDefaultCredentials(c, "https://www.googleapis.com/auth/cloud-vision")
+			if err != nil {
+				return err
+			}
+			creds = found
+		}
+
+		_, err := creds.TokenSource.Token()
+		return err
+	}
+}
+
+func checkMailConfig(config Config) error {
+	if config.SendgridAPIKey == "" {
+		return missingEnvErr("SENDGRID_API_KEY")
+	}
+	if config.EmailFrom == "" {
+		return missingEnvErr("EMAIL_FROM")
+	}
+	return nil
+}
+
+// runHealthChecks runs checks concurrently and returns the overall status
+// and the result of each check.
+func runHealthChecks(c context.Context, checks []healthCheck) ReadinessRes {
+	res := ReadinessRes{Status: healthStatusOK, Checks: make(map[string]CheckResult, len(checks))}
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, check := range checks {
+		wg.Add(1)
+		go func(check healthCheck) {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(c, readinessCheckTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := runHealthCheck(checkCtx, check)
+			result := CheckResult{
+				Status:    healthStatusOK,
+				LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				result.Error = err.Error()
+				result.Status = healthStatusDegraded
+				if check.Critical {
+					result.Status = healthStatusFail
+				}
+			}
+			res.Checks[check.Name] = result
+
+			switch {
+			case result.Status == healthStatusFail:
+				res.Status = healthStatusFail
+			case result.Status == healthStatusDegraded && res.Status == healthStatusOK:
+				res.Status = healthStatusDegraded
+			}
+		}(check)
+	}
+	wg.Wait()
+
+	return res
+}
+
+// runHealthCheck runs check, failing it if it outlives ctx.
+func runHealthCheck(ctx context.Context, check healthCheck) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- check.Check(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return errors.New("timed out")
+	}
+}
+
+// handleLiveness reports that the process is up. It checks no dependencies
+// so a dependency outage doesn't get the process restarted.
+func handleLiveness(ctx appContext, w http.ResponseWriter, req *http.Request) (int, error) {
+	if err := json.NewEncoder(w).Encode(map[string]string{"status": healthStatusOK}); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// handleReadiness reports whether the server can take traffic. It responds
+// with 503 when a critical dependency is down, and 200 otherwise, including
+// when it is only degraded.
+func handleReadiness(ctx appContext, w http.ResponseWriter, req *http.Request) (int, error) {
+	res := runHealthChecks(req.Context(), ctx.healthChecks)
+
+	status := http.StatusOK
+	if res.Status == healthStatusFail {
+		status = http.StatusServiceUnavailable
+		ctx.logger.Error().Msgf("readiness check failed: %+v", res.Checks)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return status, nil
+}
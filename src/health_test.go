@@ -0,0 +1,108 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestReadiness(t *testing.T) {
+	okCheck := func(context.Context) error { return nil }
+	failCheck := func(context.Context) error { return errors.New("connection refused") }
+
+	readiness := func(t *testing.T, checks []healthCheck) (int, ReadinessRes) {
+		ctx := appContext{logger: zerolog.Nop(), healthChecks: checks}
+		rr := httptest.NewRecorder()
+		(&appHandler{ctx, handleReadiness}).ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+
+		var res ReadinessRes
+		if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return rr.Code, res
+	}
+
+	t.Run("ready when all checks pass", func(t *testing.T) {
+		code, res := readiness(t, []healthCheck{
+			{Name: "database", Critical: true, Check: okCheck},
+			{Name: "mail", Check: okCheck},
+		})
+		if code != http.StatusOK || res.Status != healthStatusOK {
+			t.Fatalf("expected 200 ok but got %d %s", code, res.Status)
+		}
+		if len(res.Checks) != 2 || res.Checks["database"].Status != healthStatusOK {
+			t.Errorf("unexpected checks: %+v", res.Checks)
+		}
+	})
+
+	t.Run("degraded when a non critical check fails", func(t *testing.T) {
+		code, res := readiness(t, []healthCheck{
+			{Name: "database", Critical: true, Check: okCheck},
+			{Name: "classifier", Check: failCheck},
+		})
+		if code != http.StatusOK || res.Status != healthStatusDegraded {
+			t.Fatalf("expected 200 degraded but got %d %s", code, res.Status)
+		}
+		if res.Checks["classifier"].Error != "connection refused" {
+			t.Errorf("expected classifier error but got %+v", res.Checks["classifier"])
+		}
+	})
+
+	t.Run("unready when a critical check fails", func(t *testing.T) {
+		code, res := readiness(t, []healthCheck{
+			{Name: "database", Critical: true, Check: failCheck},
+			{Name: "classifier", Check: failCheck},
+		})
+		if code != http.StatusServiceUnavailable || res.Status != healthStatusFail {
+			t.Fatalf("expected 503 fail but got %d %s", code, res.Status)
+		}
+	})
+
+	t.Run("workers are unready while draining", func(t *testing.T) {
+		workers := newWorkerGroup()
+		if err := workers.Check(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := workers.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := workers.Check(context.Background()); err == nil {
+			t.Fatal("expected draining workers to fail the check")
+		}
+	})
+
+	t.Run("degraded while the classifier circuit is open", func(t *testing.T) {
+		config := Config{ClassifierBreakerThreshold: 1, ClassifierBreakerCooldown: time.Minute}
+		classifier := guardClassifier("google", newVisionClassifier(&fakeAnnotator{}, config), config)
+		check := classifier.Check
+		if err := check(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		_ = classifier.breaker.Allow()
+		classifier.breaker.Done(errors.New("unavailable"), true)
+
+		code, res := readiness(t, []healthCheck{
+			{Name: "database", Critical: true, Check: okCheck},
+			{Name: "classifier", Check: check},
+		})
+		if code != http.StatusOK || res.Status != healthStatusDegraded {
+			t.Fatalf("expected 200 degraded but got %d %s", code, res.Status)
+		}
+	})
+
+	t.Run("liveness checks no dependencies", func(t *testing.T) {
+		ctx := appContext{logger: zerolog.Nop(), healthChecks: []healthCheck{{Name: "database", Critical: true, Check: failCheck}}}
+		rr := httptest.NewRecorder()
+		(&appHandler{ctx, handleLiveness}).ServeHTTP(rr, httptest.NewRequest("GET", "/healthz", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected 200 but got %d", rr.Code)
+		}
+	})
+}
@@ -0,0 +1,130 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// errPrivateAddress is returned when an image URI resolves to an address
+// that must not be reached from the server.
+var errPrivateAddress = errors.New("image address is not public")
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598, which isn't
+// publicly routable but isn't reported as private by net.IP either.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPublicAddress reports whether images may be fetched from ip.
+func isPublicAddress(ip net.IP) bool {
+	return ip != nil && !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsUnspecified() && !sharedAddressSpace.Contains(ip)
+}
+
+// newImageFetchClient returns the HTTP client for downloading images on
+// behalf of providers that need the image bytes. Unless allowPrivate is set,
+// it refuses to connect to loopback, private, carrier-grade NAT and
+// link-local addresses, so clients can't use image URIs to reach internal
+// services.
+func newImageFetchClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if !isPublicAddress(net.ParseIP(host)) {
+				return errPrivateAddress
+			}
+			return nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// imageValidators are the origin's validators for an image, used to ask it
+// whether the image changed since it was classified.
+type imageValidators struct {
+	ETag         string
+	LastModified string
+}
+
+func validatorsFromResponse(res *http.Response) imageValidators {
+	return imageValidators{ETag: res.Header.Get("ETag"), LastModified: res.Header.Get("Last-Modified")}
+}
+
+// fetchImage downloads the image at uri, failing if it is larger than
+// maxBytes.
+func fetchImage(ctx context.Context, client *http.Client, uri string, maxBytes int64) ([]byte, imageValidators, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, imageValidators{}, err
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, imageValidators{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, imageValidators{}, fmt.Errorf("image request returned %s", res.Status)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(res.Body, maxBytes+1))
+	if err != nil {
+		return nil, imageValidators{}, err
+	}
+	if int64(len(b)) > maxBytes {
+		return nil, imageValidators{}, fmt.Errorf("image is larger than %d bytes", maxBytes)
+	}
+	return b, validatorsFromResponse(res), nil
+}
+
+// checkImageModified asks the origin whether the image at uri changed since
+// it had the validators v, returning the origin's current validators. Without
+// validators the image is always reported modified.
+func checkImageModified(ctx context.Context, client *http.Client, uri string, v imageValidators) (bool, imageValidators, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return false, imageValidators{}, err
+	}
+	if v.ETag != "" {
+		req.Header.Set("If-None-Match", v.ETag)
+	}
+	if v.LastModified != "" {
+		req.Header.Set("If-Modified-Since", v.LastModified)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return false, imageValidators{}, err
+	}
+	// Only the status and headers are needed, so the body isn't read.
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotModified:
+		// A 304 may leave out validators that didn't change.
+		current := validatorsFromResponse(res)
+		if current.ETag == "" {
+			current.ETag = v.ETag
+		}
+		if current.LastModified == "" {
+			current.LastModified = v.LastModified
+		}
+		return false, current, nil
+	case res.StatusCode >= 200 && res.StatusCode <= 299:
+		return true, validatorsFromResponse(res), nil
+	}
+	return false, imageValidators{}, fmt.Errorf("image request returned %s", res.Status)
+}
@@ -1,11 +1,15 @@
 package src
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
 )
 
 type ImageAnnotation struct {
@@ -14,19 +18,37 @@ type ImageAnnotation struct {
 	Error     sql.NullString `json:"error"` // Any error returned when trying to filter the image.
 	DateAdded time.Time      `json:"dateAdded"`
 
+	ErrorKind  string `json:"errorKind,omitempty"` // The kind of Error, such as "fetch_failed".
+	RetryCount int    `json:"-" pg:",use_zero"`    // How many times in a row classifying the image failed after the first error.
+
 	// from SafeSearchAnnotation fields
 	Adult    int16 `json:"adult"`
 	Spoof    int16 `json:"spoof"`
 	Medical  int16 `json:"medical"`
 	Violence int16 `json:"violence"`
 	Racy     int16 `json:"racy"`
+
+	Provider     string    `json:"provider,omitempty"`     // The providers that classified the image.
+	ModelVersion string    `json:"modelVersion,omitempty"` // The version of the providers' models.
+	ValidatedAt  time.Time `json:"-"`                      // When the annotation was last classified or found unchanged at the origin.
+	ETag         string    `json:"-" pg:"etag"`            // The origin's ETag for the image, if any.
+	LastModified string    `json:"-"`                      // The origin's Last-Modified for the image, if any.
+
+	OverrideVerdict string    `json:"-"` // A verdict pinned by an admin over the scores, "allow" or "block".
+	OverrideReason  string    `json:"-"` // Why the verdict was pinned.
+	OverriddenAt    time.Time `json:"-"` // When the verdict was pinned.
+}
+
+// validators returns the origin's validators stored with the annotation.
+func (anno *ImageAnnotation) validators() imageValidators {
+	return imageValidators{ETag: anno.ETag, LastModified: anno.LastModified}
 }
 
 // FindByURI returns an image with the matching URI.
-func FindByURI(conn pg.DB, imgURI string) (ImageAnnotation, error) {
+func FindByURI(ctx context.Context, conn pg.DB, imgURI string) (ImageAnnotation, error) {
 	var img ImageAnnotation
 
-	err := conn.Model(&img).Where("uri = ?", imgURI).Select()
+	err := conn.ModelContext(ctx, &img).Where("uri = ?", imgURI).Select()
 	if err != nil {
 		return img, err
 	}
@@ -35,14 +57,30 @@ func FindByURI(conn pg.DB, imgURI string) (ImageAnnotation, error) {
 }
 
 // FindAnnotationsByURI returns annotations that have matching URI's.
-func FindAnnotationsByURI(conn pg.DB, uris []string) ([]ImageAnnotation, error) {
+func FindAnnotationsByURI(ctx context.Context, conn pg.DB, uris []string) ([]ImageAnnotation, error) {
 	var annotations []ImageAnnotation
 
 	if len(uris) == 0 {
 		return nil, fmt.Errorf("imgURIList cannot be empty")
 	}
 
-	if err := conn.Model(&annotations).Where("uri IN (?)", pg.In(uris)).Select(); err != nil {
+	if err := conn.ModelContext(ctx, &annotations).Where("uri IN (?)", pg.In(uris)).Select(); err != nil {
+		return nil, err
+	}
+
+	return annotations, nil
+}
+
+// FindAnnotationsByHash returns annotations that have matching hashes. The
+// hash leads the primary key, so unlike a lookup by URI this is an index scan.
+func FindAnnotationsByHash(ctx context.Context, conn pg.DB, hashes []string) ([]ImageAnnotation, error) {
+	var annotations []ImageAnnotation
+
+	if len(hashes) == 0 {
+		return nil, fmt.Errorf("hashes cannot be empty")
+	}
+
+	if err := conn.ModelContext(ctx, &annotations).Where("hash IN (?)", pg.In(hashes)).Select(); err != nil {
 		return nil, err
 	}
 
@@ -50,8 +88,8 @@ func FindAnnotationsByURI(conn pg.DB, uris []string) ([]ImageAnnotation, error)
 }
 
 // Insert inserts the annotation into the DB.
-func Insert(conn pg.DB, image ImageAnnotation) error {
-	_, err := conn.Model(&image).Insert()
+func Insert(ctx context.Context, conn pg.DB, image ImageAnnotation) error {
+	_, err := conn.ModelContext(ctx, &image).Insert()
 	if err != nil {
 		return err
 	}
@@ -59,27 +97,236 @@ func Insert(conn pg.DB, image ImageAnnotation) error {
 	return nil
 }
 
-// InsertAll inserts all the image safe search annotations into the DB.
-func InsertAll(conn pg.DB, images []*ImageAnnotation) error {
-	if len(images) == 0 {
-		return nil
+// annotationInsertChunkSize bounds how many annotations are upserted per
+// statement, keeping statements and their row locks small.
+const annotationInsertChunkSize = 500
+
+// InsertAll inserts all the image safe search annotations into the DB,
+// replacing the annotations of images that were classified again. When
+// requests race to cache the same image, the most recently validated
+// annotation is kept. It returns the rows as written, leaving out the
+// annotations that lost to a more recent one.
+func InsertAll(ctx context.Context, conn pg.DB, images []*ImageAnnotation) ([]*ImageAnnotation, error) {
+	var written []*ImageAnnotation
+	for _, chunk := range annotationChunks(images, annotationInsertChunkSize) {
+		var rows []*ImageAnnotation
+		_, err := conn.ModelContext(ctx, &chunk).
+			OnConflict("(hash, uri) DO UPDATE").
+			Set("error = EXCLUDED.error").
+			Set("error_kind = EXCLUDED.error_kind").
+			Set("retry_count = EXCLUDED.retry_count").
+			Set("adult = EXCLUDED.adult").
+			Set("spoof = EXCLUDED.spoof").
+			Set("medical = EXCLUDED.medical").
+			Set("violence = EXCLUDED.violence").
+			Set("racy = EXCLUDED.racy").
+			Set("provider = EXCLUDED.provider").
+			Set("model_version = EXCLUDED.model_version").
+			Set("validated_at = EXCLUDED.validated_at").
+			Set("etag = EXCLUDED.etag").
+			Set("last_modified = EXCLUDED.last_modified").
+			Where("image_annotation.validated_at <= EXCLUDED.validated_at").
+			Returning("*").
+			Insert(&rows)
+		if err != nil {
+			return nil, err
+		}
+		written = append(written, rows...)
 	}
 
-	_, err := conn.Model(&images).Insert()
-	if err != nil {
-		return err
+	return written, nil
+}
+
+// annotationChunks splits images into chunks of up to size for upserting.
+// An upsert can't touch a row twice, so only the most recently validated
+// annotation of each image is kept, and rows are sorted by key so concurrent
+// upserts of overlapping images lock them in the same order.
+func annotationChunks(images []*ImageAnnotation, size int) [][]*ImageAnnotation {
+	type key struct{ hash, uri string }
+	latest := make(map[key]*ImageAnnotation, len(images))
+	for _, img := range images {
+		k := key{img.Hash, img.URI}
+		if prev, ok := latest[k]; !ok || prev.ValidatedAt.Before(img.ValidatedAt) {
+			latest[k] = img
+		}
+	}
+
+	unique := make([]*ImageAnnotation, 0, len(latest))
+	for _, img := range latest {
+		unique = append(unique, img)
+	}
+	sort.Slice(unique, func(i, j int) bool {
+		if unique[i].Hash != unique[j].Hash {
+			return unique[i].Hash < unique[j].Hash
+		}
+		return unique[i].URI < unique[j].URI
+	})
+
+	var chunks [][]*ImageAnnotation
+	for len(unique) > 0 {
+		n := min(size, len(unique))
+		chunks = append(chunks, unique[:n])
+		unique = unique[n:]
+	}
+	return chunks
+}
+
+// MarkValidated records that the images of annos are unchanged at the origin,
+// along with the origin's current validators, one statement per chunk.
+func MarkValidated(ctx context.Context, conn pg.DB, annos []*ImageAnnotation) error {
+	for _, chunk := range annotationChunks(annos, annotationInsertChunkSize) {
+		// The key columns are listed so the rows can be joined on them; they
+		// are set to the values they already have.
+		_, err := conn.ModelContext(ctx, &chunk).
+			Column("validated_at", "etag", "last_modified", "hash", "uri").
+			Where("image_annotation.hash = _data.hash AND image_annotation.uri = _data.uri").
+			Update()
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-// DeleteByURI deletes the images with matching URI.
-func DeleteByURI(conn pg.DB, uri string) error {
+// OverrideVerdict pins verdict over the scores of the annotations with the
+// hash, or unpins it if verdict is empty, returning the URIs of the updated
+// annotations. The scores are left as classified.
+func OverrideVerdict(ctx context.Context, conn orm.DB, hash string, verdict string, reason string) ([]string, error) {
+	var updated []ImageAnnotation
+
+	q := conn.ModelContext(ctx, &updated)
+	if verdict == "" {
+		q = q.Set("override_verdict = NULL").Set("override_reason = NULL").Set("overridden_at = NULL")
+	} else {
+		q = q.Set("override_verdict = ?", verdict).Set("override_reason = ?", reason).Set("overridden_at = ?", time.Now())
+	}
+	if _, err := q.Where("hash = ?", hash).Returning("uri").Update(); err != nil {
+		return nil, err
+	}
+
+	uris := make([]string, len(updated))
+	for i, anno := range updated {
+		uris[i] = anno.URI
+	}
+	return uris, nil
+}
+
+// PinOverride pins the override of anno on the cached annotation of its image,
+// or caches anno if there is none, in one statement so the pin can't be lost
+// to a concurrent classification inserting the image first.
+func PinOverride(ctx context.Context, conn orm.DB, anno *ImageAnnotation) error {
+	_, err := conn.ModelContext(ctx, anno).
+		OnConflict("(hash, uri) DO UPDATE").
+		Set("override_verdict = EXCLUDED.override_verdict").
+		Set("override_reason = EXCLUDED.override_reason").
+		Set("overridden_at = EXCLUDED.overridden_at").
+		Insert()
+	return err
+}
+
+// DeleteByURI deletes the images with matching URI, dropping them from lru
+// too.
+func DeleteByURI(ctx context.Context, conn pg.DB, lru *annotationLRU, uri string) error {
 	img := ImageAnnotation{URI: uri}
 
-	if _, err := conn.Model(&img).Where("uri = ?", uri).Delete(); err != nil {
+	if _, err := conn.ModelContext(ctx, &img).Where("uri = ?", uri).Delete(); err != nil {
 		return err
 	}
+	lru.Invalidate(uri)
 
 	return nil
 }
+
+// AnnotationFilter selects cached annotations to purge. Set conditions are
+// combined, so a filter by domain and date purges the domain's images cached
+// in the date range.
+type AnnotationFilter struct {
+	URIs   []string  // URIs selects the images with these URIs.
+	Hashes []string  // Hashes selects the images with these hashes.
+	Domain string    // Domain selects images hosted on the domain, or on its subdomains if it starts with "*.".
+	After  time.Time // After selects images cached at or after the time.
+	Before time.Time // Before selects images cached before the time.
+}
+
+// empty reports whether the filter selects every annotation.
+func (f AnnotationFilter) empty() bool {
+	return len(f.URIs) == 0 && len(f.Hashes) == 0 && f.Domain == "" && f.After.IsZero() && f.Before.IsZero()
+}
+
+// uriHostExpr extracts the lowercased host from an annotation's URI.
+const uriHostExpr = `lower(substring(uri from '^[a-zA-Z][a-zA-Z0-9+.-]*://(?:[^/?#@]*@)?([^/?#:]+)'))`
+
+// DeleteAnnotations deletes the annotations matching filter, returning the
+// URIs of those deleted. An empty filter is refused rather than deleting the
+// whole cache.
+func DeleteAnnotations(ctx context.Context, conn pg.DB, filter AnnotationFilter) ([]string, error) {
+	if filter.empty() {
+		return nil, fmt.Errorf("filter cannot be empty")
+	}
+
+	var deleted []ImageAnnotation
+	q := conn.ModelContext(ctx, &deleted)
+	if len(filter.URIs) > 0 {
+		q = q.Where("uri IN (?)", pg.In(filter.URIs))
+	}
+	if len(filter.Hashes) > 0 {
+		q = q.Where("hash IN (?)", pg.In(filter.Hashes))
+	}
+	if domain := strings.ToLower(filter.Domain); domain != "" {
+		if suffix, ok := strings.CutPrefix(domain, "*."); ok {
+			q = q.WhereGroup(func(q *pg.Query) (*pg.Query, error) {
+				return q.Where(uriHostExpr+" = ?", suffix).
+					WhereOr(uriHostExpr+" LIKE ?", "%."+suffix), nil
+			})
+		} else {
+			q = q.Where(uriHostExpr+" = ?", domain)
+		}
+	}
+	if !filter.After.IsZero() {
+		q = q.Where("date_added >= ?", filter.After)
+	}
+	if !filter.Before.IsZero() {
+		q = q.Where("date_added < ?", filter.Before)
+	}
+
+	if _, err := q.Returning("uri").Delete(); err != nil {
+		return nil, err
+	}
+
+	uris := make([]string, len(deleted))
+	for i, anno := range deleted {
+		uris[i] = anno.URI
+	}
+	return uris, nil
+}
+
+// AnnotationStats describes the annotation cache table.
+type AnnotationStats struct {
+	Rows   int               `json:"rows"`   // Rows is the number of cached annotations.
+	Errors int               `json:"errors"` // Errors is how many of them record a failed classification.
+	Bytes  int64             `json:"bytes"`  // Bytes is the size of the table, including indexes.
+	Oldest []ImageAnnotation `json:"oldest"` // Oldest are the least recently validated annotations.
+}
+
+// GetAnnotationStats returns statistics on the annotation cache along with
+// its oldest annotations, up to oldest of them.
+func GetAnnotationStats(ctx context.Context, conn pg.DB, oldest int) (AnnotationStats, error) {
+	var stats AnnotationStats
+
+	_, err := conn.QueryOneContext(ctx, pg.Scan(&stats.Rows, &stats.Errors, &stats.Bytes), `
+		SELECT count(*), count(error), pg_total_relation_size('image_annotations')
+		FROM image_annotations`)
+	if err != nil {
+		return stats, err
+	}
+
+	if oldest > 0 {
+		err = conn.ModelContext(ctx, &stats.Oldest).Order("validated_at ASC").Limit(oldest).Select()
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	return stats, nil
+}
@@ -1,9 +1,11 @@
 package src
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -26,8 +28,14 @@ func getTestCtx() (appContext, error) {
 	}
 	ctx.db = *conn
 	ctx.logger = zerolog.New(os.Stderr).With().Timestamp().Logger()
-	ctx.licenseStore = NewLicenseStore(conn)
+	ctx.licenseStore = NewLicenseStore(conn, config.DBTimeout)
+	ctx.ruleStore = NewRuleStore(conn, config.DBTimeout)
 	ctx.annotationStore = nil
+	ctx.classifier, err = NewClassifier(context.Background(), config)
+	if err != nil {
+		return ctx, err
+	}
+	ctx.revalidator = newCacheRevalidator(config)
 	ctx.config = config
 	return ctx, nil
 }
@@ -66,7 +74,7 @@ func TestImages(t *testing.T) {
 				Violence:  0,
 				Racy:      0,
 			}
-			err := Insert(ctx.db, anno)
+			err := Insert(context.Background(), ctx.db, anno)
 			if err != nil {
 				t.Fatal(err.Error())
 			}
@@ -76,7 +84,7 @@ func TestImages(t *testing.T) {
 	t.Run("finds images by URI", func(t *testing.T) {
 		smallURIList := imgURIList[:1]
 
-		imgList, err := FindAnnotationsByURI(ctx.db, smallURIList)
+		imgList, err := FindAnnotationsByURI(context.Background(), ctx.db, smallURIList)
 		if err != nil {
 			t.Fatal(err.Error())
 		}
@@ -87,19 +95,242 @@ func TestImages(t *testing.T) {
 		}
 
 		smallURIList = []string{}
-		_, err = FindAnnotationsByURI(ctx.db, smallURIList)
+		_, err = FindAnnotationsByURI(context.Background(), ctx.db, smallURIList)
 		if err == nil {
 			t.Fatal("Expected FindImagesByURI to return an error because imgURIList cannot be empty")
 		}
 	})
 
+	t.Run("finds images by hash", func(t *testing.T) {
+		imgList, err := FindAnnotationsByHash(context.Background(), ctx.db, []string{Hash(imgURIList[0]), Hash("https://example.com/missing.jpg")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(imgList) != 1 || imgList[0].URI != imgURIList[0] {
+			t.Fatalf("Expected the first image in response but received %v", imgList)
+		}
+	})
+
 	t.Run("deletes images by URI", func(t *testing.T) {
+		ctx.lru = newAnnotationLRU(10, 0)
+		ctx.lru.AddAll([]*ImageAnnotation{{URI: imgURIList[0]}})
 		for _, uri := range imgURIList {
-			err := DeleteByURI(ctx.db, uri)
+			err := DeleteByURI(context.Background(), ctx.db, ctx.lru, uri)
 			if err != nil {
 				t.Fatal(err)
 			}
 		}
+		if ctx.lru.Len() != 0 {
+			t.Fatal("Expected the deleted image to be dropped from the LRU")
+		}
 	})
 
 }
+
+func TestDeleteAnnotations(t *testing.T) {
+	ctx, err := getTestCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	uris := []string{
+		"https://example.com/a.jpg",
+		"https://cdn.example.com/b.jpg",
+		"https://user@img.example.com:8443/c.jpg?size=2",
+		"https://notexample.com/d.jpg",
+		"https://other.org/e.jpg",
+	}
+	insert := func() {
+		annos := make([]*ImageAnnotation, len(uris))
+		for i, uri := range uris {
+			annos[i] = &ImageAnnotation{Hash: Hash(uri), URI: uri, ValidatedAt: time.Now()}
+			if i == len(uris)-1 {
+				annos[i].DateAdded = old
+			}
+		}
+		if _, err := InsertAll(context.Background(), ctx.db, annos); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer DeleteAnnotations(context.Background(), ctx.db, AnnotationFilter{URIs: uris})
+
+	tests := []struct {
+		name   string
+		filter AnnotationFilter
+		want   int
+	}{
+		{"by domain", AnnotationFilter{Domain: "example.com"}, 1},
+		{"by domain and subdomains", AnnotationFilter{Domain: "*.example.com"}, 3},
+		{"by hash", AnnotationFilter{Hashes: []string{Hash(uris[3])}}, 1},
+		{"by date", AnnotationFilter{Before: old.Add(time.Hour), URIs: uris}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			insert()
+			deleted, err := DeleteAnnotations(context.Background(), ctx.db, test.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(deleted) != test.want {
+				t.Fatalf("expected %d images to be deleted but got %v", test.want, deleted)
+			}
+		})
+	}
+
+	t.Run("refuses an empty filter", func(t *testing.T) {
+		if _, err := DeleteAnnotations(context.Background(), ctx.db, AnnotationFilter{}); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("reports stats", func(t *testing.T) {
+		insert()
+		stats, err := GetAnnotationStats(context.Background(), ctx.db, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Rows < len(uris) || stats.Bytes == 0 || len(stats.Oldest) != 2 {
+			t.Fatalf("unexpected stats %+v", stats)
+		}
+	})
+}
+
+func TestAnnotationChunks(t *testing.T) {
+	now := time.Now()
+	images := []*ImageAnnotation{
+		{Hash: "c", URI: "c", ValidatedAt: now},
+		{Hash: "a", URI: "a", ValidatedAt: now.Add(-time.Hour), Adult: 1},
+		{Hash: "b", URI: "b", ValidatedAt: now},
+		{Hash: "a", URI: "a", ValidatedAt: now, Adult: 2},
+		{Hash: "a", URI: "a", ValidatedAt: now.Add(-time.Minute), Adult: 3},
+	}
+
+	chunks := annotationChunks(images, 2)
+	if len(chunks) != 2 || len(chunks[0]) != 2 || len(chunks[1]) != 1 {
+		t.Fatalf("expected chunks of 2 and 1 images but got %v", chunks)
+	}
+	if chunks[0][0].URI != "a" || chunks[0][1].URI != "b" || chunks[1][0].URI != "c" {
+		t.Fatal("expected the images to be sorted by key")
+	}
+	if chunks[0][0].Adult != 2 {
+		t.Fatalf("expected the most recently validated annotation to be kept but got %+v", chunks[0][0])
+	}
+	if chunks := annotationChunks(nil, 2); len(chunks) != 0 {
+		t.Fatalf("expected no chunks but got %v", chunks)
+	}
+}
+
+func TestInsertAllConcurrent(t *testing.T) {
+	ctx, err := getTestCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each request caches a window of images overlapping its neighbours',
+	// spanning several chunks.
+	const requests, images = 8, 2 * annotationInsertChunkSize
+	uris := make([]string, images+requests*100)
+	for i := range uris {
+		uris[i] = fmt.Sprintf("https://example.com/upsert/%d.jpg", i)
+	}
+	defer func() {
+		for _, uri := range uris {
+			DeleteByURI(context.Background(), ctx.db, ctx.lru, uri)
+		}
+	}()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	errs := make([]error, requests)
+	for r := 0; r < requests; r++ {
+		annos := make([]*ImageAnnotation, 0, images)
+		for _, uri := range uris[r*100 : r*100+images] {
+			annos = append(annos, &ImageAnnotation{
+				Hash:        Hash(uri),
+				URI:         uri,
+				Adult:       int16(r),
+				ValidatedAt: start.Add(time.Duration(r) * time.Second),
+			})
+		}
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			_, errs[r] = InsertAll(context.Background(), ctx.db, annos)
+		}(r)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cached, err := FindAnnotationsByURI(context.Background(), ctx.db, uris)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cached) != len(uris) {
+		t.Fatalf("expected %d images but got %d", len(uris), len(cached))
+	}
+	for _, anno := range cached {
+		var i int
+		fmt.Sscanf(anno.URI, "https://example.com/upsert/%d.jpg", &i)
+		// The last request to cover the image validated it most recently.
+		if want := int16(min(i/100, requests-1)); anno.Adult != want {
+			t.Fatalf("expected %s to be kept from request %d but got %d", anno.URI, want, anno.Adult)
+		}
+	}
+
+	// An annotation older than the cached one isn't written, nor returned.
+	stale := &ImageAnnotation{Hash: Hash(uris[0]), URI: uris[0], Adult: 99, ValidatedAt: start.Add(-time.Hour)}
+	fresh := &ImageAnnotation{Hash: Hash(uris[1]), URI: uris[1], Adult: 7, ValidatedAt: time.Now().Add(time.Hour)}
+	written, err := InsertAll(context.Background(), ctx.db, []*ImageAnnotation{stale, fresh})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != 1 || written[0].URI != fresh.URI || written[0].Adult != 7 {
+		t.Fatalf("expected only the newer annotation to be written but got %v", written)
+	}
+}
+
+// BenchmarkGetCachedSSAs looks up requests of thousands of URIs, half of them
+// cached, against the test database.
+func BenchmarkGetCachedSSAs(b *testing.B) {
+	ctx, err := getTestCtx()
+	if err != nil {
+		b.Skip(err)
+	}
+
+	for _, n := range []int{1000, 5000} {
+		uris := make([]string, n)
+		annos := make([]*ImageAnnotation, 0, n/2)
+		for i := range uris {
+			uris[i] = fmt.Sprintf("https://example.com/bench/%d/%d.jpg", n, i)
+			if i%2 == 0 {
+				annos = append(annos, &ImageAnnotation{Hash: Hash(uris[i]), URI: uris[i], DateAdded: time.Now(), ValidatedAt: time.Now()})
+			}
+		}
+		if _, err := InsertAll(context.Background(), ctx.db, annos); err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				cached, uncached, err := getCachedSSAs(context.Background(), ctx, uris)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(cached) != len(annos) || len(uncached) != n-len(annos) {
+					b.Fatalf("expected %d cached but got %d", len(annos), len(cached))
+				}
+			}
+		})
+
+		for _, anno := range annos {
+			if err := DeleteByURI(context.Background(), ctx.db, ctx.lru, anno.URI); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
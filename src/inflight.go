@@ -0,0 +1,207 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+)
+
+// Policies for billing images classified once for several requests.
+const (
+	coalescedBillingLeader = "leader" // Bill the license of the request that triggered the classification.
+	coalescedBillingSplit  = "split"  // Bill one of the requests for each image, spreading the cost across them.
+)
+
+// errFlightAbandoned is shared with requests waiting on a classification
+// whose leader returned without classifying the image.
+var errFlightAbandoned = errors.New("classification abandoned")
+
+// flightClaim identifies one request's claim on classifications.
+type flightClaim struct {
+	licenseID string
+}
+
+// classifyFlight is the classification of one URI by a leading request,
+// shared with the requests that asked for the same URI meanwhile.
+type classifyFlight struct {
+	key    string // The flightKey of the URI.
+	done   chan struct{}
+	anno   *ImageAnnotation
+	err    error
+	claims []*flightClaim // The requests waiting on the flight, leader first.
+	payer  *flightClaim   // The request billed for the image.
+}
+
+// classifyFlights de-duplicates classifications of the same URI by concurrent
+// requests, so a popular image missing from the cache is only classified, and
+// billed, once. Flights are keyed by URI, not by image content, so the same
+// image at two URIs is classified for each.
+type classifyFlights struct {
+	billing string
+
+	mu      sync.Mutex
+	flights map[string]*classifyFlight
+}
+
+func newClassifyFlights(billing string) *classifyFlights {
+	return &classifyFlights{billing: billing, flights: make(map[string]*classifyFlight)}
+}
+
+// flightKey returns the key of the flight of uri, a hash of the URI.
+func flightKey(uri string) string {
+	return Hash(uri)
+}
+
+// Claim splits uris into those the caller must classify, as no other request
+// is, and the flights of those another request is already classifying. The
+// caller must Finish every URI it leads. A nil group leads every URI.
+func (cf *classifyFlights) Claim(uris []string, licenseID string) (*flightClaim, []string, map[string]*classifyFlight) {
+	claim := &flightClaim{licenseID: licenseID}
+	if cf == nil {
+		return claim, uris, nil
+	}
+
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	lead := make([]string, 0, len(uris))
+	waiting := make(map[string]*classifyFlight)
+	for _, uri := range uris {
+		key := flightKey(uri)
+		if flight, ok := cf.flights[key]; ok {
+			flight.claims = append(flight.claims, claim)
+			waiting[uri] = flight
+			continue
+		}
+		cf.flights[key] = &classifyFlight{key: key, done: make(chan struct{}), claims: []*flightClaim{claim}}
+		lead = append(lead, uri)
+	}
+	return claim, lead, waiting
+}
+
+// Finish shares the annotations of the URIs claim leads with their waiters,
+// or err for those without an annotation, and ends the flights. It returns
+// how many of the annotations are billed to the leader. URIs already
+// finished are skipped, so Finish can be deferred to release what is left.
+func (cf *classifyFlights) Finish(claim *flightClaim, uris []string, annos []*ImageAnnotation, err error) int {
+	if cf == nil {
+		return len(annos)
+	}
+
+	byURI := make(map[string]*ImageAnnotation, len(annos))
+	for _, anno := range annos {
+		byURI[anno.URI] = anno
+	}
+	if err == nil {
+		err = errFlightAbandoned
+	}
+
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	billed := 0
+	for _, uri := range uris {
+		flight, ok := cf.flights[flightKey(uri)]
+		if !ok || flight.claims[0] != claim {
+			continue
+		}
+		delete(cf.flights, flight.key)
+
+		anno := byURI[uri]
+		if anno == nil {
+			flight.err = err
+			close(flight.done)
+			continue
+		}
+		copied := *anno
+		flight.anno = &copied
+		flight.payer = cf.payer(flight)
+		if flight.payer == claim {
+			billed++
+		}
+		close(flight.done)
+	}
+	return billed
+}
+
+// payer picks the request billed for a flight. Splitting picks one of the
+// requests by the flight's key, so shared images spread evenly across them.
+func (cf *classifyFlights) payer(flight *classifyFlight) *flightClaim {
+	if cf.billing != coalescedBillingSplit || len(flight.claims) == 1 {
+		return flight.claims[0]
+	}
+	n, err := strconv.ParseUint(flight.key[:8], 16, 32)
+	if err != nil {
+		return flight.claims[0]
+	}
+	return flight.claims[n%uint64(len(flight.claims))]
+}
+
+// Wait waits for the classifications of flights claim is waiting on,
+// returning the annotations of those that succeeded, how many of them are
+// billed to claim, and the first error, such as a leader's classifier error.
+// If c is done first, claim leaves the flights still running so it isn't
+// picked to pay for them.
+func (cf *classifyFlights) Wait(c context.Context, claim *flightClaim, flights map[string]*classifyFlight) ([]*ImageAnnotation, int, error) {
+	annos := make([]*ImageAnnotation, 0, len(flights))
+	billed := 0
+	var firstErr error
+	remaining := make(map[string]*classifyFlight, len(flights))
+	for uri, flight := range flights {
+		remaining[uri] = flight
+	}
+	for uri, flight := range flights {
+		select {
+		case <-flight.done:
+		case <-c.Done():
+			return annos, billed + cf.Leave(claim, remaining), c.Err()
+		}
+		delete(remaining, uri)
+		if flight.err != nil {
+			if firstErr == nil {
+				firstErr = flight.err
+			}
+			continue
+		}
+		if flight.payer == claim {
+			billed++
+		}
+		copied := *flight.anno
+		copied.URI = uri
+		annos = append(annos, &copied)
+	}
+	return annos, billed, firstErr
+}
+
+// Leave removes claim from the flights that are still running, returning how
+// many of those that finished meanwhile are billed to it anyway, as the
+// provider was called on its behalf. Requests that won't Wait for the flights
+// they joined must leave them.
+func (cf *classifyFlights) Leave(claim *flightClaim, flights map[string]*classifyFlight) int {
+	if cf == nil {
+		return 0
+	}
+
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	billed := 0
+	for _, flight := range flights {
+		select {
+		case <-flight.done:
+			if flight.payer == claim {
+				billed++
+			}
+			continue
+		default:
+		}
+		for i, c := range flight.claims {
+			if c == claim {
+				flight.claims = append(flight.claims[:i], flight.claims[i+1:]...)
+				break
+			}
+		}
+	}
+	return billed
+}
@@ -0,0 +1,124 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClassifyFlights(t *testing.T) {
+	t.Run("classifies concurrent requests for an image once", func(t *testing.T) {
+		flights := newClassifyFlights(coalescedBillingLeader)
+
+		var wg sync.WaitGroup
+		results := make([][]*ImageAnnotation, 5)
+		billed := make([]int, 5)
+		leaders := 0
+		for i := range results {
+			// Every request claims before the first one finishes.
+			claim, lead, waiting := flights.Claim([]string{"a"}, fmt.Sprint(i))
+			leaders += len(lead)
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer flights.Finish(claim, lead, nil, nil)
+				if len(lead) > 0 {
+					time.Sleep(10 * time.Millisecond)
+					results[i] = []*ImageAnnotation{{URI: "a", Adult: 5}}
+					billed[i] = flights.Finish(claim, lead, results[i], nil)
+					return
+				}
+				results[i], billed[i], _ = flights.Wait(context.Background(), claim, waiting)
+			}(i)
+		}
+		wg.Wait()
+
+		if leaders != 1 {
+			t.Fatalf("expected 1 classification but got %d", leaders)
+		}
+		for i, res := range results {
+			if len(res) != 1 || res[0].Adult != 5 {
+				t.Fatalf("expected every request to get the annotation but got %v", res)
+			}
+			if want := map[bool]int{true: 1, false: 0}[i == 0]; billed[i] != want {
+				t.Fatalf("expected request %d to be billed %d but got %d", i, want, billed[i])
+			}
+		}
+	})
+
+	t.Run("splits billing across requests", func(t *testing.T) {
+		flights := newClassifyFlights(coalescedBillingSplit)
+		uris := make([]string, 100)
+		for i := range uris {
+			uris[i] = fmt.Sprintf("https://example.com/%d.jpg", i)
+		}
+
+		leader, lead, _ := flights.Claim(uris, "leader")
+		waiter, _, waiting := flights.Claim(uris, "waiter")
+		annos := make([]*ImageAnnotation, len(lead))
+		for i, uri := range lead {
+			annos[i] = &ImageAnnotation{URI: uri}
+		}
+
+		leaderBilled := flights.Finish(leader, lead, annos, nil)
+		_, waiterBilled, err := flights.Wait(context.Background(), waiter, waiting)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leaderBilled+waiterBilled != len(uris) {
+			t.Fatalf("expected every image to be billed once but got %d and %d", leaderBilled, waiterBilled)
+		}
+		if leaderBilled < 25 || waiterBilled < 25 {
+			t.Fatalf("expected billing to be split but got %d and %d", leaderBilled, waiterBilled)
+		}
+	})
+
+	t.Run("shares the leader's error", func(t *testing.T) {
+		flights := newClassifyFlights(coalescedBillingLeader)
+		leader, lead, _ := flights.Claim([]string{"a", "b"}, "leader")
+		waiter, _, waiting := flights.Claim([]string{"a", "b", "c"}, "waiter")
+		if len(waiting) != 2 {
+			t.Fatalf("expected to wait on 2 images but got %d", len(waiting))
+		}
+
+		unavailable := errors.New("unavailable")
+		flights.Finish(leader, lead, []*ImageAnnotation{{URI: "a"}}, unavailable)
+		annos, _, err := flights.Wait(context.Background(), waiter, waiting)
+		if len(annos) != 1 || !errors.Is(err, unavailable) {
+			t.Fatalf("expected a's annotation and b's error but got %v, %v", annos, err)
+		}
+	})
+
+	t.Run("releases abandoned images", func(t *testing.T) {
+		flights := newClassifyFlights(coalescedBillingLeader)
+		leader, lead, _ := flights.Claim([]string{"a"}, "leader")
+		waiter, _, waiting := flights.Claim([]string{"a"}, "waiter")
+		flights.Finish(leader, lead, nil, nil)
+		flights.Finish(leader, lead, []*ImageAnnotation{{URI: "a"}}, nil)
+
+		if _, _, err := flights.Wait(context.Background(), waiter, waiting); !errors.Is(err, errFlightAbandoned) {
+			t.Fatalf("expected the image to be abandoned but got %v", err)
+		}
+		if _, lead, _ := flights.Claim([]string{"a"}, "leader"); len(lead) != 1 {
+			t.Fatal("expected the image to be claimable again")
+		}
+	})
+
+	t.Run("cancelled waiters are not billed", func(t *testing.T) {
+		flights := newClassifyFlights(coalescedBillingSplit)
+		leader, lead, _ := flights.Claim([]string{"a"}, "leader")
+		waiter, _, waiting := flights.Claim([]string{"a"}, "waiter")
+
+		c, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, billed, err := flights.Wait(c, waiter, waiting); !errors.Is(err, context.Canceled) || billed != 0 {
+			t.Fatalf("expected cancellation without billing but got %d, %v", billed, err)
+		}
+		if billed := flights.Finish(leader, lead, []*ImageAnnotation{{URI: "a"}}, nil); billed != 1 {
+			t.Fatalf("expected the leader to be billed but got %d", billed)
+		}
+	})
+}
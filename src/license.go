@@ -1,6 +1,9 @@
 package src
 
 import (
+	"context"
+	"time"
+
 	"github.com/go-pg/pg/v10"
 )
 
@@ -13,28 +16,45 @@ type License struct {
 	ValidityReason string `json:"validityReason"`
 	RequestCount   int    `json:"requestCount"`
 	IsTrial        bool   `json:"isTrial"`
+	Plan           string `json:"plan"` // Plan selects the license's rate limits.
+
+	// Monthly spending caps, reset at the Stripe billing period boundary.
+	SoftCap         int       `json:"softCap"`         // SoftCap is the image count that triggers a usage warning. 0 disables it.
+	HardCap         int       `json:"hardCap"`         // HardCap is the image count after which uncached classifications are rejected. 0 disables it.
+	PeriodUsage     int       `json:"periodUsage"`     // PeriodUsage is the number of images classified in the current billing period.
+	PeriodStart     time.Time `json:"periodStart"`     // PeriodStart is the start of the current billing period.
+	PeriodEnd       time.Time `json:"periodEnd"`       // PeriodEnd is the end of the current billing period.
+	SoftCapNotified bool      `json:"softCapNotified"` // SoftCapNotified is set once the soft cap warning email was sent this period.
 }
 
 type LicenseStorer interface {
-	GetLicenseByID(id string) (*License, error)
-	GetLicenseByStripeID(id string) (*License, error)
-	UpdateLicense(*License) error
-	GetLicenseByEmail(email string) (*License, error)
-	ExpireTrial(*License) (*License, error)
+	GetLicenseByID(ctx context.Context, id string) (*License, error)
+	GetLicenseByStripeID(ctx context.Context, id string) (*License, error)
+	UpdateLicense(ctx context.Context, license *License, columns ...string) error
+	AddUsage(ctx context.Context, license *License, n int) error
+	StartBillingPeriod(ctx context.Context, license *License) error
+	GetLicenseByEmail(ctx context.Context, email string) (*License, error)
+	ExpireTrial(ctx context.Context, license *License) (*License, error)
 }
 
+// licenseStore keeps licenses in Postgres. Each query is bounded by timeout
+// on top of the caller's context.
 type licenseStore struct {
-	db *pg.DB
+	db      *pg.DB
+	timeout time.Duration
 }
 
-func NewLicenseStore(db *pg.DB) *licenseStore {
-	return &licenseStore{db: db}
+func NewLicenseStore(db *pg.DB, timeout time.Duration) *licenseStore {
+	return &licenseStore{db: db, timeout: timeout}
 }
 
 // GetLicenseByID fetches a license from DB by license ID
-func (store *licenseStore) GetLicenseByID(id string) (*License, error) {
+func (store *licenseStore) GetLicenseByID(ctx context.Context, id string) (*License, error) {
+	ctx, cancel := withTimeout(ctx, store.timeout)
+	defer cancel()
+
 	license := new(License)
-	err := store.db.Model(license).Where("id = ?", id).Select()
+	err := store.db.ModelContext(ctx, license).Where("id = ?", id).Select()
 	if err != nil {
 		if err == pg.ErrNoRows {
 			return nil, nil
@@ -44,9 +64,12 @@ func (store *licenseStore) GetLicenseByID(id string) (*License, error) {
 	return license, nil
 }
 
-func (store *licenseStore) GetLicenseByStripeID(stripeID string) (*License, error) {
+func (store *licenseStore) GetLicenseByStripeID(ctx context.Context, stripeID string) (*License, error) {
+	ctx, cancel := withTimeout(ctx, store.timeout)
+	defer cancel()
+
 	license := new(License)
-	err := store.db.Model(license).Where("stripe_id = ?", stripeID).Select()
+	err := store.db.ModelContext(ctx, license).Where("stripe_id = ?", stripeID).Select()
 	if err != nil {
 		if err == pg.ErrNoRows {
 			return nil, nil
@@ -56,14 +79,52 @@ func (store *licenseStore) GetLicenseByStripeID(stripeID string) (*License, erro
 	return license, nil
 }
 
-func (store *licenseStore) UpdateLicense(license *License) error {
-	_, err := store.db.Model(license).Where("id = ?", license.ID).Update(license)
+// UpdateLicense writes columns of license. Only the columns the caller owns
+// are written, so concurrent changes to the others aren't undone.
+func (store *licenseStore) UpdateLicense(ctx context.Context, license *License, columns ...string) error {
+	ctx, cancel := withTimeout(ctx, store.timeout)
+	defer cancel()
+
+	_, err := store.db.ModelContext(ctx, license).Column(columns...).Where("id = ?", license.ID).Update()
+	return err
+}
+
+// AddUsage adds n classified images to the request count and period usage of
+// license in one statement, so concurrent requests don't lose each other's
+// usage. license is updated with the new counts.
+func (store *licenseStore) AddUsage(ctx context.Context, license *License, n int) error {
+	ctx, cancel := withTimeout(ctx, store.timeout)
+	defer cancel()
+
+	_, err := store.db.ModelContext(ctx, license).
+		Set("request_count = coalesce(request_count, 0) + ?", n).
+		Set("period_usage = coalesce(period_usage, 0) + ?", n).
+		Where("id = ?", license.ID).
+		Returning("request_count, period_usage").
+		Update()
 	return err
 }
 
-func (store *licenseStore) GetLicenseByEmail(email string) (*License, error) {
+// StartBillingPeriod writes the billing period of license, resetting its
+// usage, unless another request already moved it to that period.
+func (store *licenseStore) StartBillingPeriod(ctx context.Context, license *License) error {
+	ctx, cancel := withTimeout(ctx, store.timeout)
+	defer cancel()
+
+	_, err := store.db.ModelContext(ctx, license).
+		Column("period_start", "period_end", "period_usage", "soft_cap_notified").
+		Where("id = ?", license.ID).
+		Where("period_start IS DISTINCT FROM ? OR period_end IS DISTINCT FROM ?", license.PeriodStart, license.PeriodEnd).
+		Update()
+	return err
+}
+
+func (store *licenseStore) GetLicenseByEmail(ctx context.Context, email string) (*License, error) {
+	ctx, cancel := withTimeout(ctx, store.timeout)
+	defer cancel()
+
 	license := new(License)
-	err := store.db.Model(license).Where("email = ?", email).Select()
+	err := store.db.ModelContext(ctx, license).Where("email = ?", email).Select()
 	if err != nil {
 		if err == pg.ErrNoRows {
 			return nil, nil
@@ -73,10 +134,10 @@ func (store *licenseStore) GetLicenseByEmail(email string) (*License, error) {
 	return license, nil
 }
 
-func (store *licenseStore) ExpireTrial(license *License) (*License, error) {
+func (store *licenseStore) ExpireTrial(ctx context.Context, license *License) (*License, error) {
 	license.IsValid = false
 	license.ValidityReason = "trial license has expired"
-	if err := store.UpdateLicense(license); err != nil {
+	if err := store.UpdateLicense(ctx, license, "is_valid", "validity_reason"); err != nil {
 		return license, err
 	}
 	return license, nil
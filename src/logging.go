@@ -0,0 +1,112 @@
+package src
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIDHeader carries the ID that ties a request to its log lines. It is
+// taken from the request if the caller set one and always echoed back.
+const RequestIDHeader = "X-Request-ID"
+
+const (
+	loggerCtxKey       contextKey = "logger"
+	requestStatsCtxKey contextKey = "requestStats"
+)
+
+// validRequestID limits caller supplied request IDs to characters that are
+// safe to log.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// newLogger returns the application logger writing to out in the given
+// format, "json" or "console".
+func newLogger(format string, out io.Writer) (zerolog.Logger, error) {
+	switch format {
+	case "json":
+		return zerolog.New(out).With().Timestamp().Logger(), nil
+	case "console":
+		return zerolog.New(zerolog.ConsoleWriter{Out: out, NoColor: true}).With().Timestamp().Logger(), nil
+	}
+	return zerolog.Logger{}, fmt.Errorf("unsupported log format %q", format)
+}
+
+// loggerFromContext returns the request logger set by requestLoggingMiddleware,
+// or fallback outside of a request.
+func loggerFromContext(c context.Context, fallback zerolog.Logger) zerolog.Logger {
+	if logger, ok := c.Value(loggerCtxKey).(zerolog.Logger); ok {
+		return logger
+	}
+	return fallback
+}
+
+// requestStats are the per request counters reported in the access log.
+type requestStats struct {
+	Images    int
+	CacheHits int
+}
+
+// statsFromContext returns the stats of the current request, or nil outside
+// of a request.
+func statsFromContext(c context.Context) *requestStats {
+	stats, _ := c.Value(requestStatsCtxKey).(*requestStats)
+	return stats
+}
+
+// requestLoggingMiddleware assigns each request an ID, puts a logger tagged
+// with it in the request context and writes one access log line per request.
+func requestLoggingMiddleware(ctx appContext) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			requestID := r.Header.Get(RequestIDHeader)
+			if !validRequestID.MatchString(requestID) {
+				requestID = uuid.New().String()
+			}
+			w.Header().Set(RequestIDHeader, requestID)
+
+			logCtx := ctx.logger.With().Str("request_id", requestID)
+			if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+				logCtx = logCtx.Str("trace_id", sc.TraceID().String())
+			}
+			logger := logCtx.Logger()
+
+			stats := &requestStats{}
+			c := context.WithValue(r.Context(), loggerCtxKey, logger)
+			c = context.WithValue(c, requestStatsCtxKey, stats)
+
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r.WithContext(c))
+
+			logger.Info().
+				Str("method", r.Method).
+				Str("route", routeTemplate(r, r.URL.Path)).
+				Int("status", rec.status).
+				Str("license_id", redactLicenseID(r.Header.Get("LicenseID"))).
+				Int("images", stats.Images).
+				Int("cache_hits", stats.CacheHits).
+				Dur("duration", time.Since(start)).
+				Msg("request")
+		})
+	}
+}
+
+// redactLicenseID keeps enough of a license ID to correlate log lines
+// without leaking a usable key.
+func redactLicenseID(id string) string {
+	if id == "" {
+		return ""
+	}
+	if len(id) <= 8 {
+		return "****"
+	}
+	return id[:8] + "-****"
+}
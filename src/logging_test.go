@@ -0,0 +1,131 @@
+package src
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestRequestLogging(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := newLogger("json", &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := appContext{
+		logger:       logger,
+		licenseStore: newFakeLicenseStore(&License{ID: testLicenseID, IsValid: false}),
+		rateLimiter:  NewMemoryRateLimitStore(),
+		config:       Config{IPRateLimit: RateLimit{Rate: 1, Burst: 100}},
+	}
+	router := newRouter(ctx)
+
+	// accessLog returns the access log line of the last request.
+	accessLog := func(t *testing.T) map[string]interface{} {
+		t.Helper()
+		var entry map[string]interface{}
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		for _, line := range lines {
+			var e map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatalf("expected JSON log line but got %q", line)
+			}
+			if e["message"] == "request" {
+				entry = e
+			}
+		}
+		if entry == nil {
+			t.Fatal("expected an access log line")
+		}
+		return entry
+	}
+
+	t.Run("honors the caller's request ID", func(t *testing.T) {
+		out.Reset()
+		req := httptest.NewRequest("GET", "/v1/health", nil)
+		req.Header.Set(RequestIDHeader, "abc-123")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if got := w.Header().Get(RequestIDHeader); got != "abc-123" {
+			t.Errorf("expected request ID abc-123 but got %q", got)
+		}
+		if got := accessLog(t)["request_id"]; got != "abc-123" {
+			t.Errorf("expected logged request ID abc-123 but got %v", got)
+		}
+	})
+
+	t.Run("replaces missing and unsafe request IDs", func(t *testing.T) {
+		for _, id := range []string{"", "bad id\nwith newline"} {
+			req := httptest.NewRequest("GET", "/v1/health", nil)
+			req.Header.Set(RequestIDHeader, id)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if _, err := uuid.Parse(w.Header().Get(RequestIDHeader)); err != nil {
+				t.Errorf("expected a generated request ID for %q but got %q", id, w.Header().Get(RequestIDHeader))
+			}
+		}
+	})
+
+	t.Run("logs one access line with a redacted license", func(t *testing.T) {
+		out.Reset()
+		req := httptest.NewRequest("POST", "/v1/filter/batch", strings.NewReader(`{"imgURIList": []}`))
+		req.Header.Set("LicenseID", testLicenseID)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+
+		if n := strings.Count(out.String(), `"message":"request"`); n != 1 {
+			t.Fatalf("expected 1 access log line but got %d", n)
+		}
+		entry := accessLog(t)
+		if entry["route"] != "/v1/filter/batch" {
+			t.Errorf("expected route template but got %v", entry["route"])
+		}
+		if entry["status"] != float64(401) {
+			t.Errorf("expected status 401 but got %v", entry["status"])
+		}
+		if entry["license_id"] != redactLicenseID(testLicenseID) {
+			t.Errorf("expected redacted license ID but got %v", entry["license_id"])
+		}
+		if strings.Contains(out.String(), testLicenseID) {
+			t.Error("expected the full license ID to be kept out of the logs")
+		}
+		for _, field := range []string{"images", "cache_hits", "duration"} {
+			if _, ok := entry[field]; !ok {
+				t.Errorf("expected access log field %s", field)
+			}
+		}
+	})
+
+	t.Run("logs requests that match no route", func(t *testing.T) {
+		for method, status := range map[string]float64{"GET": 404, "DELETE": 405} {
+			out.Reset()
+			path := "/v1/nope"
+			if method == "DELETE" {
+				path = "/v1/health"
+			}
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, path, nil))
+
+			if n := strings.Count(out.String(), `"message":"request"`); n != 1 {
+				t.Fatalf("expected 1 access log line for %s %s but got %d", method, path, n)
+			}
+			if got := accessLog(t)["status"]; got != status {
+				t.Errorf("expected status %v for %s %s but got %v", status, method, path, got)
+			}
+		}
+	})
+
+	t.Run("redacts license IDs in handler logs", func(t *testing.T) {
+		out.Reset()
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/license/"+testLicenseID, nil))
+
+		if !strings.Contains(out.String(), redactLicenseID(testLicenseID)) || strings.Contains(out.String(), testLicenseID) {
+			t.Errorf("expected only the redacted license ID in the logs but got %s", out.String())
+		}
+	})
+}
@@ -0,0 +1,149 @@
+package src
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// annotationLRU is a bounded in-process cache of annotations by URI, in
+// front of the image_annotations table. Entries are dropped after the TTL so
+// changes made by other instances are picked up.
+type annotationLRU struct {
+	size int
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu      sync.Mutex
+	order   *list.List // Most recently used first.
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	anno     ImageAnnotation
+	storedAt time.Time
+}
+
+// newAnnotationLRU returns a cache of up to size annotations, or nil, which
+// caches nothing, if size is 0.
+func newAnnotationLRU(size int, ttl time.Duration) *annotationLRU {
+	if size <= 0 {
+		return nil
+	}
+	return &annotationLRU{
+		size:    size,
+		ttl:     ttl,
+		now:     time.Now,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// GetAll returns copies of the cached annotations of uris and the URIs that
+// aren't cached.
+func (lru *annotationLRU) GetAll(uris []string) ([]*ImageAnnotation, []string) {
+	if lru == nil {
+		return nil, uris
+	}
+
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	var found []*ImageAnnotation
+	missing := make([]string, 0, len(uris))
+	now := lru.now()
+	for _, uri := range uris {
+		el, ok := lru.entries[uri]
+		if ok && lru.ttl > 0 && now.Sub(el.Value.(*lruEntry).storedAt) >= lru.ttl {
+			lru.remove(el)
+			ok = false
+		}
+		if !ok {
+			missing = append(missing, uri)
+			continue
+		}
+		lru.order.MoveToFront(el)
+		anno := el.Value.(*lruEntry).anno
+		found = append(found, &anno)
+	}
+
+	annotationLRULookupsTotal.WithLabelValues("hit").Add(float64(len(found)))
+	annotationLRULookupsTotal.WithLabelValues("miss").Add(float64(len(missing)))
+	return found, missing
+}
+
+// AddAll caches copies of annos, replacing earlier annotations of the same
+// URIs and evicting the least recently used ones over the size.
+func (lru *annotationLRU) AddAll(annos []*ImageAnnotation) {
+	if lru == nil {
+		return
+	}
+
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	now := lru.now()
+	for _, anno := range annos {
+		entry := &lruEntry{anno: *anno, storedAt: now}
+		if el, ok := lru.entries[anno.URI]; ok {
+			el.Value = entry
+			lru.order.MoveToFront(el)
+			continue
+		}
+		lru.entries[anno.URI] = lru.order.PushFront(entry)
+	}
+
+	for lru.order.Len() > lru.size {
+		lru.remove(lru.order.Back())
+		annotationLRUEvictionsTotal.Inc()
+	}
+	annotationLRUEntries.Set(float64(lru.order.Len()))
+}
+
+// Invalidate drops the annotations of uris, such as when they are deleted or
+// overridden.
+func (lru *annotationLRU) Invalidate(uris ...string) {
+	if lru == nil {
+		return
+	}
+
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	for _, uri := range uris {
+		if el, ok := lru.entries[uri]; ok {
+			lru.remove(el)
+		}
+	}
+	annotationLRUEntries.Set(float64(lru.order.Len()))
+}
+
+// Purge drops every cached annotation.
+func (lru *annotationLRU) Purge() {
+	if lru == nil {
+		return
+	}
+
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.order.Init()
+	lru.entries = make(map[string]*list.Element)
+	annotationLRUEntries.Set(0)
+}
+
+// Len returns how many annotations are cached.
+func (lru *annotationLRU) Len() int {
+	if lru == nil {
+		return 0
+	}
+
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	return lru.order.Len()
+}
+
+func (lru *annotationLRU) remove(el *list.Element) {
+	lru.order.Remove(el)
+	delete(lru.entries, el.Value.(*lruEntry).anno.URI)
+}
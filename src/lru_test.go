@@ -0,0 +1,86 @@
+package src
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAnnotationLRU(t *testing.T) {
+	annos := func(uris ...string) []*ImageAnnotation {
+		res := make([]*ImageAnnotation, len(uris))
+		for i, uri := range uris {
+			res[i] = &ImageAnnotation{URI: uri, Hash: Hash(uri)}
+		}
+		return res
+	}
+
+	t.Run("evicts the least recently used", func(t *testing.T) {
+		lru := newAnnotationLRU(2, time.Minute)
+		lru.AddAll(annos("a", "b"))
+		lru.GetAll([]string{"a"})
+		lru.AddAll(annos("c"))
+
+		found, missing := lru.GetAll([]string{"a", "b", "c"})
+		if len(found) != 2 || len(missing) != 1 || missing[0] != "b" {
+			t.Fatalf("expected b to be evicted but got %d found and %v missing", len(found), missing)
+		}
+	})
+
+	t.Run("expires entries after the TTL", func(t *testing.T) {
+		now := time.Now()
+		lru := newAnnotationLRU(10, time.Minute)
+		lru.now = func() time.Time { return now }
+		lru.AddAll(annos("a"))
+
+		now = now.Add(time.Minute)
+		if found, _ := lru.GetAll([]string{"a"}); len(found) != 0 {
+			t.Fatal("expected the entry to have expired")
+		}
+		if len(lru.entries) != 0 {
+			t.Fatal("expected the expired entry to be dropped")
+		}
+	})
+
+	t.Run("replaces and invalidates entries", func(t *testing.T) {
+		lru := newAnnotationLRU(10, time.Minute)
+		lru.AddAll(annos("a", "b"))
+		lru.AddAll([]*ImageAnnotation{{URI: "a", Adult: 5}})
+
+		found, _ := lru.GetAll([]string{"a"})
+		if len(found) != 1 || found[0].Adult != 5 {
+			t.Fatalf("expected the replaced annotation but got %+v", found)
+		}
+
+		lru.Invalidate("a")
+		if _, missing := lru.GetAll([]string{"a", "b"}); len(missing) != 1 || missing[0] != "a" {
+			t.Fatalf("expected a to be invalidated but got %v missing", missing)
+		}
+
+		lru.Purge()
+		if _, missing := lru.GetAll([]string{"b"}); len(missing) != 1 {
+			t.Fatal("expected the cache to be purged")
+		}
+	})
+
+	t.Run("returns copies", func(t *testing.T) {
+		lru := newAnnotationLRU(10, time.Minute)
+		added := annos("a")
+		lru.AddAll(added)
+		added[0].Adult = 5
+
+		found, _ := lru.GetAll([]string{"a"})
+		found[0].Racy = 5
+		again, _ := lru.GetAll([]string{"a"})
+		if again[0].Adult != 0 || again[0].Racy != 0 {
+			t.Fatalf("expected the cached annotation to be unchanged but got %+v", again[0])
+		}
+	})
+
+	t.Run("disabled without a size", func(t *testing.T) {
+		lru := newAnnotationLRU(0, time.Minute)
+		lru.AddAll(annos("a"))
+		if _, missing := lru.GetAll([]string{"a"}); len(missing) != 1 {
+			t.Fatal("expected a disabled cache to miss")
+		}
+	})
+}
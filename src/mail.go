@@ -44,3 +44,19 @@ func SendLicenseMail(config Config, emailTo string, licenseID string) error {
 
 	return nil
 }
+
+func SendSoftCapMail(config Config, emailTo string, usage int, softCap int) error {
+	email := Email{
+		Name:    emailTo,
+		To:      emailTo,
+		Subject: "Your Purity Vision usage is approaching its monthly cap",
+		Plain:   fmt.Sprintf("Your PurityVision license has filtered %d images this billing period, reaching your warning threshold of %d.\n", usage, softCap),
+		Html:    fmt.Sprintf("<h1>Your PurityVision Usage</h1><p>Your license has filtered %d images this billing period, reaching your warning threshold of %d.</p>", usage, softCap),
+	}
+
+	if err := SendMail(config, email); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+package src
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRegistry holds every metric exposed on /metrics.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequestsTotal = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "purity_http_requests_total",
+		Help: "HTTP requests by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	httpRequestDuration = promauto.With(metricsRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "purity_http_request_duration_seconds",
+		Help:    "HTTP request latency by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	filterCacheLookupsTotal = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "purity_filter_cache_lookups_total",
+		Help: "Images looked up in the annotation cache by result.",
+	}, []string{"result"})
+
+	annotationLRULookupsTotal = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "purity_annotation_lru_lookups_total",
+		Help: "Images looked up in the in-process annotation cache by result.",
+	}, []string{"result"})
+
+	annotationLRUEvictionsTotal = promauto.With(metricsRegistry).NewCounter(prometheus.CounterOpts{
+		Name: "purity_annotation_lru_evictions_total",
+		Help: "Annotations evicted from the in-process annotation cache to stay within its size.",
+	})
+
+	annotationLRUEntries = promauto.With(metricsRegistry).NewGauge(prometheus.GaugeOpts{
+		Name: "purity_annotation_lru_entries",
+		Help: "Annotations held in the in-process annotation cache.",
+	})
+
+	filterCoalescedTotal = promauto.With(metricsRegistry).NewCounter(prometheus.CounterOpts{
+		Name: "purity_filter_coalesced_total",
+		Help: "Uncached images served from another request's classification of the same image.",
+	})
+
+	filterRuleMatchesTotal = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "purity_filter_rule_matches_total",
+		Help: "Images settled by a license rule without classification, by action.",
+	}, []string{"action"})
+
+	misclassificationReportsTotal = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "purity_misclassification_reports_total",
+		Help: "Images reported as misclassified by the verdict clients expected.",
+	}, []string{"expected_verdict"})
+
+	cacheRevalidationsTotal = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "purity_cache_revalidations_total",
+		Help: "Stale annotations revalidated in the background by result.",
+	}, []string{"result"})
+
+	classifierBatchDuration = promauto.With(metricsRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "purity_classifier_batch_duration_seconds",
+		Help:    "Latency of classifier batch requests.",
+		Buckets: []float64{.1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"provider"})
+
+	classifierErrorsTotal = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "purity_classifier_errors_total",
+		Help: "Failed classifier batch requests.",
+	}, []string{"provider"})
+
+	classifierCircuitOpen = promauto.With(metricsRegistry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: "purity_classifier_circuit_open",
+		Help: "Whether the classifier circuit breaker is open (1) or not (0).",
+	}, []string{"provider"})
+
+	filterDegradedTotal = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "purity_filter_degraded_total",
+		Help: "Images settled by the degraded policy while the classifier was unavailable.",
+	}, []string{"policy"})
+
+	licenseRejectionsTotal = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "purity_license_rejections_total",
+		Help: "Requests rejected by the paywall by reason.",
+	}, []string{"reason"})
+
+	webhookEventsTotal = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "purity_webhook_events_total",
+		Help: "Stripe webhook events by type and outcome.",
+	}, []string{"type", "outcome"})
+
+	stripeErrorsTotal = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "purity_stripe_errors_total",
+		Help: "Failed Stripe API calls by operation.",
+	}, []string{"operation"})
+
+	dbQueryDuration = promauto.With(metricsRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "purity_db_query_duration_seconds",
+		Help:    "Postgres query latency by operation.",
+		Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"operation", "status"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// metricsHandler serves the metrics in the Prometheus text format.
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// newMetricsServer returns the server of /metrics. It listens apart from the
+// API so internal metrics aren't exposed with it.
+func newMetricsServer(config Config) *http.Server {
+	r := mux.NewRouter()
+	r.Handle("/metrics", metricsHandler()).Methods("GET")
+	return &http.Server{
+		Addr:              config.MetricsAddr,
+		Handler:           r,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+	}
+}
+
+// metricsMiddleware counts requests and observes their latency by route
+// template, so path parameters don't blow up label cardinality.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r, "unknown")
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		httpRequestsTotal.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+		httpRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// metricsHook observes the duration of every database query.
+type metricsHook struct{}
+
+func (metricsHook) BeforeQuery(ctx context.Context, evt *pg.QueryEvent) (context.Context, error) {
+	return ctx, nil
+}
+
+func (metricsHook) AfterQuery(ctx context.Context, evt *pg.QueryEvent) error {
+	status := "ok"
+	if evt.Err != nil && evt.Err != pg.ErrNoRows {
+		status = "error"
+	}
+	dbQueryDuration.WithLabelValues(queryOperation(evt), status).Observe(time.Since(evt.StartTime).Seconds())
+	return nil
+}
+
+// queryOperation returns the SQL verb of the query, such as "select".
+func queryOperation(evt *pg.QueryEvent) string {
+	q, err := evt.UnformattedQuery()
+	if err != nil {
+		return "other"
+	}
+
+	fields := strings.Fields(string(q))
+	if len(fields) == 0 {
+		return "other"
+	}
+
+	switch op := strings.ToLower(fields[0]); op {
+	case "select", "insert", "update", "delete":
+		return op
+	}
+	return "other"
+}
@@ -0,0 +1,83 @@
+package src
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+)
+
+func TestMetrics(t *testing.T) {
+	ctx := appContext{
+		logger:       zerolog.Nop(),
+		licenseStore: newFakeLicenseStore(&License{ID: testLicenseID, IsValid: false}),
+		rateLimiter:  NewMemoryRateLimitStore(),
+		config:       Config{IPRateLimit: RateLimit{Rate: 1, Burst: 100}},
+	}
+	router := newRouter(ctx)
+
+	t.Run("counts requests by route template", func(t *testing.T) {
+		counter := httpRequestsTotal.WithLabelValues("/v1/license/{id}", "GET", "200")
+		before := testutil.ToFloat64(counter)
+
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/license/"+testLicenseID, nil))
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/license/"+testLicenseID, nil))
+
+		if got := testutil.ToFloat64(counter) - before; got != 2 {
+			t.Errorf("expected 2 requests counted but got %v", got)
+		}
+	})
+
+	t.Run("counts license rejections by reason", func(t *testing.T) {
+		expired := licenseRejectionsTotal.WithLabelValues(codeLicenseExpired)
+		invalid := licenseRejectionsTotal.WithLabelValues(codeInvalidLicense)
+		expiredBefore, invalidBefore := testutil.ToFloat64(expired), testutil.ToFloat64(invalid)
+
+		req := httptest.NewRequest("POST", "/v1/filter/batch", strings.NewReader(`{"imgURIList": []}`))
+		req.Header.Set("LicenseID", testLicenseID)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+
+		req = httptest.NewRequest("POST", "/v1/filter/batch", strings.NewReader(`{"imgURIList": []}`))
+		req.Header.Set("LicenseID", "not a uuid")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+
+		if got := testutil.ToFloat64(expired) - expiredBefore; got != 1 {
+			t.Errorf("expected 1 expired rejection but got %v", got)
+		}
+		if got := testutil.ToFloat64(invalid) - invalidBefore; got != 1 {
+			t.Errorf("expected 1 invalid rejection but got %v", got)
+		}
+	})
+
+	t.Run("counts webhook events by outcome", func(t *testing.T) {
+		counter := webhookEventsTotal.WithLabelValues("unknown", "error")
+		before := testutil.ToFloat64(counter)
+
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/webhook", strings.NewReader(`{}`)))
+
+		if got := testutil.ToFloat64(counter) - before; got != 1 {
+			t.Errorf("expected 1 failed webhook event but got %v", got)
+		}
+	})
+
+	t.Run("serves metrics apart from the API", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		newMetricsServer(Config{MetricsAddr: ":9091"}).Handler.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected 200 but got %d", rr.Code)
+		}
+		if !strings.Contains(rr.Body.String(), "purity_http_requests_total") {
+			t.Error("expected request counter in metrics output")
+		}
+
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+		if rr.Code != http.StatusNotFound {
+			t.Fatalf("expected metrics to be off the API port but got %d", rr.Code)
+		}
+	})
+}
@@ -1,23 +1,36 @@
 package src
 
 import (
-	"errors"
+	"context"
+	"fmt"
 	"net/http"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 )
 
+type contextKey string
+
+const licenseCtxKey contextKey = "license"
+
+// licenseFromContext returns the license set on the request context by
+// paywallMiddleware, or nil if there is none.
+func licenseFromContext(ctx context.Context) *License {
+	license, _ := ctx.Value(licenseCtxKey).(*License)
+	return license
+}
+
 func getLicenseFromReq(ls LicenseStorer, r *http.Request) (*License, error) {
 	licenseID := r.Header.Get("LicenseID")
 
 	_, err := uuid.Parse(licenseID)
 	if err != nil {
-		return nil, errors.New("invalid license ID")
+		return nil, newAppError(codeInvalidLicense, "invalid license ID")
 	}
 
-	license, err := ls.GetLicenseByID(licenseID)
+	license, err := ls.GetLicenseByID(r.Context(), licenseID)
 	if err != nil || license == nil {
-		return nil, errors.New("invalid license")
+		return nil, &AppError{Code: codeInvalidLicense, Message: "invalid license", Err: err}
 	}
 
 	return license, nil
@@ -28,8 +41,10 @@ func paywallMiddleware(ctx appContext) func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			license, err := getLicenseFromReq(ctx.licenseStore, r)
 			if err != nil {
-				ctx.logger.Info().Msgf("failed to get license: %v", err)
-				http.Error(w, err.Error(), http.StatusUnauthorized)
+				logger := loggerFromContext(r.Context(), ctx.logger)
+				logger.Info().Msgf("failed to get license: %v", err)
+				licenseRejectionsTotal.WithLabelValues(toAppError(http.StatusUnauthorized, err).Code).Inc()
+				writeError(w, r, http.StatusUnauthorized, err)
 				return
 			}
 
@@ -48,15 +63,61 @@ func paywallMiddleware(ctx appContext) func(next http.Handler) http.Handler {
 			// }
 
 			if !license.IsValid {
-				http.Error(w, "Expired license", http.StatusUnauthorized)
+				appErr := newAppError(codeLicenseExpired, "expired license")
+				if license.ValidityReason != "" {
+					appErr = appErr.WithDetails("reason", license.ValidityReason)
+				}
+				licenseRejectionsTotal.WithLabelValues(appErr.Code).Inc()
+				writeError(w, r, http.StatusUnauthorized, appErr)
 				return
 			}
 
-			next.ServeHTTP(w, r)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), licenseCtxKey, license)))
 		})
 	}
 }
 
+// deprecatedMiddleware marks responses from unversioned routes as deprecated
+// in favor of their /v1 equivalents.
+func deprecatedMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("</v1%s>; rel=\"successor-version\"", r.URL.Path))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// routeTemplate returns the path template of the route matching r, such as
+// "/v1/license/{id}", or fallback if no route matched.
+func routeTemplate(r *http.Request, fallback string) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if tmpl, err := current.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return fallback
+}
+
+// statusRecorder records the status code written by the wrapped handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	if !rec.wroteHeader {
+		rec.status = code
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	return rec.ResponseWriter.Write(b)
+}
+
 var addCorsHeaders = func(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		allowedHeaders := "Accept, Content-Type, Content-Length, Accept-Encoding, Authorization, X-CSRF-Token, licenseID"
@@ -64,7 +125,7 @@ var addCorsHeaders = func(next http.Handler) http.Handler {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
 		w.Header().Set("Access-Control-Allow-Headers", allowedHeaders)
-		w.Header().Set("Access-Control-Expose-Headers", "Authorization")
+		w.Header().Set("Access-Control-Expose-Headers", "Authorization, X-Request-ID, X-Purity-Degraded, X-Spending-Cap, X-Spending-Cap-Usage, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Retry-After")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
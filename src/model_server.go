@@ -0,0 +1,207 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+const (
+	// modelServerMaxImageBytes is the largest image sent to the model server.
+	modelServerMaxImageBytes = 10 << 20
+	// modelServerFetchConcurrency bounds the images of a batch downloaded at once.
+	modelServerFetchConcurrency = 8
+)
+
+// ModelServerReq is the body posted to a self-hosted model server. Images
+// are the raw image bytes, base64 encoded in JSON.
+type ModelServerReq struct {
+	Images [][]byte `json:"images"`
+}
+
+// ModelServerRes is the response of a self-hosted model server, with one
+// result per posted image in the same order.
+type ModelServerRes struct {
+	Results      []ModelServerResult `json:"results"`
+	ModelVersion string              `json:"model_version,omitempty"`
+}
+
+// ModelServerResult holds the probability, from 0 to 1, of each category
+// the model rates. Categories left out are unknown.
+type ModelServerResult struct {
+	Adult    *float64 `json:"adult,omitempty"`
+	Spoof    *float64 `json:"spoof,omitempty"`
+	Medical  *float64 `json:"medical,omitempty"`
+	Violence *float64 `json:"violence,omitempty"`
+	Racy     *float64 `json:"racy,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	// ErrorKind is "unsupported_format" for images the model can't decode.
+	// Other errors are provider errors.
+	ErrorKind string `json:"error_kind,omitempty"`
+}
+
+// modelServerClassifier classifies images with a self-hosted inference
+// server, so images never leave the customer's network. The images are
+// downloaded and their bytes posted to the server, which returns the
+// probability of each category; these are calibrated onto the likelihood
+// scale with per-category thresholds.
+type modelServerClassifier struct {
+	url         string
+	client      *http.Client
+	fetchClient *http.Client
+	thresholds  map[string]likelihoodThresholds
+}
+
+func NewModelServerClassifier(config Config) (*modelServerClassifier, error) {
+	if config.ModelServerURL == "" {
+		return nil, missingEnvErr("PURITY_MODEL_SERVER_URL")
+	}
+	return &modelServerClassifier{
+		url:         config.ModelServerURL,
+		client:      &http.Client{Timeout: config.ClassifierTimeout},
+		fetchClient: newImageFetchClient(config.ClassifierTimeout, config.ImageFetchAllowPrivate),
+		thresholds:  config.ModelServerThresholds,
+	}, nil
+}
+
+func (mc *modelServerClassifier) Classify(ctx context.Context, uris []string) ([]Classification, error) {
+	res := make([]Classification, len(uris))
+	images, validators, err := mc.fetchImages(ctx, uris, res)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the images that could be fetched are posted, in order.
+	var posted []int
+	var req ModelServerReq
+	for i, img := range images {
+		if img != nil {
+			posted = append(posted, i)
+			req.Images = append(req.Images, img)
+		}
+	}
+	if len(posted) == 0 {
+		return res, nil
+	}
+
+	msRes, err := mc.post(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(msRes.Results) != len(posted) {
+		return nil, fmt.Errorf("model server returned %d results for %d images", len(msRes.Results), len(posted))
+	}
+
+	for j, i := range posted {
+		result := msRes.Results[j]
+		res[i] = Classification{
+			Adult:    mc.likelihood("adult", result.Adult),
+			Spoof:    mc.likelihood("spoof", result.Spoof),
+			Medical:  mc.likelihood("medical", result.Medical),
+			Violence: mc.likelihood("violence", result.Violence),
+			Racy:     mc.likelihood("racy", result.Racy),
+			Error:    result.Error,
+
+			ErrorKind:    modelServerErrorKind(result),
+			ModelVersion: msRes.ModelVersion,
+			Validators:   validators[i],
+		}
+	}
+	return res, nil
+}
+
+// fetchImages downloads the images of uris. Images that can't be fetched
+// are left nil, with the reason set on their classification in res.
+func (mc *modelServerClassifier) fetchImages(ctx context.Context, uris []string, res []Classification) ([][]byte, []imageValidators, error) {
+	images := make([][]byte, len(uris))
+	validators := make([]imageValidators, len(uris))
+
+	sem := make(chan struct{}, modelServerFetchConcurrency)
+	var wg sync.WaitGroup
+	for i, uri := range uris {
+		wg.Add(1)
+		go func(i int, uri string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			img, v, err := fetchImage(ctx, mc.fetchClient, uri, modelServerMaxImageBytes)
+			if err != nil {
+				res[i].Error = fmt.Sprintf("failed to fetch image: %v", err)
+				res[i].ErrorKind = errorKindFetchFailed
+				return
+			}
+			images[i], validators[i] = img, v
+		}(i, uri)
+	}
+	wg.Wait()
+
+	return images, validators, ctx.Err()
+}
+
+func (mc *modelServerClassifier) post(ctx context.Context, msReq ModelServerReq) (*ModelServerRes, error) {
+	body, err := json.Marshal(msReq)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, mc.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := mc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return nil, fmt.Errorf("model server returned %s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+
+	var msRes ModelServerRes
+	if err := json.NewDecoder(res.Body).Decode(&msRes); err != nil {
+		return nil, fmt.Errorf("failed to decode model server response: %v", err)
+	}
+	return &msRes, nil
+}
+
+func modelServerErrorKind(result ModelServerResult) string {
+	switch {
+	case result.Error == "":
+		return ""
+	case result.ErrorKind == errorKindUnsupportedFormat:
+		return errorKindUnsupportedFormat
+	}
+	return errorKindProviderError
+}
+
+// likelihood maps the probability of category onto the likelihood scale, or
+// unknown if the model didn't rate the category.
+func (mc *modelServerClassifier) likelihood(category string, p *float64) int16 {
+	if p == nil {
+		return int16(pb.Likelihood_UNKNOWN)
+	}
+	thresholds, found := mc.thresholds[category]
+	if !found {
+		thresholds = defaultLikelihoodThresholds
+	}
+	return thresholds.likelihood(*p)
+}
+
+func (mc *modelServerClassifier) Check(ctx context.Context) error { return nil }
+
+func (mc *modelServerClassifier) Close() error {
+	mc.client.CloseIdleConnections()
+	mc.fetchClient.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,144 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+// newStubImageServer serves images by path, and 404 for any other path.
+func newStubImageServer(t *testing.T, images map[string][]byte) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		img, found := images[r.URL.Path]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(img)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newStubModelServer stands in for a local inference server. It rates images
+// containing "nsfw" as adult and racy, rates everything else as safe, and
+// leaves medical and spoof unrated.
+func newStubModelServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ModelServerReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var res ModelServerRes
+		for _, img := range req.Images {
+			p := 0.05
+			if bytes.Contains(img, []byte("nsfw")) {
+				p = 0.95
+			}
+			res.Results = append(res.Results, ModelServerResult{Adult: &p, Racy: &p, Violence: &p})
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestModelServerClassifier(t *testing.T) {
+	images := newStubImageServer(t, map[string][]byte{
+		"/safe.jpg": []byte("a landscape"),
+		"/nsfw.jpg": []byte("something nsfw"),
+	})
+	uris := []string{images.URL + "/safe.jpg", images.URL + "/missing.jpg", images.URL + "/nsfw.jpg"}
+	config := Config{
+		ModelServerURL:         newStubModelServer(t).URL,
+		ClassifierTimeout:      time.Second,
+		ImageFetchAllowPrivate: true,
+	}
+
+	t.Run("classifies image bytes", func(t *testing.T) {
+		mc, err := NewModelServerClassifier(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer mc.Close()
+
+		res, err := mc.Classify(context.Background(), uris)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res[0].Adult != int16(pb.Likelihood_VERY_UNLIKELY) || res[0].Medical != int16(pb.Likelihood_UNKNOWN) {
+			t.Errorf("expected very unlikely adult and unknown medical but got %+v", res[0])
+		}
+		if res[1].Error == "" {
+			t.Error("expected an error for the missing image")
+		}
+		if res[2].Adult != int16(pb.Likelihood_VERY_LIKELY) || res[2].Error != "" {
+			t.Errorf("expected very likely adult but got %+v", res[2])
+		}
+	})
+
+	t.Run("calibrates each category", func(t *testing.T) {
+		config := config
+		config.ModelServerThresholds = map[string]likelihoodThresholds{"racy": {0.96, 0.97, 0.98, 0.99}}
+		mc, err := NewModelServerClassifier(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer mc.Close()
+
+		res, err := mc.Classify(context.Background(), uris[2:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res[0].Racy != int16(pb.Likelihood_VERY_UNLIKELY) || res[0].Adult != int16(pb.Likelihood_VERY_LIKELY) {
+			t.Errorf("expected very unlikely racy and very likely adult but got %+v", res[0])
+		}
+	})
+
+	t.Run("fails the batch on server errors", func(t *testing.T) {
+		failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "model not loaded", http.StatusServiceUnavailable)
+		}))
+		defer failing.Close()
+
+		config := config
+		config.ModelServerURL = failing.URL
+		mc, err := NewModelServerClassifier(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mc.Classify(context.Background(), uris); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
+
+func TestGetEnvThresholds(t *testing.T) {
+	tests := []struct {
+		val   string
+		valid bool
+	}{
+		{"0.1,0.3,0.5,0.9", true},
+		{"0.1, 0.1, 0.5, 1", true},
+		{"0.1,0.3,0.5", false},
+		{"0.5,0.3,0.6,0.9", false},
+		{"0.1,0.3,0.5,1.5", false},
+		{"low,0.3,0.5,0.9", false},
+	}
+	for _, test := range tests {
+		t.Setenv("PURITY_TEST_THRESHOLDS", test.val)
+		_, err := getEnvThresholdsWithDefault("PURITY_TEST_THRESHOLDS", defaultLikelihoodThresholds)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: expected valid %t but got %v", test.val, test.valid, err)
+		}
+	}
+}
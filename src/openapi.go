@@ -0,0 +1,21 @@
+package src
+
+import (
+	_ "embed"
+	"fmt"
+	"net/http"
+)
+
+// openapiSpec is the OpenAPI 3 document for the /v1 API. It is maintained by
+// hand; the contract tests in openapi_test.go keep it in sync with the handlers.
+//
+//go:embed openapi.json
+var openapiSpec []byte
+
+func handleOpenAPI(ctx appContext, w http.ResponseWriter, req *http.Request) (int, error) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(openapiSpec); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to write response: %v", err)
+	}
+	return http.StatusOK, nil
+}
@@ -0,0 +1,257 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/rs/zerolog"
+)
+
+// fakeLicenseStore is an in memory LicenseStorer for tests that don't need
+// a database.
+type fakeLicenseStore struct {
+	licenses map[string]*License
+}
+
+func newFakeLicenseStore(licenses ...*License) *fakeLicenseStore {
+	store := &fakeLicenseStore{licenses: make(map[string]*License)}
+	for _, license := range licenses {
+		store.licenses[license.ID] = license
+	}
+	return store
+}
+
+func (store *fakeLicenseStore) GetLicenseByID(ctx context.Context, id string) (*License, error) {
+	if license, found := store.licenses[id]; found {
+		copied := *license
+		return &copied, nil
+	}
+	return nil, nil
+}
+
+func (store *fakeLicenseStore) GetLicenseByStripeID(ctx context.Context, id string) (*License, error) {
+	for _, license := range store.licenses {
+		if license.StripeID == id {
+			copied := *license
+			return &copied, nil
+		}
+	}
+	return nil, nil
+}
+
+func (store *fakeLicenseStore) GetLicenseByEmail(ctx context.Context, email string) (*License, error) {
+	for _, license := range store.licenses {
+		if license.Email == email {
+			copied := *license
+			return &copied, nil
+		}
+	}
+	return nil, nil
+}
+
+func (store *fakeLicenseStore) UpdateLicense(ctx context.Context, license *License, columns ...string) error {
+	copied := *license
+	store.licenses[license.ID] = &copied
+	return nil
+}
+
+func (store *fakeLicenseStore) AddUsage(ctx context.Context, license *License, n int) error {
+	stored, found := store.licenses[license.ID]
+	if !found {
+		return nil
+	}
+	stored.RequestCount += n
+	stored.PeriodUsage += n
+	license.RequestCount, license.PeriodUsage = stored.RequestCount, stored.PeriodUsage
+	return nil
+}
+
+func (store *fakeLicenseStore) StartBillingPeriod(ctx context.Context, license *License) error {
+	return store.UpdateLicense(ctx, license)
+}
+
+func (store *fakeLicenseStore) ExpireTrial(ctx context.Context, license *License) (*License, error) {
+	license.IsValid = false
+	license.ValidityReason = "trial license has expired"
+	return license, store.UpdateLicense(ctx, license, "is_valid", "validity_reason")
+}
+
+func TestOpenAPIContract(t *testing.T) {
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromData(openapiSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = doc.Validate(loader.Context); err != nil {
+		t.Fatalf("openapi.json is invalid: %v", err)
+	}
+
+	specRouter, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired := &License{ID: "0f1e3fa4-2b1c-4c51-a7e5-0c1f3b8f1c2a", IsValid: false, ValidityReason: "subscription was cancelled"}
+	valid := &License{ID: testLicenseID, Email: "test@email.com", IsValid: true, Plan: "standard", HardCap: 100}
+
+	ctx := appContext{
+		logger:       zerolog.Nop(),
+		licenseStore: newFakeLicenseStore(expired, valid),
+		ruleStore:    &fakeRuleStore{},
+		rateLimiter:  NewMemoryRateLimitStore(),
+		config:       Config{IPRateLimit: RateLimit{Rate: 1, Burst: 100}, AdminToken: "secret"},
+	}
+	router := newRouter(ctx)
+	admin := map[string]string{"Authorization": "Bearer secret"}
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		headers map[string]string
+		status  int
+	}{
+		{name: "health", method: "GET", path: "/v1/health", status: http.StatusOK},
+		{name: "openapi document", method: "GET", path: "/v1/openapi.json", status: http.StatusOK},
+		{name: "get license", method: "GET", path: "/v1/license/" + testLicenseID, status: http.StatusOK},
+		{name: "get missing license", method: "GET", path: "/v1/license/missing", status: http.StatusNotFound},
+		{name: "update caps", method: "PUT", path: "/v1/license/" + testLicenseID + "/caps", body: `{"softCap": 80, "hardCap": 100}`, headers: admin, status: http.StatusOK},
+		{name: "update caps with bad caps", method: "PUT", path: "/v1/license/" + testLicenseID + "/caps", body: `{"softCap": 200, "hardCap": 100}`, headers: admin, status: http.StatusBadRequest},
+		{name: "update caps of missing license", method: "PUT", path: "/v1/license/missing/caps", body: `{"softCap": 1}`, headers: admin, status: http.StatusNotFound},
+		{name: "update caps without the admin token", method: "PUT", path: "/v1/license/" + testLicenseID + "/caps", body: `{"hardCap": 1000}`, status: http.StatusUnauthorized},
+		{name: "add rule", method: "POST", path: "/v1/license/" + testLicenseID + "/rules", body: `{"pattern": "*.blocked.example", "action": "block"}`, status: http.StatusOK},
+		{name: "add bad rule", method: "POST", path: "/v1/license/" + testLicenseID + "/rules", body: `{"pattern": "cdn.example.com", "action": "maybe"}`, status: http.StatusBadRequest},
+		{name: "add rule to a missing license", method: "POST", path: "/v1/license/missing/rules", body: `{"pattern": "a.example", "action": "allow"}`, status: http.StatusNotFound},
+		{name: "get rules", method: "GET", path: "/v1/license/" + testLicenseID + "/rules", status: http.StatusOK},
+		{name: "filter by rule", method: "POST", path: "/v1/filter/batch", body: `{"imgURIList": ["https://img.blocked.example/a.jpg"]}`, headers: map[string]string{"LicenseID": testLicenseID}, status: http.StatusOK},
+		{name: "delete rule", method: "DELETE", path: "/v1/license/" + testLicenseID + "/rules/1", status: http.StatusNoContent},
+		{name: "filter without license", method: "POST", path: "/v1/filter/batch", body: `{"imgURIList": ["https://example.com/a.jpg"]}`, status: http.StatusUnauthorized},
+		{
+			name:    "filter with expired license",
+			method:  "POST",
+			path:    "/v1/filter/batch",
+			body:    `{"imgURIList": ["https://example.com/a.jpg"]}`,
+			headers: map[string]string{"LicenseID": expired.ID, "Accept": "application/problem+json"},
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name:    "filter empty list",
+			method:  "POST",
+			path:    "/v1/filter/batch",
+			body:    `{"imgURIList": []}`,
+			headers: map[string]string{"LicenseID": testLicenseID},
+			status:  http.StatusBadRequest,
+		},
+		{
+			name:    "filter invalid URIs",
+			method:  "POST",
+			path:    "/v1/filter/batch",
+			body:    `{"imgURIList": ["not a uri", "also not a uri"]}`,
+			headers: map[string]string{"LicenseID": testLicenseID},
+			status:  http.StatusOK,
+		},
+		{
+			name:    "report with a bad verdict",
+			method:  "POST",
+			path:    "/v1/filter/report",
+			body:    `{"uri": "https://example.com/a.jpg", "expectedVerdict": "maybe"}`,
+			headers: map[string]string{"LicenseID": testLicenseID},
+			status:  http.StatusBadRequest,
+		},
+		{
+			name:    "report without an image",
+			method:  "POST",
+			path:    "/v1/filter/report",
+			body:    `{"expectedVerdict": "allow"}`,
+			headers: map[string]string{"LicenseID": testLicenseID},
+			status:  http.StatusBadRequest,
+		},
+		{name: "webhook without signature", method: "POST", path: "/v1/webhook", body: `{}`, status: http.StatusBadRequest},
+		{name: "look up annotations without an image", method: "GET", path: "/v1/admin/cache/annotations", headers: admin, status: http.StatusBadRequest},
+		{name: "look up annotations without the admin token", method: "GET", path: "/v1/admin/cache/annotations?uri=https://example.com/a.jpg", status: http.StatusUnauthorized},
+		{name: "purge annotations without a condition", method: "DELETE", path: "/v1/admin/cache/annotations", headers: admin, status: http.StatusBadRequest},
+		{name: "purge annotations of a bad domain", method: "DELETE", path: "/v1/admin/cache/annotations?domain=example.com/a", headers: admin, status: http.StatusBadRequest},
+		{name: "reclassify an empty list", method: "POST", path: "/v1/admin/cache/reclassify", body: `{"imgURIList": []}`, headers: admin, status: http.StatusBadRequest},
+		{name: "reclassify invalid URIs", method: "POST", path: "/v1/admin/cache/reclassify", body: `{"imgURIList": ["not a uri"]}`, headers: admin, status: http.StatusBadRequest},
+		{name: "cache stats with a bad limit", method: "GET", path: "/v1/admin/cache/stats?oldest=-1", headers: admin, status: http.StatusBadRequest},
+		{name: "override with a bad verdict", method: "PUT", path: "/v1/admin/cache/override", body: `{"uri": "https://example.com/a.jpg", "verdict": "maybe"}`, headers: admin, status: http.StatusBadRequest},
+		{name: "override without an image", method: "PUT", path: "/v1/admin/cache/override", body: `{"verdict": "allow"}`, headers: admin, status: http.StatusBadRequest},
+		{name: "unpin without an image", method: "DELETE", path: "/v1/admin/cache/override", headers: admin, status: http.StatusBadRequest},
+		{name: "list reports with a bad status", method: "GET", path: "/v1/admin/reports?status=open", headers: admin, status: http.StatusBadRequest},
+		{name: "list reports without the admin token", method: "GET", path: "/v1/admin/reports", status: http.StatusUnauthorized},
+		{name: "resolve a report with a bad action", method: "POST", path: "/v1/admin/reports/1/resolve", body: `{"action": "ignore"}`, headers: admin, status: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+			req.Header.Set("Content-Type", "application/json")
+			for k, v := range test.headers {
+				req.Header.Set(k, v)
+			}
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != test.status {
+				t.Fatalf("expected status %d but got %d: %s", test.status, rr.Code, rr.Body.String())
+			}
+
+			route, pathParams, err := specRouter.FindRoute(req)
+			if err != nil {
+				t.Fatalf("route is not in openapi.json: %v", err)
+			}
+
+			input := &openapi3filter.ResponseValidationInput{
+				RequestValidationInput: &openapi3filter.RequestValidationInput{
+					Request:    req,
+					PathParams: pathParams,
+					Route:      route,
+					Options:    &openapi3filter.Options{AuthenticationFunc: openapi3filter.NoopAuthenticationFunc},
+				},
+				Status: rr.Code,
+				Header: rr.Header(),
+				Body:   io.NopCloser(bytes.NewReader(rr.Body.Bytes())),
+			}
+			if err := openapi3filter.ValidateResponse(context.Background(), input); err != nil {
+				t.Errorf("response does not match openapi.json: %v", err)
+			}
+		})
+	}
+
+	t.Run("unversioned routes are deprecated", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/health", nil))
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200 but got %d", rr.Code)
+		}
+		if rr.Header().Get("Deprecation") != "true" {
+			t.Error("expected Deprecation header on unversioned route")
+		}
+		if rr.Header().Get("Link") != `</v1/health>; rel="successor-version"` {
+			t.Errorf("unexpected Link header %q", rr.Header().Get("Link"))
+		}
+	})
+
+	t.Run("unknown routes return the error envelope", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/nope", nil))
+
+		if rr.Code != http.StatusNotFound {
+			t.Fatalf("expected status 404 but got %d", rr.Code)
+		}
+		if !strings.Contains(rr.Body.String(), `"code":"not_found"`) {
+			t.Errorf("unexpected body %s", rr.Body.String())
+		}
+	})
+}
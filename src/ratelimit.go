@@ -0,0 +1,305 @@
+package src
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+)
+
+// RateLimit is a token bucket that refills at Rate tokens per second and
+// holds at most Burst tokens. Each request takes one token.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// planRateLimits are the per license limits for each license plan.
+var planRateLimits = map[string]RateLimit{
+	"trial":    {Rate: 1, Burst: 10},
+	"standard": {Rate: 5, Burst: 50},
+	"pro":      {Rate: 20, Burst: 200},
+}
+
+const defaultPlan = "standard"
+
+// RateLimitResult is the outcome of taking a token from a bucket.
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // Reset is the time until the bucket is full again.
+	RetryAfter time.Duration // RetryAfter is the time until a token is available when not allowed.
+}
+
+// RateLimitStore keeps token buckets by key.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error)
+}
+
+// licenseRateLimit returns the rate limit for the license's plan.
+func licenseRateLimit(license *License) RateLimit {
+	if limit, ok := planRateLimits[license.Plan]; ok {
+		return limit
+	}
+	if license.IsTrial {
+		return planRateLimits["trial"]
+	}
+	return planRateLimits[defaultPlan]
+}
+
+// take refills a bucket holding tokens, last updated at last, and tries to
+// take a token from it. It returns the tokens left in the bucket.
+func (l RateLimit) take(tokens float64, last time.Time, now time.Time) (float64, RateLimitResult) {
+	burst := float64(l.Burst)
+	if elapsed := now.Sub(last).Seconds(); elapsed > 0 {
+		tokens += elapsed * l.Rate
+	}
+	if tokens > burst {
+		tokens = burst
+	}
+
+	res := RateLimitResult{Limit: l.Burst}
+	if tokens >= 1 {
+		tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = l.refillDuration(1 - tokens)
+	}
+	res.Remaining = int(math.Floor(tokens))
+	res.Reset = l.refillDuration(burst - tokens)
+
+	return tokens, res
+}
+
+// refillDuration returns how long the bucket takes to refill n tokens.
+func (l RateLimit) refillDuration(n float64) time.Duration {
+	if l.Rate <= 0 {
+		return 0
+	}
+	return time.Duration(n / l.Rate * float64(time.Second))
+}
+
+type memoryBucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time // full is when the bucket will be full and can be dropped.
+}
+
+// memoryRateLimitStore keeps token buckets in process memory. Limits are not
+// shared between instances.
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+func NewMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: make(map[string]*memoryBucket)}
+}
+
+func (store *memoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.sweep(now)
+
+	bucket, found := store.buckets[key]
+	if !found {
+		bucket = &memoryBucket{tokens: float64(limit.Burst), last: now}
+		store.buckets[key] = bucket
+	}
+
+	tokens, res := limit.take(bucket.tokens, bucket.last, now)
+	bucket.tokens = tokens
+	bucket.last = now
+	bucket.full = now.Add(res.Reset)
+
+	return res, nil
+}
+
+// sweep drops buckets that have refilled completely, at most once a minute.
+func (store *memoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(store.lastSweep) < time.Minute {
+		return
+	}
+	store.lastSweep = now
+
+	for key, bucket := range store.buckets {
+		if !now.Before(bucket.full) {
+			delete(store.buckets, key)
+		}
+	}
+}
+
+type rateLimitBucket struct {
+	Key       string  `pg:",pk"`
+	Tokens    float64 `pg:",use_zero"`
+	UpdatedAt time.Time
+	FullAt    time.Time // FullAt is when the bucket will be full and can be dropped.
+}
+
+// pgRateLimitStore keeps token buckets in Postgres so limits are shared
+// between instances.
+type pgRateLimitStore struct {
+	db      *pg.DB
+	timeout time.Duration
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+func NewPGRateLimitStore(db *pg.DB, timeout time.Duration) *pgRateLimitStore {
+	return &pgRateLimitStore{db: db, timeout: timeout}
+}
+
+func (store *pgRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	var res RateLimitResult
+
+	ctx, cancel := withTimeout(ctx, store.timeout)
+	defer cancel()
+
+	if err := store.sweep(ctx, now); err != nil {
+		return res, err
+	}
+
+	err := store.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		bucket := &rateLimitBucket{Key: key, Tokens: float64(limit.Burst), UpdatedAt: now, FullAt: now}
+		if _, err := tx.Model(bucket).OnConflict("DO NOTHING").Insert(); err != nil {
+			return err
+		}
+
+		if err := tx.Model(bucket).Where("key = ?", key).For("UPDATE").Select(); err != nil {
+			return err
+		}
+
+		bucket.Tokens, res = limit.take(bucket.Tokens, bucket.UpdatedAt, now)
+		bucket.UpdatedAt = now
+		bucket.FullAt = now.Add(res.Reset)
+
+		_, err := tx.Model(bucket).WherePK().Update()
+		return err
+	})
+
+	return res, err
+}
+
+// sweep deletes buckets that have refilled completely, at most once a minute
+// per instance.
+func (store *pgRateLimitStore) sweep(ctx context.Context, now time.Time) error {
+	store.mu.Lock()
+	if now.Sub(store.lastSweep) < time.Minute {
+		store.mu.Unlock()
+		return nil
+	}
+	store.lastSweep = now
+	store.mu.Unlock()
+
+	_, err := store.db.ModelContext(ctx, (*rateLimitBucket)(nil)).Where("full_at <= ?", now).Delete()
+	return err
+}
+
+// clientIP returns the IP address of the client that made the request. Behind
+// proxyHops trusted proxies, it is the X-Forwarded-For entry added by the
+// outermost one, since the entries before it are written by the client. With
+// no proxy hops the remote address is used.
+func clientIP(r *http.Request, proxyHops int) string {
+	if proxyHops > 0 {
+		var entries []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			entries = append(entries, strings.Split(header, ",")...)
+		}
+		if len(entries) > 0 {
+			i := len(entries) - proxyHops
+			if i < 0 {
+				i = 0
+			}
+			return strings.TrimSpace(entries[i])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func setRateLimitHeaders(w http.ResponseWriter, res RateLimitResult) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+	if !res.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// rateLimitMiddleware rejects requests with 429 once the bucket for the
+// request's key is empty. keyFunc returns the bucket key and limit for a
+// request, or false if the request is not rate limited.
+func rateLimitMiddleware(ctx appContext, keyFunc func(*http.Request) (string, RateLimit, bool)) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, limit, ok := keyFunc(r)
+			if !ok || r.Method == "OPTIONS" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Keys hold license IDs, so log lines are tied to the key through the
+			// request ID of the access log instead.
+			logger := loggerFromContext(r.Context(), ctx.logger)
+			res, err := ctx.rateLimiter.Take(r.Context(), key, limit, time.Now())
+			if err != nil {
+				// Fail open so a rate limit backend outage doesn't take the API down.
+				logger.Error().Msgf("failed to check rate limit: %v", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			setRateLimitHeaders(w, res)
+			if !res.Allowed {
+				logger.Info().Msg("rate limited")
+				appErr := newAppError(codeRateLimited, fmt.Sprintf("rate limit exceeded, retry in %d seconds", ceilSeconds(res.RetryAfter)))
+				writeError(w, r, http.StatusTooManyRequests, appErr.WithDetails("retryAfter", ceilSeconds(res.RetryAfter)))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ipRateLimitMiddleware rate limits requests by client IP.
+func ipRateLimitMiddleware(ctx appContext) func(next http.Handler) http.Handler {
+	return rateLimitMiddleware(ctx, func(r *http.Request) (string, RateLimit, bool) {
+		proxyHops := 0
+		if ctx.config.RateLimitTrustProxy {
+			proxyHops = ctx.config.RateLimitProxyHops
+		}
+		return "ip:" + clientIP(r, proxyHops), ctx.config.IPRateLimit, true
+	})
+}
+
+// licenseRateLimitMiddleware rate limits requests by the license set on the
+// request context by paywallMiddleware, using the limits of its plan.
+func licenseRateLimitMiddleware(ctx appContext) func(next http.Handler) http.Handler {
+	return rateLimitMiddleware(ctx, func(r *http.Request) (string, RateLimit, bool) {
+		license := licenseFromContext(r.Context())
+		if license == nil {
+			return "", RateLimit{}, false
+		}
+		return "license:" + license.ID, licenseRateLimit(license), true
+	})
+}
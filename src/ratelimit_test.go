@@ -0,0 +1,211 @@
+package src
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestRateLimit(t *testing.T) {
+	limit := RateLimit{Rate: 1, Burst: 3}
+
+	t.Run("bucket allows bursts then refills", func(t *testing.T) {
+		store := NewMemoryRateLimitStore()
+		now := time.Now()
+
+		for i := 0; i < limit.Burst; i++ {
+			res, err := store.Take(context.Background(), "key", limit, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !res.Allowed {
+				t.Fatalf("expected request %d to be allowed", i)
+			}
+			if res.Remaining != limit.Burst-i-1 {
+				t.Errorf("expected %d remaining but got %d", limit.Burst-i-1, res.Remaining)
+			}
+		}
+
+		res, _ := store.Take(context.Background(), "key", limit, now)
+		if res.Allowed {
+			t.Fatal("expected request to be rate limited once the burst is used")
+		}
+		if res.RetryAfter != time.Second {
+			t.Errorf("expected retry after 1s but got %s", res.RetryAfter)
+		}
+
+		res, _ = store.Take(context.Background(), "other", limit, now)
+		if !res.Allowed {
+			t.Error("expected buckets to be independent per key")
+		}
+
+		res, _ = store.Take(context.Background(), "key", limit, now.Add(time.Second))
+		if !res.Allowed {
+			t.Error("expected bucket to refill over time")
+		}
+	})
+
+	t.Run("sweeps full buckets", func(t *testing.T) {
+		store := NewMemoryRateLimitStore()
+		now := time.Now()
+
+		_, _ = store.Take(context.Background(), "key", limit, now)
+		_, _ = store.Take(context.Background(), "other", limit, now.Add(time.Hour))
+		if _, found := store.buckets["key"]; found {
+			t.Error("expected refilled bucket to be dropped")
+		}
+	})
+
+	t.Run("plan selects license limits", func(t *testing.T) {
+		if licenseRateLimit(&License{Plan: "pro"}) != planRateLimits["pro"] {
+			t.Error("expected pro plan limits")
+		}
+		if licenseRateLimit(&License{IsTrial: true}) != planRateLimits["trial"] {
+			t.Error("expected trial limits for trial license without a plan")
+		}
+		if licenseRateLimit(&License{}) != planRateLimits[defaultPlan] {
+			t.Error("expected default plan limits")
+		}
+	})
+
+	t.Run("middleware sets headers and rejects with 429", func(t *testing.T) {
+		ctx := appContext{
+			logger:      zerolog.Nop(),
+			rateLimiter: NewMemoryRateLimitStore(),
+			config:      Config{IPRateLimit: RateLimit{Rate: 1, Burst: 1}},
+		}
+		h := ipRateLimitMiddleware(ctx)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		req := httptest.NewRequest("GET", "/license/abc", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected 200 but got %d", rr.Code)
+		}
+		if rr.Header().Get("RateLimit-Limit") != "1" || rr.Header().Get("RateLimit-Remaining") != "0" {
+			t.Errorf("unexpected rate limit headers: %v", rr.Header())
+		}
+
+		rr = httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected 429 but got %d", rr.Code)
+		}
+		if rr.Header().Get("Retry-After") != "1" {
+			t.Errorf("expected Retry-After of 1 but got %q", rr.Header().Get("Retry-After"))
+		}
+	})
+	t.Run("client IP ignores entries written by the client", func(t *testing.T) {
+		ctx := appContext{
+			logger:      zerolog.Nop(),
+			rateLimiter: NewMemoryRateLimitStore(),
+			config:      Config{IPRateLimit: RateLimit{Rate: 1, Burst: 1}, RateLimitTrustProxy: true, RateLimitProxyHops: 1},
+		}
+		h := ipRateLimitMiddleware(ctx)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		codes := make([]int, 2)
+		for i, spoofed := range []string{"1.1.1.1", "2.2.2.2"} {
+			req := httptest.NewRequest("GET", "/license/abc", nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			req.Header.Set("X-Forwarded-For", spoofed+", 203.0.113.7")
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			codes[i] = rr.Code
+		}
+		if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests {
+			t.Fatalf("expected a spoofed leading entry to share the client's bucket but got %v", codes)
+		}
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Add("X-Forwarded-For", "1.1.1.1, 198.51.100.1")
+		req.Header.Add("X-Forwarded-For", "203.0.113.7")
+		if ip := clientIP(req, 2); ip != "198.51.100.1" {
+			t.Errorf("expected the entry before the trusted hops but got %s", ip)
+		}
+		if ip := clientIP(req, 5); ip != "1.1.1.1" {
+			t.Errorf("expected the first entry with more hops than entries but got %s", ip)
+		}
+		if ip := clientIP(req, 0); ip != "192.0.2.1" {
+			t.Errorf("expected the remote address without trusted hops but got %s", ip)
+		}
+	})
+	t.Run("filter routes limit license guesses by IP", func(t *testing.T) {
+		ctx := appContext{
+			logger:       zerolog.Nop(),
+			licenseStore: newFakeLicenseStore(),
+			rateLimiter:  NewMemoryRateLimitStore(),
+			config:       Config{IPRateLimit: RateLimit{Rate: 1, Burst: 1}},
+		}
+		router := newRouter(ctx)
+
+		codes := make([]int, 2)
+		for i := range codes {
+			req := httptest.NewRequest("POST", "/v1/filter/batch", nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			req.Header.Set("LicenseID", "0f1e3fa4-2b1c-4c51-a7e5-0c1f3b8f1c2a")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			codes[i] = rr.Code
+		}
+		if codes[0] != http.StatusUnauthorized || codes[1] != http.StatusTooManyRequests {
+			t.Fatalf("expected the second guess to be rate limited but got %v", codes)
+		}
+	})
+}
+
+func TestTrialLicenseRateLimit(t *testing.T) {
+	ctx, err := getTestCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trial := &License{ID: GenerateLicenseKey(), Email: "trial@example.com", IsValid: true, IsTrial: true}
+	if _, err = ctx.db.Model(trial).Insert(); err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.db.Model(trial).WherePK().Delete()
+
+	license, err := ctx.licenseStore.GetLicenseByID(context.Background(), trial.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit := licenseRateLimit(license); limit != planRateLimits["trial"] {
+		t.Fatalf("expected the trial limits for a stored trial license but got %+v with plan %q", limit, license.Plan)
+	}
+}
+
+func TestPGRateLimitStore(t *testing.T) {
+	ctx, err := getTestCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewPGRateLimitStore(&ctx.db, ctx.config.DBTimeout)
+	limit := RateLimit{Rate: 1, Burst: 3}
+	now := time.Now().UTC()
+	defer ctx.db.Model((*rateLimitBucket)(nil)).Where("key IN (?, ?)", "ip:spoofed", "ip:other").Delete()
+
+	if _, err = store.Take(context.Background(), "ip:spoofed", limit, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Take(context.Background(), "ip:other", limit, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	count, err := ctx.db.Model((*rateLimitBucket)(nil)).Where("key = ?", "ip:spoofed").Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatal("expected the refilled bucket to be deleted")
+	}
+}
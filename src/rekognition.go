@@ -0,0 +1,238 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+const (
+	// rekognitionMaxImageBytes is the largest image Rekognition accepts as bytes.
+	rekognitionMaxImageBytes = 5 << 20
+	// rekognitionMinConfidence is the confidence, in percent, below which
+	// Rekognition leaves out moderation labels.
+	rekognitionMinConfidence = 20
+	// rekognitionConcurrency bounds the images of a batch classified at once,
+	// as Rekognition takes one image per call.
+	rekognitionConcurrency = 8
+)
+
+// rekognitionCategories maps Rekognition moderation labels, from both the
+// first and second level of its taxonomy, onto SafeSearch categories.
+var rekognitionCategories = map[string]string{
+	"Explicit Nudity":          "adult",
+	"Explicit":                 "adult",
+	"Explicit Sexual Activity": "adult",
+	"Sexual Activity":          "adult",
+	"Suggestive":               "racy",
+	"Non-Explicit Nudity of Intimate parts and Kissing": "racy",
+	"Swimwear or Underwear":                             "racy",
+	"Violence":                                          "violence",
+	"Graphic Violence":                                  "violence",
+	"Graphic Violence Or Gore":                          "violence",
+	"Visually Disturbing":                               "violence",
+}
+
+// rekognitionAPI is the part of the Rekognition client used to classify images.
+type rekognitionAPI interface {
+	DetectModerationLabels(context.Context, *rekognition.DetectModerationLabelsInput, ...func(*rekognition.Options)) (*rekognition.DetectModerationLabelsOutput, error)
+}
+
+// rekognitionClassifier classifies images with AWS Rekognition content
+// moderation. Rekognition can't fetch images by URI, so they are downloaded
+// first. It rates adult, racy and violent content and leaves medical and
+// spoof unknown. Like the Vision classifier, it retries transient failures
+// itself.
+type rekognitionClassifier struct {
+	client      rekognitionAPI
+	fetchClient *http.Client
+	credentials aws.CredentialsProvider
+	timeout     time.Duration
+	maxRetries  int
+	backoff     time.Duration
+}
+
+// NewRekognitionClassifier connects to Rekognition with the default AWS
+// credentials chain.
+func NewRekognitionClassifier(ctx context.Context, config Config) (*rekognitionClassifier, error) {
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(config.AWSRegion))
+	if err != nil {
+		return nil, err
+	}
+	return newRekognitionClassifier(cfg, config), nil
+}
+
+func newRekognitionClassifier(cfg aws.Config, config Config) *rekognitionClassifier {
+	client := rekognition.NewFromConfig(cfg, func(o *rekognition.Options) {
+		if config.AWSRekognitionEndpoint != "" {
+			o.BaseEndpoint = aws.String(config.AWSRekognitionEndpoint)
+		}
+		// Retries are done by the classifier, so they are bounded and count
+		// towards the circuit breaker.
+		o.Retryer = aws.NopRetryer{}
+	})
+	return &rekognitionClassifier{
+		client:      client,
+		fetchClient: newImageFetchClient(config.ClassifierTimeout, config.ImageFetchAllowPrivate),
+		credentials: cfg.Credentials,
+		timeout:     config.ClassifierTimeout,
+		maxRetries:  config.ClassifierMaxRetries,
+		backoff:     config.ClassifierRetryBackoff,
+	}
+}
+
+// Classify classifies uris one call each. An image Rekognition fails on gets
+// a provider error of its own; the batch only fails if no image could be
+// classified, so the breaker and fallback see a provider that is down.
+func (rc *rekognitionClassifier) Classify(ctx context.Context, uris []string) ([]Classification, error) {
+	res := make([]Classification, len(uris))
+	errs := make([]error, len(uris))
+
+	sem := make(chan struct{}, rekognitionConcurrency)
+	var wg sync.WaitGroup
+	for i, uri := range uris {
+		wg.Add(1)
+		go func(i int, uri string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			res[i], errs[i] = rc.classifyImage(ctx, uri)
+		}(i, uri)
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	failed := 0
+	for i, err := range errs {
+		if err != nil {
+			failed++
+			res[i] = Classification{Error: err.Error(), ErrorKind: errorKindProviderError}
+		}
+	}
+	if failed == len(uris) {
+		return nil, errors.Join(errs...)
+	}
+	return res, nil
+}
+
+// classifyImage classifies a single image. Problems with the image itself
+// are set on the classification; other errors are returned.
+func (rc *rekognitionClassifier) classifyImage(ctx context.Context, uri string) (Classification, error) {
+	img, validators, err := fetchImage(ctx, rc.fetchClient, uri, rekognitionMaxImageBytes)
+	if err != nil {
+		if ctx.Err() != nil {
+			return Classification{}, ctx.Err()
+		}
+		return Classification{Error: fmt.Sprintf("failed to fetch image: %v", err), ErrorKind: errorKindFetchFailed}, nil
+	}
+
+	out, err := rc.detectModerationLabels(ctx, &rekognition.DetectModerationLabelsInput{
+		Image:         &types.Image{Bytes: img},
+		MinConfidence: aws.Float32(rekognitionMinConfidence),
+	})
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			switch apiErr.ErrorCode() {
+			case "InvalidImageFormatException", "ImageTooLargeException":
+				return Classification{Error: apiErr.ErrorMessage(), ErrorKind: errorKindUnsupportedFormat}, nil
+			case "InvalidParameterException":
+				return Classification{Error: apiErr.ErrorMessage(), ErrorKind: errorKindProviderError}, nil
+			}
+		}
+		return Classification{}, err
+	}
+
+	res := moderationClassification(out.ModerationLabels)
+	res.ModelVersion = aws.ToString(out.ModerationModelVersion)
+	res.Validators = validators
+	return res, nil
+}
+
+// detectModerationLabels calls Rekognition, retrying throttling and server
+// errors with backoff.
+func (rc *rekognitionClassifier) detectModerationLabels(ctx context.Context, input *rekognition.DetectModerationLabelsInput) (*rekognition.DetectModerationLabelsOutput, error) {
+	for attempt := 0; ; attempt++ {
+		callCtx, cancel := withTimeout(ctx, rc.timeout)
+		res, err := rc.client.DetectModerationLabels(callCtx, input)
+		cancel()
+
+		if err == nil || attempt >= rc.maxRetries || ctx.Err() != nil || !isRekognitionTransient(err) {
+			return res, err
+		}
+
+		select {
+		case <-time.After(retryDelay(rc.backoff, attempt)):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+// isRekognitionTransient reports whether a failed Rekognition call may
+// succeed if retried.
+func isRekognitionTransient(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "ThrottlingException", "ProvisionedThroughputExceededException", "LimitExceededException",
+			"InternalServerError", "ServiceUnavailableException":
+			return true
+		}
+	}
+	var resErr *smithyhttp.ResponseError
+	return errors.As(err, &resErr) && resErr.HTTPStatusCode() >= http.StatusInternalServerError
+}
+
+// moderationClassification rates each category by its most confident label.
+// Rated categories without labels are very unlikely.
+func moderationClassification(labels []types.ModerationLabel) Classification {
+	confidence := map[string]float64{"adult": 0, "racy": 0, "violence": 0}
+	for _, label := range labels {
+		category, found := rekognitionCategories[aws.ToString(label.Name)]
+		if !found {
+			category, found = rekognitionCategories[aws.ToString(label.ParentName)]
+		}
+		if found {
+			confidence[category] = max(confidence[category], float64(aws.ToFloat32(label.Confidence))/100)
+		}
+	}
+
+	return Classification{
+		Adult:    defaultLikelihoodThresholds.likelihood(confidence["adult"]),
+		Racy:     defaultLikelihoodThresholds.likelihood(confidence["racy"]),
+		Violence: defaultLikelihoodThresholds.likelihood(confidence["violence"]),
+		Medical:  int16(pb.Likelihood_UNKNOWN),
+		Spoof:    int16(pb.Likelihood_UNKNOWN),
+	}
+}
+
+// Check checks that AWS credentials can be retrieved.
+func (rc *rekognitionClassifier) Check(ctx context.Context) error {
+	if rc.credentials == nil {
+		return errors.New("no AWS credentials configured")
+	}
+	_, err := rc.credentials.Retrieve(ctx)
+	return err
+}
+
+func (rc *rekognitionClassifier) Close() error {
+	rc.fetchClient.CloseIdleConnections()
+	return nil
+}
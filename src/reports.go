@@ -0,0 +1,89 @@
+package src
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+)
+
+// Statuses of a misclassification report.
+const (
+	reportStatusPending  = "pending"  // Waiting for review.
+	reportStatusAccepted = "accepted" // The verdict was overridden.
+	reportStatusRejected = "rejected" // The classification was upheld.
+)
+
+// MisclassificationReport is a client's report that an image got the wrong
+// verdict, queued for review by an admin.
+type MisclassificationReport struct {
+	ID              int64      `json:"id" pg:",pk"`
+	Hash            string     `json:"hash"`
+	URI             string     `json:"uri"`
+	LicenseID       string     `json:"-"`
+	ExpectedVerdict string     `json:"expectedVerdict"` // The verdict the client expected, "allow" or "block".
+	Comment         string     `json:"comment,omitempty"`
+	Status          string     `json:"status" pg:",use_zero"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	ResolvedAt      *time.Time `json:"resolvedAt,omitempty"`
+}
+
+// InsertReport queues report for review, setting its ID.
+func InsertReport(ctx context.Context, conn pg.DB, report *MisclassificationReport) error {
+	report.Status = reportStatusPending
+	if _, err := conn.ModelContext(ctx, report).Returning("id, created_at").Insert(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// FindReportByID returns the report with the ID, or nil if there is none.
+func FindReportByID(ctx context.Context, conn pg.DB, id int64) (*MisclassificationReport, error) {
+	report := &MisclassificationReport{ID: id}
+
+	err := conn.ModelContext(ctx, report).WherePK().Select()
+	if err == pg.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// FindReportsByStatus returns up to limit reports with the status, oldest
+// first.
+func FindReportsByStatus(ctx context.Context, conn pg.DB, status string, limit int) ([]MisclassificationReport, error) {
+	var reports []MisclassificationReport
+
+	err := conn.ModelContext(ctx, &reports).
+		Where("status = ?", status).
+		Order("created_at ASC", "id ASC").
+		Limit(limit).
+		Select()
+	if err != nil {
+		return nil, err
+	}
+
+	return reports, nil
+}
+
+// ResolveReports resolves the pending reports of the image with the hash
+// with status, returning how many were resolved. Reports of an image are
+// resolved together as they ask for the same review.
+func ResolveReports(ctx context.Context, conn orm.DB, hash string, status string) (int, error) {
+	res, err := conn.ModelContext(ctx, (*MisclassificationReport)(nil)).
+		Set("status = ?", status).
+		Set("resolved_at = ?", time.Now()).
+		Where("hash = ?", hash).
+		Where("status = ?", reportStatusPending).
+		Update()
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected(), nil
+}
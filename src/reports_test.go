@@ -0,0 +1,143 @@
+package src
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReports(t *testing.T) {
+	ctx, err := getTestCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uri := "https://example.com/reported.jpg"
+	anno := &ImageAnnotation{Hash: Hash(uri), URI: uri, Adult: 5, ValidatedAt: time.Now()}
+	if _, err := InsertAll(context.Background(), ctx.db, []*ImageAnnotation{anno}); err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteByURI(context.Background(), ctx.db, ctx.lru, uri)
+	defer ctx.db.Model((*MisclassificationReport)(nil)).Where("hash = ?", anno.Hash).Delete()
+
+	t.Run("queues reports for review", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			report := &MisclassificationReport{Hash: anno.Hash, URI: uri, LicenseID: testLicenseID, ExpectedVerdict: verdictAllow}
+			if err := InsertReport(context.Background(), ctx.db, report); err != nil {
+				t.Fatal(err)
+			}
+			if report.ID == 0 || report.Status != reportStatusPending {
+				t.Fatalf("expected a pending report with an ID but got %+v", report)
+			}
+		}
+
+		reports, err := FindReportsByStatus(context.Background(), ctx.db, reportStatusPending, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := 0
+		for _, report := range reports {
+			if report.Hash == anno.Hash {
+				found++
+			}
+		}
+		if found != 2 {
+			t.Fatalf("expected 2 pending reports but got %d", found)
+		}
+	})
+
+	t.Run("overrides keep the original scores", func(t *testing.T) {
+		uris, err := OverrideVerdict(context.Background(), &ctx.db, anno.Hash, verdictAllow, "reported")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(uris) != 1 || uris[0] != uri {
+			t.Fatalf("expected %s to be overridden but got %v", uri, uris)
+		}
+
+		cached, err := FindByURI(context.Background(), ctx.db, uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached.OverrideVerdict != verdictAllow || cached.OverriddenAt.IsZero() || cached.Adult != 5 {
+			t.Fatalf("expected the pinned verdict with the original scores but got %+v", cached)
+		}
+
+		// Classifying the image again keeps the override.
+		reclassified := *anno
+		reclassified.Adult, reclassified.ValidatedAt = 4, time.Now()
+		if _, err := InsertAll(context.Background(), ctx.db, []*ImageAnnotation{&reclassified}); err != nil {
+			t.Fatal(err)
+		}
+		if cached, _ = FindByURI(context.Background(), ctx.db, uri); cached.OverrideVerdict != verdictAllow {
+			t.Fatal("expected the override to be kept")
+		}
+
+		if _, err := OverrideVerdict(context.Background(), &ctx.db, anno.Hash, "", ""); err != nil {
+			t.Fatal(err)
+		}
+		if cached, _ = FindByURI(context.Background(), ctx.db, uri); cached.OverrideVerdict != "" {
+			t.Fatal("expected the override to be removed")
+		}
+	})
+
+	t.Run("placeholders carry pins of uncached images", func(t *testing.T) {
+		uncached := "https://example.com/pinned-before-classified.jpg"
+		defer DeleteByURI(context.Background(), ctx.db, ctx.lru, uncached)
+
+		if _, err := setOverride(context.Background(), ctx, Hash(uncached), uncached, verdictBlock, "reported"); err != nil {
+			t.Fatal(err)
+		}
+		// A classification racing the pin keeps it.
+		classified := &ImageAnnotation{Hash: Hash(uncached), URI: uncached, Adult: 2, ValidatedAt: time.Now()}
+		if _, err := InsertAll(context.Background(), ctx.db, []*ImageAnnotation{classified}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := setOverride(context.Background(), ctx, Hash(uncached), uncached, verdictBlock, "reported again"); err != nil {
+			t.Fatal(err)
+		}
+		cached, err := FindByURI(context.Background(), ctx.db, uncached)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached.OverrideVerdict != verdictBlock || cached.OverrideReason != "reported again" || cached.Adult != 2 {
+			t.Fatalf("expected the pin over the classified scores but got %+v", cached)
+		}
+
+		// Unpinned before any classification, the placeholder is expired.
+		placeholder := "https://example.com/pinned-then-unpinned.jpg"
+		defer DeleteByURI(context.Background(), ctx.db, ctx.lru, placeholder)
+		if _, err := setOverride(context.Background(), ctx, Hash(placeholder), placeholder, verdictAllow, "reported"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := setOverride(context.Background(), ctx, Hash(placeholder), "", "", ""); err != nil {
+			t.Fatal(err)
+		}
+		cached, err = FindByURI(context.Background(), ctx.db, placeholder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := annotationFreshness(&cached, time.Now(), ctx.config); got != cacheExpired {
+			t.Fatalf("expected the unpinned placeholder to be expired but got %d", got)
+		}
+
+		// Without its uri an uncached image can't be pinned.
+		found, err := setOverride(context.Background(), ctx, Hash("https://example.com/never-cached.jpg"), "", verdictBlock, "reported")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found {
+			t.Fatal("expected nothing to be pinned by the hash of an uncached image")
+		}
+	})
+
+	t.Run("resolves the reports of an image together", func(t *testing.T) {
+		resolved, err := ResolveReports(context.Background(), &ctx.db, anno.Hash, reportStatusAccepted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resolved != 2 {
+			t.Fatalf("expected 2 reports to be resolved but got %d", resolved)
+		}
+	})
+}
@@ -0,0 +1,307 @@
+package src
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// revalidateConcurrency bounds the origin requests of a revalidation at once.
+const revalidateConcurrency = 8
+
+// Freshness of a cached annotation.
+const (
+	cacheFresh   = iota // Served as is.
+	cacheStale          // Served while it is revalidated in the background.
+	cacheExpired        // Classified again before it is served.
+)
+
+// annotationFreshness returns the freshness of anno at now. Annotations are
+// fresh for the cache TTL after they were last validated, then stale for the
+// stale-while-revalidate window, then expired. Errors that may be transient
+// are instead fresh for the error TTL, doubled on each retry, and then expire
+// without a stale window so the image is retried.
+func annotationFreshness(anno *ImageAnnotation, now time.Time, config Config) int {
+	// A pinned verdict stands whatever the image is classified as.
+	if anno.OverrideVerdict != "" {
+		return cacheFresh
+	}
+	// An unpinned placeholder has no scores to serve, whatever the TTL.
+	if anno.ValidatedAt.Equal(placeholderValidatedAt) {
+		return cacheExpired
+	}
+
+	validatedAt := anno.ValidatedAt
+	if validatedAt.IsZero() {
+		validatedAt = anno.DateAdded
+	}
+	age := now.Sub(validatedAt)
+
+	if isRetriableError(anno, config) {
+		if age < errorTTL(anno, config) {
+			return cacheFresh
+		}
+		return cacheExpired
+	}
+
+	if config.CacheTTL <= 0 {
+		return cacheFresh
+	}
+	switch {
+	case age < config.CacheTTL:
+		return cacheFresh
+	case age < config.CacheTTL+config.CacheStaleWhileRevalidate:
+		return cacheStale
+	}
+	return cacheExpired
+}
+
+// isRetriableError reports whether anno is an error that is negatively
+// cached and retried. Unsupported formats won't change on retry, so they are
+// kept like verdicts, as are errors that ran out of retries.
+func isRetriableError(anno *ImageAnnotation, config Config) bool {
+	return anno.Error.Valid &&
+		anno.ErrorKind != errorKindUnsupportedFormat &&
+		config.CacheErrorTTL > 0 &&
+		anno.RetryCount < config.CacheErrorMaxRetries
+}
+
+// errorTTL returns how long the error of anno is cached, doubling the error
+// TTL for each retry.
+func errorTTL(anno *ImageAnnotation, config Config) time.Duration {
+	return config.CacheErrorTTL << min(anno.RetryCount, 16)
+}
+
+// splitByFreshness splits cached annotations into those that can be served,
+// of which stale ones are also returned to be revalidated, and expired ones,
+// which must be classified again.
+func splitByFreshness(annos []*ImageAnnotation, now time.Time, config Config) (served []*ImageAnnotation, stale []*ImageAnnotation, expired []*ImageAnnotation) {
+	for _, anno := range annos {
+		switch annotationFreshness(anno, now, config) {
+		case cacheFresh:
+			served = append(served, anno)
+		case cacheStale:
+			served = append(served, anno)
+			stale = append(stale, anno)
+		default:
+			expired = append(expired, anno)
+		}
+	}
+	return served, stale, expired
+}
+
+// cacheRevalidator revalidates stale annotations in the background. It asks
+// the origin whether each image changed, using the stored ETag and
+// Last-Modified, and only classifies the images that did. Revalidations are
+// cache maintenance, so they aren't billed to the license that hit the stale
+// entry.
+//
+// Annotations classified by an older model than their providers now run are
+// also revalidated, and classified again even if the image is unchanged.
+type cacheRevalidator struct {
+	fetchClient *http.Client
+
+	mu       sync.Mutex
+	inflight map[string]bool   // URIs being revalidated.
+	models   map[string]string // Latest model version seen from each provider.
+}
+
+func newCacheRevalidator(config Config) *cacheRevalidator {
+	return &cacheRevalidator{
+		fetchClient: newImageFetchClient(config.ClassifierTimeout, config.ImageFetchAllowPrivate),
+		inflight:    make(map[string]bool),
+		models:      make(map[string]string),
+	}
+}
+
+// ObserveModels records the model versions of classifications as the ones
+// their providers now run. A nil revalidator does nothing.
+func (rv *cacheRevalidator) ObserveModels(classifications []Classification) {
+	if rv == nil {
+		return
+	}
+
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	for _, classification := range classifications {
+		if classification.Error == "" && classification.Provider != "" && classification.ModelVersion != "" {
+			rv.models[classification.Provider] = classification.ModelVersion
+		}
+	}
+}
+
+// Outdated returns the annotations of annos classified by another model
+// version than their providers now run. Annotations whose version is unknown
+// are kept. A nil revalidator returns none.
+func (rv *cacheRevalidator) Outdated(annos []*ImageAnnotation) []*ImageAnnotation {
+	if rv == nil {
+		return nil
+	}
+
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	var outdated []*ImageAnnotation
+	for _, anno := range annos {
+		if rv.isOutdated(anno) {
+			outdated = append(outdated, anno)
+		}
+	}
+	return outdated
+}
+
+// isOutdated reports whether anno is from an older model. rv.mu must be held.
+func (rv *cacheRevalidator) isOutdated(anno *ImageAnnotation) bool {
+	// A pinned verdict stands whatever the image is classified as.
+	if anno.OverrideVerdict != "" || anno.ModelVersion == "" {
+		return false
+	}
+	current, ok := rv.models[anno.Provider]
+	return ok && current != anno.ModelVersion
+}
+
+// Revalidate starts revalidating annos on ctx's workers, skipping those that
+// are already being revalidated. A nil revalidator does nothing.
+func (rv *cacheRevalidator) Revalidate(c context.Context, ctx appContext, annos []*ImageAnnotation) {
+	if rv == nil {
+		return
+	}
+
+	// The annotations are copied as the originals are being served.
+	pending := make([]*ImageAnnotation, 0, len(annos))
+	rv.mu.Lock()
+	for _, anno := range annos {
+		if !rv.inflight[anno.URI] {
+			rv.inflight[anno.URI] = true
+			copied := *anno
+			pending = append(pending, &copied)
+		}
+	}
+	rv.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	c = context.WithoutCancel(c)
+	ctx.workers.Go(func() {
+		defer rv.done(pending)
+		rv.revalidate(c, ctx, pending)
+	})
+}
+
+func (rv *cacheRevalidator) done(annos []*ImageAnnotation) {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	for _, anno := range annos {
+		delete(rv.inflight, anno.URI)
+	}
+}
+
+func (rv *cacheRevalidator) revalidate(c context.Context, ctx appContext, annos []*ImageAnnotation) {
+	c, span := tracer.Start(c, "cache.revalidate", trace.WithAttributes(imageCountAttr(len(annos))))
+	defer span.End()
+
+	now := time.Now()
+	modified := make([]bool, len(annos))
+	validators := make([]imageValidators, len(annos))
+	errs := make([]error, len(annos))
+
+	sem := make(chan struct{}, revalidateConcurrency)
+	var wg sync.WaitGroup
+	for i, anno := range annos {
+		wg.Add(1)
+		go func(i int, anno *ImageAnnotation) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			checkCtx, cancel := withTimeout(c, ctx.config.ClassifierTimeout)
+			defer cancel()
+			modified[i], validators[i], errs[i] = checkImageModified(checkCtx, rv.fetchClient, anno.URI, anno.validators())
+		}(i, anno)
+	}
+	wg.Wait()
+
+	rv.mu.Lock()
+	outdated := make([]bool, len(annos))
+	for i, anno := range annos {
+		outdated[i] = rv.isOutdated(anno)
+	}
+	rv.mu.Unlock()
+
+	var unchanged []*ImageAnnotation
+	var changedURIs []string
+	changedValidators := make(map[string]imageValidators)
+	for i, anno := range annos {
+		switch {
+		case errs[i] != nil:
+			cacheRevalidationsTotal.WithLabelValues("failed").Inc()
+			ctx.logger.Debug().Msgf("failed to revalidate %s: %v", anno.URI, errs[i])
+		case modified[i] || outdated[i]:
+			changedURIs = append(changedURIs, anno.URI)
+			changedValidators[anno.URI] = validators[i]
+		default:
+			anno.ValidatedAt, anno.ETag, anno.LastModified = now, validators[i].ETag, validators[i].LastModified
+			unchanged = append(unchanged, anno)
+		}
+	}
+
+	if len(unchanged) > 0 {
+		dbCtx, cancel := withTimeout(c, ctx.config.DBTimeout)
+		err := MarkValidated(dbCtx, ctx.db, unchanged)
+		cancel()
+		if err != nil {
+			ctx.logger.Error().Msgf("failed to mark annotations validated: %v", err)
+		} else {
+			ctx.lru.AddAll(unchanged)
+			cacheRevalidationsTotal.WithLabelValues("not_modified").Add(float64(len(unchanged)))
+		}
+	}
+
+	if len(changedURIs) == 0 {
+		return
+	}
+
+	classifications, err := ctx.classifier.Classify(c, changedURIs)
+	if err != nil {
+		cacheRevalidationsTotal.WithLabelValues("failed").Add(float64(len(changedURIs)))
+		ctx.logger.Error().Msgf("failed to classify changed images: %v", err)
+		return
+	}
+	rv.ObserveModels(classifications)
+
+	previous := make(map[string]*ImageAnnotation, len(annos))
+	upgradeOnly := make(map[string]bool)
+	for i, anno := range annos {
+		previous[anno.URI] = anno
+		if !modified[i] {
+			upgradeOnly[anno.URI] = true
+		}
+	}
+	reclassified := make([]*ImageAnnotation, 0, len(classifications))
+	for i, classification := range classifications {
+		// Providers that don't fetch images leave the validators to the check.
+		if classification.Validators == (imageValidators{}) {
+			classification.Validators = changedValidators[changedURIs[i]]
+		}
+		anno := classificationToAnnotation(changedURIs[i], classification)
+		prev := previous[anno.URI]
+		// An unchanged image keeps its verdict if the newer model fails on it.
+		if upgradeOnly[anno.URI] && anno.Error.Valid && !prev.Error.Valid {
+			cacheRevalidationsTotal.WithLabelValues("failed").Inc()
+			continue
+		}
+		if prev.Error.Valid && anno.Error.Valid {
+			anno.RetryCount = prev.RetryCount + 1
+		}
+		reclassified = append(reclassified, anno)
+	}
+	if err := cacheAnnotations(c, ctx, reclassified); err != nil {
+		cacheRevalidationsTotal.WithLabelValues("failed").Add(float64(len(reclassified)))
+		ctx.logger.Error().Msgf("failed to cache revalidated annotations: %v", err)
+		return
+	}
+	cacheRevalidationsTotal.WithLabelValues("changed").Add(float64(len(reclassified)))
+}
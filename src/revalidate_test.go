@@ -0,0 +1,152 @@
+package src
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAnnotationFreshness(t *testing.T) {
+	now := time.Now()
+	config := Config{CacheTTL: 24 * time.Hour, CacheStaleWhileRevalidate: time.Hour}
+	errorConfig := config
+	errorConfig.CacheErrorTTL, errorConfig.CacheErrorMaxRetries = 10*time.Minute, 3
+
+	tests := []struct {
+		name   string
+		anno   ImageAnnotation
+		config Config
+		want   int
+	}{
+		{"fresh", ImageAnnotation{ValidatedAt: now.Add(-time.Hour)}, config, cacheFresh},
+		{"stale", ImageAnnotation{ValidatedAt: now.Add(-24*time.Hour - time.Minute)}, config, cacheStale},
+		{"expired", ImageAnnotation{ValidatedAt: now.Add(-26 * time.Hour)}, config, cacheExpired},
+		{"falls back to the date added", ImageAnnotation{DateAdded: now.Add(-26 * time.Hour)}, config, cacheExpired},
+		{"revalidation extends freshness", ImageAnnotation{DateAdded: now.Add(-48 * time.Hour), ValidatedAt: now}, config, cacheFresh},
+		{"never expires without a TTL", ImageAnnotation{ValidatedAt: now.Add(-24 * 365 * time.Hour)}, Config{}, cacheFresh},
+		{"expires at the TTL without a stale window", ImageAnnotation{ValidatedAt: now.Add(-25 * time.Hour)}, Config{CacheTTL: 24 * time.Hour}, cacheExpired},
+		{"errors are fresh for the error TTL", erroredAnnotation(errorKindFetchFailed, 0, now.Add(-5*time.Minute)), errorConfig, cacheFresh},
+		{"errors expire without a stale window", erroredAnnotation(errorKindFetchFailed, 0, now.Add(-11*time.Minute)), errorConfig, cacheExpired},
+		{"errors expire without a cache TTL", erroredAnnotation(errorKindProviderError, 0, now.Add(-11*time.Minute)), Config{CacheErrorTTL: 10 * time.Minute, CacheErrorMaxRetries: 3}, cacheExpired},
+		{"error TTL doubles on each retry", erroredAnnotation(errorKindFetchFailed, 2, now.Add(-39*time.Minute)), errorConfig, cacheFresh},
+		{"errors are kept after the last retry", erroredAnnotation(errorKindFetchFailed, 3, now.Add(-time.Hour)), errorConfig, cacheFresh},
+		{"overrides never expire", ImageAnnotation{ValidatedAt: now.Add(-48 * time.Hour), OverrideVerdict: verdictAllow}, config, cacheFresh},
+		{"pinned placeholders are fresh", ImageAnnotation{DateAdded: now, ValidatedAt: placeholderValidatedAt, OverrideVerdict: verdictBlock}, config, cacheFresh},
+		{"unpinned placeholders are expired", ImageAnnotation{DateAdded: now, ValidatedAt: placeholderValidatedAt}, Config{}, cacheExpired},
+		{"unsupported formats are kept", erroredAnnotation(errorKindUnsupportedFormat, 0, now.Add(-time.Hour)), errorConfig, cacheFresh},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := annotationFreshness(&test.anno, now, test.config); got != test.want {
+				t.Fatalf("expected %d but got %d", test.want, got)
+			}
+		})
+	}
+
+	t.Run("splits by freshness", func(t *testing.T) {
+		annos := []*ImageAnnotation{
+			{URI: "fresh", ValidatedAt: now},
+			{URI: "stale", ValidatedAt: now.Add(-24*time.Hour - time.Minute)},
+			{URI: "expired", ValidatedAt: now.Add(-48 * time.Hour)},
+		}
+		served, stale, expired := splitByFreshness(annos, now, config)
+		if len(served) != 2 || len(stale) != 1 || stale[0].URI != "stale" || len(expired) != 1 || expired[0].URI != "expired" {
+			t.Fatalf("expected fresh and stale served, stale revalidated and expired reclassified but got %d, %v, %v", len(served), stale, expired)
+		}
+	})
+}
+
+func erroredAnnotation(kind string, retries int, validatedAt time.Time) ImageAnnotation {
+	return ImageAnnotation{
+		Error:       sql.NullString{String: "failed", Valid: true},
+		ErrorKind:   kind,
+		RetryCount:  retries,
+		ValidatedAt: validatedAt,
+	}
+}
+
+func TestCheckImageModified(t *testing.T) {
+	const etag = `"v2"`
+	const lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.jpg" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("If-None-Match") == etag || (r.Header.Get("If-None-Match") == "" && r.Header.Get("If-Modified-Since") == lastModified) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", lastModified)
+		w.Write([]byte("image"))
+	}))
+	defer srv.Close()
+
+	client := newImageFetchClient(time.Second, true)
+	tests := []struct {
+		name       string
+		validators imageValidators
+		modified   bool
+	}{
+		{"unchanged etag", imageValidators{ETag: etag}, false},
+		{"unchanged last modified", imageValidators{LastModified: lastModified}, false},
+		{"changed etag", imageValidators{ETag: `"v1"`}, true},
+		{"no validators", imageValidators{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			modified, v, err := checkImageModified(context.Background(), client, srv.URL+"/a.jpg", test.validators)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if modified != test.modified {
+				t.Fatalf("expected modified %t but got %t", test.modified, modified)
+			}
+			if modified && v.ETag != etag {
+				t.Fatalf("expected the new ETag but got %q", v.ETag)
+			}
+			if !modified && v != test.validators {
+				t.Fatalf("expected the validators to be kept but got %+v", v)
+			}
+		})
+	}
+
+	t.Run("fails on errors", func(t *testing.T) {
+		if _, _, err := checkImageModified(context.Background(), client, srv.URL+"/missing.jpg", imageValidators{ETag: etag}); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
+
+func TestOutdatedAnnotations(t *testing.T) {
+	rv := newCacheRevalidator(Config{})
+	annos := []*ImageAnnotation{
+		{URI: "current", Provider: "vision", ModelVersion: "v2"},
+		{URI: "outdated", Provider: "vision", ModelVersion: "v1"},
+		{URI: "unversioned", Provider: "vision"},
+		{URI: "unseen provider", Provider: "rekognition", ModelVersion: "7.0"},
+		{URI: "pinned", Provider: "vision", ModelVersion: "v1", OverrideVerdict: verdictAllow},
+	}
+	if outdated := rv.Outdated(annos); len(outdated) != 0 {
+		t.Fatalf("expected no outdated annotations before a model was seen but got %d", len(outdated))
+	}
+
+	rv.ObserveModels([]Classification{
+		{Provider: "vision", ModelVersion: "v2"},
+		{Provider: "rekognition", ModelVersion: "8.0", Error: "failed"},
+	})
+	outdated := rv.Outdated(annos)
+	if len(outdated) != 1 || outdated[0].URI != "outdated" {
+		t.Fatalf("expected only the annotation of the older model to be outdated but got %v", outdated)
+	}
+
+	var nilRV *cacheRevalidator
+	nilRV.ObserveModels([]Classification{{Provider: "vision", ModelVersion: "v3"}})
+	if outdated := nilRV.Outdated(annos); outdated != nil {
+		t.Fatalf("expected a nil revalidator to find nothing outdated but got %v", outdated)
+	}
+}
@@ -0,0 +1,376 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/gorilla/mux"
+)
+
+// maxRulesPerLicense bounds the rules evaluated for each image of a request.
+const maxRulesPerLicense = 500
+
+// LicenseRule allows or blocks the images matching Pattern for a license,
+// without classifying them. The pattern is a domain, such as example.com, or
+// *.example.com to include its subdomains, optionally followed by a path
+// prefix, such as example.com/avatars/.
+type LicenseRule struct {
+	ID        int64     `json:"id" pg:",pk"`
+	LicenseID string    `json:"-"`
+	Pattern   string    `json:"pattern"`
+	Action    string    `json:"action"` // The verdict of matching images, "allow" or "block".
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type RuleStorer interface {
+	GetRules(ctx context.Context, licenseID string) ([]LicenseRule, error)
+	PutRule(ctx context.Context, rule *LicenseRule) error
+	DeleteRule(ctx context.Context, licenseID string, id int64) (bool, error)
+}
+
+// ruleStore keeps license rules in Postgres. Each query is bounded by
+// timeout on top of the caller's context.
+type ruleStore struct {
+	db      *pg.DB
+	timeout time.Duration
+}
+
+func NewRuleStore(db *pg.DB, timeout time.Duration) *ruleStore {
+	return &ruleStore{db: db, timeout: timeout}
+}
+
+// GetRules returns the rules of a license, oldest first.
+func (store *ruleStore) GetRules(ctx context.Context, licenseID string) ([]LicenseRule, error) {
+	ctx, cancel := withTimeout(ctx, store.timeout)
+	defer cancel()
+
+	var rules []LicenseRule
+	err := store.db.ModelContext(ctx, &rules).Where("license_id = ?", licenseID).Order("id ASC").Select()
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// PutRule adds rule to its license, or updates the action of the license's
+// rule with the same pattern, setting its ID.
+func (store *ruleStore) PutRule(ctx context.Context, rule *LicenseRule) error {
+	ctx, cancel := withTimeout(ctx, store.timeout)
+	defer cancel()
+
+	_, err := store.db.ModelContext(ctx, rule).
+		OnConflict("(license_id, pattern) DO UPDATE").
+		Set("action = EXCLUDED.action").
+		Returning("id, created_at").
+		Insert()
+	return err
+}
+
+// DeleteRule deletes a rule of a license, reporting whether it existed.
+func (store *ruleStore) DeleteRule(ctx context.Context, licenseID string, id int64) (bool, error) {
+	ctx, cancel := withTimeout(ctx, store.timeout)
+	defer cancel()
+
+	res, err := store.db.ModelContext(ctx, (*LicenseRule)(nil)).
+		Where("license_id = ?", licenseID).
+		Where("id = ?", id).
+		Delete()
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// maxCachedRuleLicenses bounds the licenses whose rules are kept in memory.
+const maxCachedRuleLicenses = 10000
+
+// cachedRuleStore keeps the rules of licenses in memory in front of a
+// RuleStorer, as every batch filter request needs them. Writes through it
+// drop the license's rules; those made through other instances are seen
+// once the TTL has passed. The rules returned are shared and must not be
+// modified.
+type cachedRuleStore struct {
+	RuleStorer
+	ttl time.Duration
+	now func() time.Time
+
+	mu         sync.Mutex
+	rules      map[string]cachedRules
+	generation uint64 // Incremented by each write, so reads racing it aren't cached.
+}
+
+type cachedRules struct {
+	rules    []LicenseRule
+	storedAt time.Time
+}
+
+// newCachedRuleStore returns store with its rules kept in memory for ttl, or
+// store itself if ttl is 0.
+func newCachedRuleStore(store RuleStorer, ttl time.Duration) RuleStorer {
+	if ttl <= 0 {
+		return store
+	}
+	return &cachedRuleStore{RuleStorer: store, ttl: ttl, now: time.Now, rules: make(map[string]cachedRules)}
+}
+
+func (store *cachedRuleStore) GetRules(ctx context.Context, licenseID string) ([]LicenseRule, error) {
+	store.mu.Lock()
+	now := store.now()
+	if cached, ok := store.rules[licenseID]; ok && now.Sub(cached.storedAt) < store.ttl {
+		store.mu.Unlock()
+		return cached.rules, nil
+	}
+	generation := store.generation
+	store.mu.Unlock()
+
+	rules, err := store.RuleStorer.GetRules(ctx, licenseID)
+	if err != nil {
+		return nil, err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.generation != generation {
+		return rules, nil
+	}
+	if len(store.rules) >= maxCachedRuleLicenses {
+		for id, cached := range store.rules {
+			if now.Sub(cached.storedAt) >= store.ttl {
+				delete(store.rules, id)
+			}
+		}
+		if len(store.rules) >= maxCachedRuleLicenses {
+			clear(store.rules)
+		}
+	}
+	store.rules[licenseID] = cachedRules{rules: rules, storedAt: now}
+	return rules, nil
+}
+
+func (store *cachedRuleStore) PutRule(ctx context.Context, rule *LicenseRule) error {
+	defer store.invalidate(rule.LicenseID)
+	return store.RuleStorer.PutRule(ctx, rule)
+}
+
+func (store *cachedRuleStore) DeleteRule(ctx context.Context, licenseID string, id int64) (bool, error) {
+	defer store.invalidate(licenseID)
+	return store.RuleStorer.DeleteRule(ctx, licenseID, id)
+}
+
+func (store *cachedRuleStore) invalidate(licenseID string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.generation++
+	delete(store.rules, licenseID)
+}
+
+// rulePattern matches a normalized rule pattern.
+var rulePattern = regexp.MustCompile(`^(\*\.)?[a-z0-9-]+(\.[a-z0-9-]+)*(/\S*)?$`)
+
+// normalizeRulePattern lowercases the domain of pattern and drops any scheme,
+// so rules can be given as URLs.
+func normalizeRulePattern(pattern string) (string, error) {
+	pattern = strings.TrimSpace(pattern)
+	if i := strings.Index(pattern, "://"); i >= 0 {
+		pattern = pattern[i+3:]
+	}
+	domain, path, _ := strings.Cut(pattern, "/")
+	pattern = strings.ToLower(domain)
+	if path != "" {
+		pattern += "/" + path
+	}
+
+	if !rulePattern.MatchString(pattern) {
+		return "", fmt.Errorf("%q is not a domain or URL pattern", pattern)
+	}
+	return pattern, nil
+}
+
+// ruleSpecificity orders the rules matching an image. Rules with a longer
+// path prefix win, then those with a longer domain, then exact domains over
+// wildcards.
+func ruleSpecificity(pattern string) (int, int, bool) {
+	domain, path, _ := strings.Cut(pattern, "/")
+	suffix, wildcard := strings.CutPrefix(domain, "*.")
+	return len(path), len(suffix), !wildcard
+}
+
+// matchRule returns the most specific of rules matching uri, or nil if none
+// does. Block rules win over allow rules as specific.
+func matchRule(rules []LicenseRule, uri string) *LicenseRule {
+	if len(rules) == 0 {
+		return nil
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil
+	}
+	host := strings.ToLower(u.Hostname())
+
+	var best *LicenseRule
+	for i := range rules {
+		rule := &rules[i]
+		domain, path, hasPath := strings.Cut(rule.Pattern, "/")
+		if suffix, ok := strings.CutPrefix(domain, "*."); ok {
+			if host != suffix && !strings.HasSuffix(host, "."+suffix) {
+				continue
+			}
+		} else if host != domain {
+			continue
+		}
+		if hasPath && !strings.HasPrefix(u.Path, "/"+path) {
+			continue
+		}
+
+		if best == nil || moreSpecific(rule, best) {
+			best = rule
+		}
+	}
+	return best
+}
+
+func moreSpecific(a, b *LicenseRule) bool {
+	aPath, aDomain, aExact := ruleSpecificity(a.Pattern)
+	bPath, bDomain, bExact := ruleSpecificity(b.Pattern)
+	switch {
+	case aPath != bPath:
+		return aPath > bPath
+	case aDomain != bDomain:
+		return aDomain > bDomain
+	case aExact != bExact:
+		return aExact
+	}
+	return a.Action == verdictBlock && b.Action != verdictBlock
+}
+
+// ruleResult returns the result for an image settled by rule.
+func ruleResult(uri string, rule *LicenseRule) *FilterResult {
+	res := &FilterResult{
+		ImageAnnotation: &ImageAnnotation{Hash: Hash(uri), URI: uri, DateAdded: time.Now()},
+		Status:          filterStatusOK,
+		Message:         fmt.Sprintf("matched rule %s", rule.Pattern),
+		Source:          verdictSourceRule,
+	}
+	setVerdict(res, rule.Action)
+	return res
+}
+
+// RuleReq is the form of an incoming JSON payload for adding a rule to a
+// license.
+type RuleReq struct {
+	Pattern string `json:"pattern"`
+	Action  string `json:"action"`
+}
+
+// licenseForRules returns the license of the id path parameter, or the
+// status and error to respond with.
+func licenseForRules(ctx appContext, req *http.Request) (*License, int, error) {
+	licenseID := mux.Vars(req)["id"]
+	if licenseID == "" {
+		return nil, http.StatusBadRequest, newAppError(codeBadRequest, "licenseID path parameter was empty")
+	}
+
+	license, err := ctx.licenseStore.GetLicenseByID(req.Context(), licenseID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("failed to get license: %s", err.Error())
+	}
+	if license == nil {
+		return nil, http.StatusNotFound, newAppError(codeNotFound, fmt.Sprintf("license %s not found", redactLicenseID(licenseID)))
+	}
+	return license, http.StatusOK, nil
+}
+
+func handleGetRules(ctx appContext, w http.ResponseWriter, req *http.Request) (int, error) {
+	license, status, err := licenseForRules(ctx, req)
+	if err != nil {
+		return status, err
+	}
+
+	rules, err := ctx.ruleStore.GetRules(req.Context(), license.ID)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to get rules: %v", err)
+	}
+	if rules == nil {
+		rules = []LicenseRule{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rules); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+func handlePutRule(ctx appContext, w http.ResponseWriter, req *http.Request) (int, error) {
+	var ruleReq RuleReq
+	if err := json.NewDecoder(req.Body).Decode(&ruleReq); err != nil {
+		return http.StatusBadRequest, newAppError(codeInvalidJSON, "JSON body missing or malformed")
+	}
+	if ruleReq.Action != verdictAllow && ruleReq.Action != verdictBlock {
+		return http.StatusBadRequest, newAppError(codeBadRequest, "action must be \"allow\" or \"block\"")
+	}
+	pattern, err := normalizeRulePattern(ruleReq.Pattern)
+	if err != nil {
+		return http.StatusBadRequest, newAppError(codeBadRequest, err.Error())
+	}
+
+	license, status, err := licenseForRules(ctx, req)
+	if err != nil {
+		return status, err
+	}
+
+	rules, err := ctx.ruleStore.GetRules(req.Context(), license.ID)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to get rules: %v", err)
+	}
+	exists := false
+	for _, rule := range rules {
+		exists = exists || rule.Pattern == pattern
+	}
+	if !exists && len(rules) >= maxRulesPerLicense {
+		return http.StatusBadRequest, newAppError(codeBadRequest, fmt.Sprintf("a license can have at most %d rules", maxRulesPerLicense))
+	}
+
+	rule := &LicenseRule{LicenseID: license.ID, Pattern: pattern, Action: ruleReq.Action}
+	if err := ctx.ruleStore.PutRule(req.Context(), rule); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to save rule: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rule); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+func handleDeleteRule(ctx appContext, w http.ResponseWriter, req *http.Request) (int, error) {
+	id, err := strconv.ParseInt(mux.Vars(req)["ruleID"], 10, 64)
+	if err != nil {
+		return http.StatusBadRequest, newAppError(codeBadRequest, "rule ID must be an integer")
+	}
+
+	license, status, err := licenseForRules(ctx, req)
+	if err != nil {
+		return status, err
+	}
+
+	found, err := ctx.ruleStore.DeleteRule(req.Context(), license.ID, id)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to delete rule: %v", err)
+	}
+	if !found {
+		return http.StatusNotFound, newAppError(codeNotFound, fmt.Sprintf("rule %d not found", id))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, nil
+}
@@ -0,0 +1,297 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+// fakeRuleStore is an in memory RuleStorer for tests that don't need a
+// database.
+type fakeRuleStore struct {
+	rules  []LicenseRule
+	nextID int64
+}
+
+func (store *fakeRuleStore) GetRules(ctx context.Context, licenseID string) ([]LicenseRule, error) {
+	var res []LicenseRule
+	for _, rule := range store.rules {
+		if rule.LicenseID == licenseID {
+			res = append(res, rule)
+		}
+	}
+	return res, nil
+}
+
+func (store *fakeRuleStore) PutRule(ctx context.Context, rule *LicenseRule) error {
+	for i, existing := range store.rules {
+		if existing.LicenseID == rule.LicenseID && existing.Pattern == rule.Pattern {
+			store.rules[i].Action = rule.Action
+			rule.ID = existing.ID
+			return nil
+		}
+	}
+	store.nextID++
+	rule.ID = store.nextID
+	store.rules = append(store.rules, *rule)
+	return nil
+}
+
+func (store *fakeRuleStore) DeleteRule(ctx context.Context, licenseID string, id int64) (bool, error) {
+	for i, rule := range store.rules {
+		if rule.LicenseID == licenseID && rule.ID == id {
+			store.rules = append(store.rules[:i], store.rules[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func TestNormalizeRulePattern(t *testing.T) {
+	tests := map[string]string{
+		"Example.com":                          "example.com",
+		"*.CDN.example.com":                    "*.cdn.example.com",
+		"https://Example.com/Avatars/":         "example.com/Avatars/",
+		"  img.example.com/a.jpg  ":            "img.example.com/a.jpg",
+		"http://*.example.com/images/uploads/": "*.example.com/images/uploads/",
+	}
+	for pattern, want := range tests {
+		got, err := normalizeRulePattern(pattern)
+		if err != nil {
+			t.Fatalf("expected %q to be valid but got %v", pattern, err)
+		}
+		if got != want {
+			t.Fatalf("expected %q to be normalized to %q but got %q", pattern, want, got)
+		}
+	}
+
+	for _, pattern := range []string{"", "*", "*.", "example..com", "a.*.example.com", "exa mple.com", "example.com:8080"} {
+		if _, err := normalizeRulePattern(pattern); err == nil {
+			t.Fatalf("expected %q to be rejected", pattern)
+		}
+	}
+}
+
+func TestMatchRule(t *testing.T) {
+	rules := []LicenseRule{
+		{Pattern: "*.example.com", Action: verdictBlock},
+		{Pattern: "cdn.example.com", Action: verdictAllow},
+		{Pattern: "cdn.example.com/private/", Action: verdictBlock},
+		{Pattern: "other.org", Action: verdictAllow},
+		{Pattern: "other.org", Action: verdictBlock},
+	}
+
+	tests := []struct {
+		uri     string
+		pattern string
+		action  string
+	}{
+		{"https://example.com/a.jpg", "*.example.com", verdictBlock},
+		{"https://img.Example.com/a.jpg", "*.example.com", verdictBlock},
+		{"https://cdn.example.com/a.jpg", "cdn.example.com", verdictAllow},
+		{"https://cdn.example.com:8443/private/a.jpg", "cdn.example.com/private/", verdictBlock},
+		{"https://other.org/a.jpg", "other.org", verdictBlock},
+		{"https://notexample.com/a.jpg", "", ""},
+		{"https://example.com.evil.net/a.jpg", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.uri, func(t *testing.T) {
+			rule := matchRule(rules, test.uri)
+			if test.pattern == "" {
+				if rule != nil {
+					t.Fatalf("expected no rule but got %+v", rule)
+				}
+				return
+			}
+			if rule == nil || rule.Pattern != test.pattern || rule.Action != test.action {
+				t.Fatalf("expected %s to %s but got %+v", test.pattern, test.action, rule)
+			}
+		})
+	}
+}
+
+func TestBatchFilterRules(t *testing.T) {
+	rules := &fakeRuleStore{}
+	ctx := appContext{
+		logger:       zerolog.Nop(),
+		licenseStore: newFakeLicenseStore(&License{ID: testLicenseID, IsValid: true}),
+		ruleStore:    newCachedRuleStore(rules, time.Minute),
+		rateLimiter:  NewMemoryRateLimitStore(),
+		config:       Config{IPRateLimit: RateLimit{Rate: 1, Burst: 100}},
+	}
+	router := newRouter(ctx)
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("LicenseID", testLicenseID)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, body := range []string{`{"pattern": "cdn.example.com", "action": "allow"}`, `{"pattern": "*.ads.net", "action": "block"}`} {
+		if rec := serve("POST", "/v1/license/"+testLicenseID+"/rules", body); rec.Code != http.StatusOK {
+			t.Fatalf("expected the rule to be added but got %d: %s", rec.Code, rec.Body)
+		}
+	}
+
+	t.Run("settles matching images without classifying them", func(t *testing.T) {
+		before := ctx.licenseStore.(*fakeLicenseStore).licenses[testLicenseID].RequestCount
+
+		// The context has no classifier or database, so only rules can settle the images.
+		rec := serve("POST", "/v1/filter/batch", `{"imgURIList": ["https://cdn.example.com/a.jpg", "https://img.ads.net/b.jpg"]}`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200 but got %d: %s", rec.Code, rec.Body)
+		}
+		var res []FilterResult
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != 2 || res[0].Verdict != verdictAllow || res[1].Verdict != verdictBlock {
+			t.Fatalf("expected the rules' verdicts but got %+v", res)
+		}
+		for _, r := range res {
+			if r.Source != verdictSourceRule || r.Status != filterStatusOK {
+				t.Fatalf("expected an ok result from a rule but got %q, %q", r.Status, r.Source)
+			}
+		}
+		if res[1].Adult != int16(pb.Likelihood_VERY_LIKELY) {
+			t.Fatalf("expected the scores to carry the block verdict but got %d", res[1].Adult)
+		}
+
+		if after := ctx.licenseStore.(*fakeLicenseStore).licenses[testLicenseID].RequestCount; after != before {
+			t.Fatalf("expected no usage to be billed but got %d", after-before)
+		}
+	})
+
+	t.Run("manages rules", func(t *testing.T) {
+		if rec := serve("POST", "/v1/license/"+testLicenseID+"/rules", `{"pattern": "cdn.example.com", "action": "block"}`); rec.Code != http.StatusOK {
+			t.Fatalf("expected the rule to be updated but got %d", rec.Code)
+		}
+		rec := serve("GET", "/v1/license/"+testLicenseID+"/rules", "")
+		var got []LicenseRule
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 2 || got[0].Action != verdictBlock {
+			t.Fatalf("expected 2 rules with the first updated but got %+v", got)
+		}
+		rec = serve("POST", "/v1/filter/batch", `{"imgURIList": ["https://cdn.example.com/a.jpg"]}`)
+		var res []FilterResult
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != 1 || res[0].Verdict != verdictBlock {
+			t.Fatalf("expected the updated rule to apply at once but got %+v", res)
+		}
+
+		if rec := serve("DELETE", "/v1/license/"+testLicenseID+"/rules/1", ""); rec.Code != http.StatusNoContent {
+			t.Fatalf("expected the rule to be deleted but got %d", rec.Code)
+		}
+		if rec := serve("DELETE", "/v1/license/"+testLicenseID+"/rules/1", ""); rec.Code != http.StatusNotFound {
+			t.Fatalf("expected a missing rule but got %d", rec.Code)
+		}
+	})
+
+	t.Run("rejects bad rules", func(t *testing.T) {
+		for _, body := range []string{`{"pattern": "cdn.example.com", "action": "maybe"}`, `{"pattern": "not a domain", "action": "allow"}`} {
+			if rec := serve("POST", "/v1/license/"+testLicenseID+"/rules", body); rec.Code != http.StatusBadRequest {
+				t.Fatalf("expected %s to be rejected but got %d", body, rec.Code)
+			}
+		}
+		if rec := serve("POST", "/v1/license/missing/rules", `{"pattern": "a.com", "action": "allow"}`); rec.Code != http.StatusNotFound {
+			t.Fatalf("expected a missing license but got %d", rec.Code)
+		}
+	})
+
+	t.Run("limits license guesses by IP", func(t *testing.T) {
+		limited := ctx
+		limited.rateLimiter = NewMemoryRateLimitStore()
+		limited.config.IPRateLimit = RateLimit{Rate: 1, Burst: 1}
+		router := newRouter(limited)
+
+		codes := make([]int, 2)
+		for i := range codes {
+			req := httptest.NewRequest("DELETE", "/v1/license/missing/rules/1", nil)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			codes[i] = rec.Code
+		}
+		if codes[0] != http.StatusNotFound || codes[1] != http.StatusTooManyRequests {
+			t.Fatalf("expected the second guess to be rate limited but got %v", codes)
+		}
+	})
+
+	t.Run("answers preflight requests", func(t *testing.T) {
+		req := httptest.NewRequest("OPTIONS", "/v1/license/"+testLicenseID+"/rules", nil)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Header().Get("Access-Control-Allow-Methods"), "POST") {
+			t.Fatalf("expected the preflight to allow POST but got %d, %q", rec.Code, rec.Header().Get("Access-Control-Allow-Methods"))
+		}
+	})
+}
+
+// countingRuleStore counts the rule lookups that reach the store.
+type countingRuleStore struct {
+	fakeRuleStore
+	gets int
+}
+
+func (store *countingRuleStore) GetRules(ctx context.Context, licenseID string) ([]LicenseRule, error) {
+	store.gets++
+	return store.fakeRuleStore.GetRules(ctx, licenseID)
+}
+
+func TestCachedRuleStore(t *testing.T) {
+	backing := &countingRuleStore{}
+	store := newCachedRuleStore(backing, time.Minute).(*cachedRuleStore)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	get := func() []LicenseRule {
+		rules, err := store.GetRules(context.Background(), testLicenseID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rules
+	}
+
+	get()
+	get()
+	if backing.gets != 1 {
+		t.Fatalf("expected the second lookup to be cached but got %d lookups", backing.gets)
+	}
+
+	if err := store.PutRule(context.Background(), &LicenseRule{LicenseID: testLicenseID, Pattern: "a.com", Action: verdictBlock}); err != nil {
+		t.Fatal(err)
+	}
+	if rules := get(); len(rules) != 1 || backing.gets != 2 {
+		t.Fatalf("expected the new rule after a write but got %v after %d lookups", rules, backing.gets)
+	}
+
+	if _, err := store.DeleteRule(context.Background(), testLicenseID, 1); err != nil {
+		t.Fatal(err)
+	}
+	if rules := get(); len(rules) != 0 || backing.gets != 3 {
+		t.Fatalf("expected no rules after a delete but got %v after %d lookups", rules, backing.gets)
+	}
+
+	now = now.Add(time.Minute)
+	get()
+	if backing.gets != 4 {
+		t.Fatalf("expected the rules to be looked up again after the TTL but got %d lookups", backing.gets)
+	}
+
+	if _, ok := newCachedRuleStore(backing, 0).(*countingRuleStore); !ok {
+		t.Fatal("expected no cache without a TTL")
+	}
+}
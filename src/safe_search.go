@@ -2,39 +2,173 @@ package src
 
 import (
 	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"time"
 
 	vision "cloud.google.com/go/vision/apiv1"
+	"github.com/googleapis/gax-go/v2"
+	"google.golang.org/api/option"
 	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type BatchAnnotateResponse map[string]*pb.AnnotateImageResponse
 
-func batchAnnotateURIs(uris []string) (*pb.BatchAnnotateImagesResponse, error) {
-	ctx := context.Background()
-	client, err := vision.NewImageAnnotatorClient(ctx)
+// visionModelVersion is the SafeSearch model requested from Vision.
+const visionModelVersion = "builtin/stable"
+
+// imageAnnotator is the part of the Vision client used to classify images.
+type imageAnnotator interface {
+	BatchAnnotateImages(context.Context, *pb.BatchAnnotateImagesRequest, ...gax.CallOption) (*pb.BatchAnnotateImagesResponse, error)
+	Close() error
+}
+
+// visionClassifier classifies images with Google Cloud Vision SafeSearch.
+// It holds one client, and so one pool of gRPC connections, for the life of
+// the server and retries transient failures.
+type visionClassifier struct {
+	client      imageAnnotator
+	timeout     time.Duration
+	maxRetries  int
+	backoff     time.Duration
+	credentials func(context.Context) error
+}
+
+// NewVisionClassifier connects to Vision with the default Google credentials.
+func NewVisionClassifier(ctx context.Context, config Config) (*visionClassifier, error) {
+	client, err := vision.NewImageAnnotatorClient(ctx, option.WithGRPCConnectionPool(config.ClassifierConnPool))
 	if err != nil {
 		return nil, err
 	}
-	defer client.Close()
+	// Retries are done by the classifier, so they are bounded and count
+	// towards the circuit breaker.
+	client.CallOptions.BatchAnnotateImages = nil
+
+	vc := newVisionClassifier(client, config)
+	vc.credentials = checkVisionCredentials()
+	return vc, nil
+}
+
+func newVisionClassifier(client imageAnnotator, config Config) *visionClassifier {
+	return &visionClassifier{
+		client:     client,
+		timeout:    config.ClassifierTimeout,
+		maxRetries: config.ClassifierMaxRetries,
+		backoff:    config.ClassifierRetryBackoff,
+	}
+}
+
+// Classify returns the SafeSearch classifications of uris, in the same order.
+func (vc *visionClassifier) Classify(ctx context.Context, uris []string) ([]Classification, error) {
+	annotations, err := vc.batchAnnotateURIs(ctx, uris)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]Classification, len(annotations.Responses))
+	for i, annotation := range annotations.Responses {
+		res[i] = safeSearchClassification(annotation)
+	}
+	return res, nil
+}
+
+// Check checks that the Google credentials can be exchanged for a token.
+func (vc *visionClassifier) Check(ctx context.Context) error {
+	if vc.credentials == nil {
+		return nil
+	}
+	return vc.credentials(ctx)
+}
+
+// Close closes the connections to Vision.
+func (vc *visionClassifier) Close() error {
+	return vc.client.Close()
+}
 
+func (vc *visionClassifier) batchAnnotateURIs(ctx context.Context, uris []string) (*pb.BatchAnnotateImagesResponse, error) {
 	requests := make([]*pb.AnnotateImageRequest, 0, len(uris))
 	for _, uri := range uris {
 		requests = append(requests, &pb.AnnotateImageRequest{
 			Image: vision.NewImageFromURI(uri),
 			Features: []*pb.Feature{
-				{Type: pb.Feature_SAFE_SEARCH_DETECTION},
+				{Type: pb.Feature_SAFE_SEARCH_DETECTION, Model: visionModelVersion},
 			},
 		})
 	}
+	req := &pb.BatchAnnotateImagesRequest{Requests: requests}
+
+	for attempt := 0; ; attempt++ {
+		callCtx, cancel := withTimeout(ctx, vc.timeout)
+		res, err := vc.client.BatchAnnotateImages(callCtx, req)
+		cancel()
+
+		if err == nil || attempt >= vc.maxRetries || ctx.Err() != nil || !isTransient(err) {
+			return res, err
+		}
 
-	return client.BatchAnnotateImages(ctx, &pb.BatchAnnotateImagesRequest{Requests: requests})
+		select {
+		case <-time.After(retryDelay(vc.backoff, attempt)):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
 }
 
-// GetImgSSas returns the SafeSearchAnnotations and any associated errors given uris, and an optional application error.
-func GetURIAnnotations(uris []string) ([]*pb.AnnotateImageResponse, error) {
-	annotations, err := batchAnnotateURIs(uris)
-	if err != nil {
-		return nil, err
+// safeSearchClassification converts a Vision response, which already uses
+// the likelihood scale.
+func safeSearchClassification(annotation *pb.AnnotateImageResponse) Classification {
+	res := Classification{ModelVersion: visionModelVersion}
+	if annotation == nil {
+		res.Error, res.ErrorKind = "no annotation returned", errorKindProviderError
+		return res
+	}
+	if annotation.Error != nil {
+		res.Error = annotation.Error.Message
+		res.ErrorKind = visionErrorKind(annotation.Error)
+	}
+	if ssa := annotation.SafeSearchAnnotation; ssa != nil {
+		res.Adult = int16(ssa.Adult)
+		res.Spoof = int16(ssa.Spoof)
+		res.Medical = int16(ssa.Medical)
+		res.Violence = int16(ssa.Violence)
+		res.Racy = int16(ssa.Racy)
 	}
-	return annotations.Responses, nil
+	return res
+}
+
+// visionErrorKind classifies the error Vision returned for one image. Vision
+// reports images it can't download and images it can't decode with the same
+// codes as other errors, so they are told apart by message.
+func visionErrorKind(st *rpcstatus.Status) string {
+	msg := strings.ToLower(st.Message)
+	switch {
+	case strings.Contains(msg, "access the url"), strings.Contains(msg, "download"), strings.Contains(msg, "fetch"):
+		return errorKindFetchFailed
+	case codes.Code(st.Code) == codes.InvalidArgument && strings.Contains(msg, "image"):
+		return errorKindUnsupportedFormat
+	}
+	return errorKindProviderError
+}
+
+// isTransient reports whether a failed Vision call may succeed if retried.
+func isTransient(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// retryDelay returns the exponential backoff before retry attempt+1, with
+// jitter so that callers failing together don't retry together.
+func retryDelay(base time.Duration, attempt int) time.Duration {
+	d := base << attempt
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
 }
@@ -0,0 +1,146 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/googleapis/gax-go/v2"
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeAnnotator fails with errs in order, then succeeds.
+type fakeAnnotator struct {
+	errs  []error
+	calls int
+	delay time.Duration
+}
+
+func (fa *fakeAnnotator) BatchAnnotateImages(ctx context.Context, req *pb.BatchAnnotateImagesRequest, opts ...gax.CallOption) (*pb.BatchAnnotateImagesResponse, error) {
+	fa.calls++
+	if fa.delay > 0 {
+		select {
+		case <-time.After(fa.delay):
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	if len(fa.errs) > 0 {
+		err := fa.errs[0]
+		fa.errs = fa.errs[1:]
+		return nil, err
+	}
+
+	res := &pb.BatchAnnotateImagesResponse{}
+	for range req.Requests {
+		res.Responses = append(res.Responses, &pb.AnnotateImageResponse{SafeSearchAnnotation: &pb.SafeSearchAnnotation{Adult: pb.Likelihood_VERY_UNLIKELY}})
+	}
+	return res, nil
+}
+
+func (fa *fakeAnnotator) Close() error { return nil }
+
+func TestVisionClassifier(t *testing.T) {
+	config := Config{
+		ClassifierTimeout:          50 * time.Millisecond,
+		ClassifierMaxRetries:       2,
+		ClassifierRetryBackoff:     time.Millisecond,
+		ClassifierBreakerThreshold: 2,
+		ClassifierBreakerCooldown:  time.Minute,
+	}
+	uris := []string{"https://example.com/a.jpg", "https://example.com/b.jpg"}
+
+	t.Run("retries transient errors", func(t *testing.T) {
+		client := &fakeAnnotator{errs: []error{
+			status.Error(codes.Unavailable, "unavailable"),
+			status.Error(codes.ResourceExhausted, "quota"),
+		}}
+		res, err := newVisionClassifier(client, config).Classify(context.Background(), uris)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != len(uris) || client.calls != 3 {
+			t.Fatalf("expected %d annotations after 3 calls but got %d after %d", len(uris), len(res), client.calls)
+		}
+	})
+
+	t.Run("does not retry permanent errors", func(t *testing.T) {
+		client := &fakeAnnotator{errs: []error{status.Error(codes.InvalidArgument, "bad request")}}
+		if _, err := newVisionClassifier(client, config).Classify(context.Background(), uris); err == nil {
+			t.Fatal("expected an error")
+		}
+		if client.calls != 1 {
+			t.Fatalf("expected 1 call but got %d", client.calls)
+		}
+	})
+
+	t.Run("times out each call", func(t *testing.T) {
+		client := &fakeAnnotator{delay: time.Second}
+		start := time.Now()
+		_, err := newVisionClassifier(client, config).Classify(context.Background(), uris)
+		if status.Code(err) != codes.DeadlineExceeded {
+			t.Fatalf("expected deadline exceeded but got %v", err)
+		}
+		if client.calls != 3 || time.Since(start) > 500*time.Millisecond {
+			t.Fatalf("expected 3 timed out calls but got %d in %s", client.calls, time.Since(start))
+		}
+	})
+
+	t.Run("fails fast once the breaker opens", func(t *testing.T) {
+		unavailable := status.Error(codes.Unavailable, "unavailable")
+		client := &fakeAnnotator{errs: []error{unavailable, unavailable, unavailable, unavailable, unavailable, unavailable}}
+		vc := guardClassifier("google", newVisionClassifier(client, config), config)
+
+		for i := 0; i < 2; i++ {
+			if _, err := vc.Classify(context.Background(), uris); err == nil || errors.Is(err, ErrCircuitOpen) {
+				t.Fatalf("expected the provider error but got %v", err)
+			}
+		}
+		calls := client.calls
+		if _, err := vc.Classify(context.Background(), uris); !errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("expected open circuit but got %v", err)
+		}
+		if client.calls != calls {
+			t.Fatal("expected no call to the provider while the breaker is open")
+		}
+	})
+
+	t.Run("stops on cancellation without tripping the breaker", func(t *testing.T) {
+		client := &fakeAnnotator{delay: time.Second}
+		config := Config{ClassifierMaxRetries: 2, ClassifierBreakerThreshold: 1, ClassifierBreakerCooldown: time.Minute}
+		vc := guardClassifier("google", newVisionClassifier(client, config), config)
+
+		c, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if _, err := vc.Classify(c, uris); err == nil {
+			t.Fatal("expected an error")
+		}
+		if client.calls != 1 {
+			t.Fatalf("expected 1 call but got %d", client.calls)
+		}
+		if vc.breaker.State() != breakerClosed {
+			t.Fatalf("expected breaker to stay closed but got %s", vc.breaker.State())
+		}
+	})
+}
+
+func TestVisionErrorKind(t *testing.T) {
+	tests := []struct {
+		code codes.Code
+		msg  string
+		want string
+	}{
+		{codes.InvalidArgument, "We can not access the URL currently. Please download the content and pass it in.", errorKindFetchFailed},
+		{codes.InvalidArgument, "Bad image data.", errorKindUnsupportedFormat},
+		{codes.Internal, "Internal server error.", errorKindProviderError},
+	}
+	for _, test := range tests {
+		if got := visionErrorKind(&rpcstatus.Status{Code: int32(test.code), Message: test.msg}); got != test.want {
+			t.Errorf("%q: expected %s but got %s", test.msg, test.want, got)
+		}
+	}
+}
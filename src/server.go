@@ -1,11 +1,17 @@
 package src
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/go-pg/pg/v10"
 	"github.com/gorilla/mux"
@@ -19,6 +25,9 @@ type AnnotateReq struct {
 	ImgURIList []string `json:"imgURIList"`
 }
 
+// AnnotationStore caches annotations in place of the database when set, such
+// as to run the filter without Postgres. GetAnnotations returns the cached
+// annotations of the URIs.
 type AnnotationStore interface {
 	GetAnnotations([]string) ([]*ImageAnnotation, error)
 	PutAnnotations([]*ImageAnnotation) error
@@ -29,7 +38,15 @@ type appContext struct {
 	db              pg.DB
 	logger          zerolog.Logger
 	licenseStore    LicenseStorer
+	ruleStore       RuleStorer
 	annotationStore AnnotationStore
+	classifier      Classifier
+	revalidator     *cacheRevalidator
+	lru             *annotationLRU
+	flights         *classifyFlights
+	rateLimiter     RateLimitStore
+	workers         *workerGroup
+	healthChecks    []healthCheck
 	config          Config
 }
 
@@ -41,21 +58,19 @@ type appHandler struct {
 // Our ServeHTTP method is mostly the same, and also has the ability to
 // access our *appContext's fields (templates, loggers, etc.) as well.
 func (ah appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Handlers log through the request logger so their lines carry the request ID.
+	ctx := ah.appContext
+	ctx.logger = loggerFromContext(r.Context(), ctx.logger)
+
 	// Updated to pass ah.appContext as a parameter to our handler type.
-	status, err := ah.H(ah.appContext, w, r)
+	status, err := ah.H(ctx, w, r)
 	if err != nil {
-		ah.appContext.logger.Printf("HTTP %d: %q", status, err)
-		switch status {
-		case http.StatusNotFound:
-			http.NotFound(w, r)
-			// And if we wanted a friendlier error page, we can
-			// now leverage our context instance - e.g.
-			// err := ah.renderTemplate(w, "http_404.tmpl", nil)
-		case http.StatusInternalServerError:
-			http.Error(w, http.StatusText(status), status)
-		default:
-			http.Error(w, http.StatusText(status), status)
+		if status >= http.StatusInternalServerError {
+			ctx.logger.Error().Int("status", status).Err(err).Msg("request failed")
+		} else {
+			ctx.logger.Info().Int("status", status).Err(err).Msg("request rejected")
 		}
+		writeError(w, r, status, err)
 	}
 }
 
@@ -69,19 +84,43 @@ func InitServer() {
 	}
 	zerolog.SetGlobalLevel(zerolog.Level(zerolog.ErrorLevel))
 
+	logger, err := newLogger(config.LogFormat, os.Stderr)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	// Code without a request or app context, such as the database hook
+	// outside of requests, logs through the global logger.
+	log.Logger = logger
+
 	conn, err := InitDB(config)
 	if err != nil {
 		log.Fatal().Msg(err.Error())
 	}
-	defer conn.Close()
+
+	classifier, err := NewClassifier(context.Background(), config)
+	if err != nil {
+		conn.Close()
+		log.Fatal().Msg(err.Error())
+	}
 
 	ctx := appContext{
 		db:              *conn,
-		logger:          zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr, NoColor: true}).With().Timestamp().Logger(),
-		licenseStore:    NewLicenseStore(conn),
+		logger:          logger,
+		licenseStore:    NewLicenseStore(conn, config.DBTimeout),
+		ruleStore:       newCachedRuleStore(NewRuleStore(conn, config.DBTimeout), config.RuleCacheTTL),
 		annotationStore: nil,
+		classifier:      classifier,
+		revalidator:     newCacheRevalidator(config),
+		lru:             newAnnotationLRU(config.CacheLRUSize, config.CacheLRUTTL),
+		flights:         newClassifyFlights(config.CoalescedBilling),
+		rateLimiter:     NewMemoryRateLimitStore(),
+		workers:         newWorkerGroup(),
 		config:          config,
 	}
+	if config.RateLimitBackend == "postgres" {
+		ctx.rateLimiter = NewPGRateLimitStore(conn, config.DBTimeout)
+	}
+	ctx.healthChecks = newHealthChecks(ctx, conn)
 
 	flag.IntVar(&portFlag, "port", 8080, "port to run the service on")
 	flag.Parse()
@@ -92,22 +131,178 @@ func InitServer() {
 	}
 	zerolog.SetGlobalLevel(zerolog.Level(logLevel))
 
+	listenAddr := ""
+	listenAddr = fmt.Sprintf("%s:%d", listenAddr, portFlag)
+
+	srv := &http.Server{
+		Addr:              listenAddr,
+		Handler:           newRouter(ctx),
+		ReadTimeout:       config.ReadTimeout,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+
+	srv.TLSConfig, err = newTLSConfig(config, ctx.logger)
+	if err != nil {
+		conn.Close()
+		ctx.logger.Fatal().Msg(err.Error())
+	}
+
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		conn.Close()
+		ctx.logger.Fatal().Msg(err.Error())
+	}
+
+	shutdownTracing, err := initTracing(config)
+	if err != nil {
+		conn.Close()
+		ctx.logger.Fatal().Msg(err.Error())
+	}
+
+	if config.MetricsAddr != "" {
+		metricsSrv := newMetricsServer(config)
+		metricsL, err := net.Listen("tcp", config.MetricsAddr)
+		if err != nil {
+			conn.Close()
+			ctx.logger.Fatal().Msg(err.Error())
+		}
+		go func() {
+			if err := metricsSrv.Serve(metricsL); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				ctx.logger.Error().Msgf("metrics server failed: %v", err)
+			}
+		}()
+		defer metricsSrv.Close()
+		ctx.logger.Info().Msgf("Metrics now served on %s", config.MetricsAddr)
+	}
+
+	stopCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if srv.TLSConfig != nil {
+		ctx.logger.Info().Msgf("Web server now listening on %s with TLS", listenAddr)
+	} else {
+		ctx.logger.Info().Msgf("Web server now listening on %s", listenAddr)
+	}
+	err = serve(ctx, srv, l, stopCtx.Done())
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if flushErr := shutdownTracing(flushCtx); flushErr != nil {
+		ctx.logger.Error().Msgf("failed to flush traces: %v", flushErr)
+	}
+
+	if closeErr := classifier.Close(); closeErr != nil {
+		ctx.logger.Error().Msgf("failed to close classifier: %v", closeErr)
+	}
+	if closeErr := conn.Close(); closeErr != nil {
+		ctx.logger.Error().Msgf("failed to close database: %v", closeErr)
+	}
+	if err != nil {
+		ctx.logger.Fatal().Msg(err.Error())
+	}
+	ctx.logger.Info().Msg("Web server stopped")
+}
+
+// serve runs srv on l until stop is closed, then shuts it down gracefully:
+// it reports unready for the shutdown delay, stops accepting connections and
+// waits for in-flight requests and background workers to finish, giving up
+// after the shutdown timeout. Work still running then is cancelled through
+// the request contexts.
+func serve(ctx appContext, srv *http.Server, l net.Listener, stop <-chan struct{}) error {
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	srv.BaseContext = func(net.Listener) context.Context { return baseCtx }
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			// The certificate comes from TLSConfig.GetCertificate.
+			serveErr <- srv.ServeTLS(l, "", "")
+		} else {
+			serveErr <- srv.Serve(l)
+		}
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-stop:
+	}
+
+	// Report unready while still serving, so load balancers see it and stop
+	// routing here before new connections are refused.
+	ctx.workers.Drain()
+	if ctx.config.ShutdownDelay > 0 {
+		ctx.logger.Info().Msgf("reporting unready for %s before shutting down", ctx.config.ShutdownDelay)
+		time.Sleep(ctx.config.ShutdownDelay)
+	}
+	ctx.logger.Info().Msgf("shutting down, waiting up to %s for in-flight work", ctx.config.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), ctx.config.ShutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to drain in-flight requests: %v", err)
+	}
+	if err := ctx.workers.Wait(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to drain background workers: %v", err)
+	}
+
+	return nil
+}
+
+// newRouter returns the router for all HTTP routes. The public API lives
+// under /v1; the unversioned routes are kept for extension releases that
+// predate it and are marked deprecated.
+func newRouter(ctx appContext) *mux.Router {
 	r := mux.NewRouter()
+	r.Use(tracingMiddleware, requestLoggingMiddleware(ctx), metricsMiddleware, addCorsHeaders)
 
-	r.Use(addCorsHeaders)
+	// mux skips middleware for requests that match no route, so the fallback
+	// handlers are wrapped to get their access log line, span and metrics.
+	unmatched := func(status int) http.Handler {
+		return tracingMiddleware(requestLoggingMiddleware(ctx)(metricsMiddleware(statusHandler(status))))
+	}
+	r.NotFoundHandler = unmatched(http.StatusNotFound)
+	r.MethodNotAllowedHandler = unmatched(http.StatusMethodNotAllowed)
 	r.Handle("/", http.FileServer(http.Dir("./"))).Methods("GET")
+	r.Handle("/healthz", &appHandler{ctx, handleLiveness}).Methods("GET")
+	r.Handle("/readyz", &appHandler{ctx, handleReadiness}).Methods("GET")
+
+	v1 := r.PathPrefix("/v1").Subrouter()
+	v1.Handle("/openapi.json", &appHandler{ctx, handleOpenAPI}).Methods("GET", "OPTIONS")
+	registerRoutes(ctx, v1)
+	registerAdminRoutes(ctx, v1)
+
+	legacy := r.NewRoute().Subrouter()
+	legacy.Use(deprecatedMiddleware)
+	registerRoutes(ctx, legacy)
+
+	return r
+}
+
+// registerRoutes registers the public API routes on r.
+func registerRoutes(ctx appContext, r *mux.Router) {
+	ipRateLimit := ipRateLimitMiddleware(ctx)
+
 	r.Handle("/health", &appHandler{ctx, handleHealth}).Methods("GET", "OPTIONS")
-	r.Handle("/license/{id}", &appHandler{ctx, handleGetLicense}).Methods("GET", "OPTIONS")
+	r.Handle("/license/{id}", ipRateLimit(&appHandler{ctx, handleGetLicense})).Methods("GET", "OPTIONS")
+	// Caps can raise what a license is billed, so only admins may change them.
+	r.Handle("/license/{id}/caps", ipRateLimit(adminMiddleware(ctx)(&appHandler{ctx, handleUpdateSpendingCaps}))).Methods("PUT", "OPTIONS")
+	r.Handle("/license/{id}/rules", ipRateLimit(&appHandler{ctx, handleGetRules})).Methods("GET", "OPTIONS")
+	// Rules are managed by the license holder, authorized by the license ID
+	// like the license itself.
+	r.Handle("/license/{id}/rules", ipRateLimit(&appHandler{ctx, handlePutRule})).Methods("POST", "OPTIONS")
+	r.Handle("/license/{id}/rules/{ruleID}", ipRateLimit(&appHandler{ctx, handleDeleteRule})).Methods("DELETE", "OPTIONS")
 	r.Handle("/webhook", &appHandler{ctx, handleWebhook}).Methods("POST")
 	// r.HandleFunc("/trial-register", handleTrialRegister).Methods("POST", "OPTIONS")
 
 	// Paywalled filter routes.
 	filterR := r.PathPrefix("/filter").Subrouter()
-	filterR.Use(paywallMiddleware(ctx))
+	// The IP limit throttles guessing license IDs before each guess costs a
+	// license lookup; the license limit applies once the license resolved.
+	filterR.Use(ipRateLimit, paywallMiddleware(ctx), licenseRateLimitMiddleware(ctx))
 	filterR.Handle("/batch", &appHandler{ctx, handleBatchFilter}).Methods("POST", "OPTIONS")
-
-	listenAddr := ""
-	listenAddr = fmt.Sprintf("%s:%d", listenAddr, portFlag)
-	ctx.logger.Info().Msgf("Web server now listening on %s", listenAddr)
-	ctx.logger.Fatal().Msg(http.ListenAndServe(listenAddr, r).Error())
+	filterR.Handle("/report", &appHandler{ctx, handleReportMisclassification}).Methods("POST", "OPTIONS")
 }
@@ -2,14 +2,18 @@ package src
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -218,6 +222,35 @@ func TestFilterEndpoint(t *testing.T) {
 					},
 				},
 			},
+			{
+				Given: []string{
+					"not a uri",
+					"https://i.imgur.com/FEpwOY8.jpg",
+				},
+				Expect: FilterTestExpect{
+					Code:  200,
+					Error: nil,
+					Res: []*ImageAnnotation{
+						{
+							Hash:      Hash("not a uri"),
+							URI:       "not a uri",
+							Error:     sql.NullString{String: "not a uri is not a valid URI", Valid: true},
+							DateAdded: time.Now(),
+						},
+						{
+							Hash:      "87408bebb6a1d42cd7cc1bbffb6d7dcc6aff14af4aea5c9af9fc5b624cf7c93a",
+							URI:       "https://i.imgur.com/FEpwOY8.jpg",
+							Error:     sql.NullString{},
+							DateAdded: time.Now(),
+							Adult:     2,
+							Spoof:     1,
+							Medical:   2,
+							Violence:  3,
+							Racy:      5,
+						},
+					},
+				},
+			},
 		}
 
 		for _, test := range tests {
@@ -270,6 +303,225 @@ func TestFilterEndpoint(t *testing.T) {
 
 }
 
+func TestGracefulShutdown(t *testing.T) {
+	startServer := func(t *testing.T, ctx appContext, h http.Handler) (string, chan struct{}, chan error) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stop := make(chan struct{})
+		done := make(chan error, 1)
+		go func() {
+			done <- serve(ctx, &http.Server{Handler: h}, l, stop)
+		}()
+		return "http://" + l.Addr().String(), stop, done
+	}
+
+	t.Run("drains in-flight requests and workers", func(t *testing.T) {
+		ctx := appContext{
+			logger:  zerolog.Nop(),
+			workers: newWorkerGroup(),
+			config:  Config{ShutdownTimeout: 5 * time.Second},
+		}
+
+		var workerDone atomic.Bool
+		started := make(chan struct{})
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx.workers.Go(func() {
+				time.Sleep(100 * time.Millisecond)
+				workerDone.Store(true)
+			})
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+			_, _ = w.Write([]byte("done"))
+		})
+
+		addr, stop, done := startServer(t, ctx, h)
+
+		type result struct {
+			body string
+			err  error
+		}
+		resCh := make(chan result, 1)
+		go func() {
+			res, err := http.Get(addr)
+			if err != nil {
+				resCh <- result{err: err}
+				return
+			}
+			defer res.Body.Close()
+			b, err := io.ReadAll(res.Body)
+			resCh <- result{body: string(b), err: err}
+		}()
+
+		<-started
+		close(stop)
+
+		res := <-resCh
+		if res.err != nil || res.body != "done" {
+			t.Fatalf("expected in-flight request to complete, got %q, %v", res.body, res.err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("expected clean shutdown but got: %v", err)
+		}
+		if !workerDone.Load() {
+			t.Error("expected background worker to finish before shutdown returned")
+		}
+	})
+
+	t.Run("is unready while draining in-flight requests", func(t *testing.T) {
+		ctx := appContext{
+			logger:  zerolog.Nop(),
+			workers: newWorkerGroup(),
+			config:  Config{ShutdownTimeout: 5 * time.Second},
+		}
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		})
+
+		addr, stop, done := startServer(t, ctx, h)
+		go func() {
+			if res, err := http.Get(addr); err == nil {
+				res.Body.Close()
+			}
+		}()
+
+		<-started
+		close(stop)
+
+		deadline := time.Now().Add(time.Second)
+		for ctx.workers.Check(context.Background()) == nil {
+			if time.Now().After(deadline) {
+				close(release)
+				t.Fatal("expected the workers to be unready while the request is in flight")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+		if err := <-done; err != nil {
+			t.Fatalf("expected clean shutdown but got: %v", err)
+		}
+	})
+
+	t.Run("accepts connections while unready for the shutdown delay", func(t *testing.T) {
+		ctx := appContext{
+			logger:  zerolog.Nop(),
+			workers: newWorkerGroup(),
+			config:  Config{ShutdownTimeout: 5 * time.Second, ShutdownDelay: 200 * time.Millisecond},
+		}
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("done"))
+		})
+
+		addr, stop, done := startServer(t, ctx, h)
+		close(stop)
+
+		deadline := time.Now().Add(time.Second)
+		for ctx.workers.Check(context.Background()) == nil {
+			if time.Now().After(deadline) {
+				t.Fatal("expected the workers to be unready once stopped")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		res, err := client.Get(addr)
+		if err != nil {
+			t.Fatalf("expected a new connection to be served during the shutdown delay but got %v", err)
+		}
+		res.Body.Close()
+		if err := <-done; err != nil {
+			t.Fatalf("expected clean shutdown but got: %v", err)
+		}
+	})
+
+	t.Run("gives up after the shutdown timeout", func(t *testing.T) {
+		ctx := appContext{
+			logger: zerolog.Nop(),
+			config: Config{ShutdownTimeout: 50 * time.Millisecond},
+		}
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		})
+		t.Cleanup(func() { close(release) })
+
+		addr, stop, done := startServer(t, ctx, h)
+		go func() {
+			if res, err := http.Get(addr); err == nil {
+				res.Body.Close()
+			}
+		}()
+
+		<-started
+		close(stop)
+
+		if err := <-done; err == nil {
+			t.Fatal("expected shutdown to time out")
+		}
+	})
+
+	t.Run("cancels requests still running after the timeout", func(t *testing.T) {
+		ctx := appContext{
+			logger: zerolog.Nop(),
+			config: Config{ShutdownTimeout: 50 * time.Millisecond},
+		}
+
+		started := make(chan struct{})
+		cancelled := make(chan struct{})
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-r.Context().Done()
+			close(cancelled)
+		})
+
+		addr, stop, done := startServer(t, ctx, h)
+		go func() {
+			if res, err := http.Get(addr); err == nil {
+				res.Body.Close()
+			}
+		}()
+
+		<-started
+		close(stop)
+		<-done
+
+		select {
+		case <-cancelled:
+		case <-time.After(time.Second):
+			t.Fatal("expected the request context to be cancelled")
+		}
+	})
+}
+
+func TestBatchFilterCancelled(t *testing.T) {
+	ctx := appContext{
+		logger:       zerolog.Nop(),
+		licenseStore: newFakeLicenseStore(&License{ID: testLicenseID, IsValid: true}),
+		ruleStore:    &fakeRuleStore{},
+	}
+
+	// The handler gets the license from paywallMiddleware.
+	c, cancel := context.WithCancel(context.WithValue(context.Background(), licenseCtxKey, &License{ID: testLicenseID, IsValid: true}))
+	cancel()
+
+	b, _ := json.Marshal(AnnotateReq{ImgURIList: []string{"https://example.com/a.jpg"}})
+	req := httptest.NewRequest("POST", "/v1/filter/batch", bytes.NewReader(b)).WithContext(c)
+	req.Header.Set("LicenseID", testLicenseID)
+
+	status, err := handleBatchFilter(ctx, httptest.NewRecorder(), req)
+	if status != http.StatusServiceUnavailable || !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected 503 for a cancelled request but got %d, %v", status, err)
+	}
+}
+
 func testFilterHandler(ctx appContext, fr *AnnotateReq) (*httptest.ResponseRecorder, int, error) {
 	b, err := json.Marshal(fr)
 	if err != nil {
@@ -282,6 +534,11 @@ func testFilterHandler(ctx appContext, fr *AnnotateReq) (*httptest.ResponseRecor
 	if err != nil {
 		return nil, -1, errors.New("Failed to create test HTTP request")
 	}
+	license, err := ctx.licenseStore.GetLicenseByID(req.Context(), testLicenseID)
+	if err != nil {
+		return nil, -1, err
+	}
+	req = req.WithContext(context.WithValue(req.Context(), licenseCtxKey, license))
 
 	rr := httptest.NewRecorder()
 
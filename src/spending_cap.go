@@ -0,0 +1,170 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ErrHardCapReached is returned by filterImages when a license has used up its
+// monthly hard cap. Any cached results are still returned alongside it.
+var ErrHardCapReached = errors.New("monthly spending cap reached")
+
+const (
+	spendingCapHeader      = "X-Spending-Cap"
+	spendingCapUsageHeader = "X-Spending-Cap-Usage"
+)
+
+// SpendingCapsReq is the form of an incoming JSON payload for updating
+// the monthly spending caps of a license.
+type SpendingCapsReq struct {
+	SoftCap int `json:"softCap"`
+	HardCap int `json:"hardCap"`
+}
+
+// calendarPeriod returns the calendar month containing t. It is the billing
+// period for licenses that have no Stripe subscription.
+func calendarPeriod(t time.Time) (time.Time, time.Time) {
+	t = t.UTC()
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 1, 0)
+}
+
+// setBillingPeriod moves the license to the billing period [start, end),
+// resetting its period usage if the period changed. It reports whether it did.
+func setBillingPeriod(license *License, start time.Time, end time.Time) bool {
+	if license.PeriodStart.Equal(start) && license.PeriodEnd.Equal(end) {
+		return false
+	}
+	license.PeriodStart = start
+	license.PeriodEnd = end
+	license.PeriodUsage = 0
+	license.SoftCapNotified = false
+	return true
+}
+
+// rolloverBillingPeriod starts a new billing period for the license if the
+// current one has ended, and reports whether it did. The period is taken from
+// the Stripe subscription when there is one, and the calendar month otherwise.
+func rolloverBillingPeriod(ctx appContext, license *License, now time.Time) bool {
+	if !license.PeriodEnd.IsZero() && now.Before(license.PeriodEnd) {
+		return false
+	}
+
+	start, end := calendarPeriod(now)
+	if license.SubscriptionID != "" {
+		sub, err := fetchStripeSubscription(ctx.config.StripeKey, license)
+		if err != nil {
+			ctx.logger.Error().Msgf("failed to fetch billing period for license %s, using calendar month: %s", redactLicenseID(license.ID), err)
+		} else if sub.CurrentPeriodEnd > now.Unix() {
+			start = time.Unix(sub.CurrentPeriodStart, 0).UTC()
+			end = time.Unix(sub.CurrentPeriodEnd, 0).UTC()
+		}
+	}
+
+	return setBillingPeriod(license, start, end)
+}
+
+// hardCapAllowance returns how many of n images the license may still
+// classify in the current billing period.
+func hardCapAllowance(license *License, n int) int {
+	if license.HardCap <= 0 {
+		return n
+	}
+	remaining := license.HardCap - license.PeriodUsage
+	if remaining <= 0 {
+		return 0
+	}
+	if remaining < n {
+		return remaining
+	}
+	return n
+}
+
+func softCapReached(license *License) bool {
+	return license.SoftCap > 0 && license.PeriodUsage >= license.SoftCap
+}
+
+func hardCapReached(license *License) bool {
+	return license.HardCap > 0 && license.PeriodUsage >= license.HardCap
+}
+
+// notifySoftCap emails the license owner the first time the soft cap is
+// reached in a billing period, and reports whether it did.
+func notifySoftCap(ctx appContext, license *License) bool {
+	if !softCapReached(license) || license.SoftCapNotified {
+		return false
+	}
+
+	if err := SendSoftCapMail(ctx.config, license.Email, license.PeriodUsage, license.SoftCap); err != nil {
+		ctx.logger.Error().Msgf("failed to send soft cap warning for license %s: %s", redactLicenseID(license.ID), err)
+		return false
+	}
+	license.SoftCapNotified = true
+	return true
+}
+
+// setSpendingCapHeaders tells the client which spending cap, if any, the
+// license has reached.
+func setSpendingCapHeaders(w http.ResponseWriter, license *License) {
+	switch {
+	case hardCapReached(license):
+		w.Header().Set(spendingCapHeader, "hard")
+	case softCapReached(license):
+		w.Header().Set(spendingCapHeader, "soft")
+	default:
+		return
+	}
+
+	limit := license.HardCap
+	if limit <= 0 {
+		limit = license.SoftCap
+	}
+	w.Header().Set(spendingCapUsageHeader, fmt.Sprintf("%d/%d", license.PeriodUsage, limit))
+}
+
+func handleUpdateSpendingCaps(ctx appContext, w http.ResponseWriter, req *http.Request) (int, error) {
+	licenseID := mux.Vars(req)["id"]
+	if licenseID == "" {
+		return http.StatusBadRequest, newAppError(codeBadRequest, "licenseID path parameter was empty")
+	}
+
+	var capsReq SpendingCapsReq
+	if err := json.NewDecoder(req.Body).Decode(&capsReq); err != nil {
+		return http.StatusBadRequest, newAppError(codeInvalidJSON, "JSON body missing or malformed")
+	}
+
+	if capsReq.SoftCap < 0 || capsReq.HardCap < 0 {
+		return http.StatusBadRequest, newAppError(codeBadRequest, "spending caps cannot be negative")
+	}
+	if capsReq.HardCap > 0 && capsReq.SoftCap > capsReq.HardCap {
+		return http.StatusBadRequest, newAppError(codeBadRequest, "soft cap cannot be greater than hard cap")
+	}
+
+	license, err := ctx.licenseStore.GetLicenseByID(req.Context(), licenseID)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to get license: %s", err.Error())
+	}
+	if license == nil {
+		return http.StatusNotFound, newAppError(codeNotFound, fmt.Sprintf("license %s not found", redactLicenseID(licenseID)))
+	}
+
+	license.SoftCap = capsReq.SoftCap
+	license.HardCap = capsReq.HardCap
+	if !softCapReached(license) {
+		license.SoftCapNotified = false
+	}
+
+	if err = ctx.licenseStore.UpdateLicense(req.Context(), license, "soft_cap", "hard_cap", "soft_cap_notified"); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("error updating license: %v", err)
+	}
+
+	if err := json.NewEncoder(w).Encode(license); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
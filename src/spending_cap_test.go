@@ -0,0 +1,121 @@
+package src
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSpendingCaps(t *testing.T) {
+	t.Run("calendar period covers the month", func(t *testing.T) {
+		start, end := calendarPeriod(time.Date(2023, time.December, 15, 10, 0, 0, 0, time.UTC))
+		if !start.Equal(time.Date(2023, time.December, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("unexpected period start %s", start)
+		}
+		if !end.Equal(time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("unexpected period end %s", end)
+		}
+	})
+
+	t.Run("new billing period resets usage", func(t *testing.T) {
+		license := &License{PeriodUsage: 500, SoftCapNotified: true}
+		start, end := calendarPeriod(time.Now())
+
+		setBillingPeriod(license, start, end)
+		if license.PeriodUsage != 0 || license.SoftCapNotified {
+			t.Fatal("expected usage and notification to be reset")
+		}
+
+		license.PeriodUsage = 10
+		setBillingPeriod(license, start, end)
+		if license.PeriodUsage != 10 {
+			t.Fatal("expected usage to be kept within the same period")
+		}
+	})
+
+	t.Run("hard cap limits allowance", func(t *testing.T) {
+		tests := []struct {
+			hardCap, usage, n, expect int
+		}{
+			{0, 5000, 16, 16},
+			{100, 0, 16, 16},
+			{100, 90, 16, 10},
+			{100, 100, 16, 0},
+			{100, 150, 16, 0},
+		}
+
+		for _, test := range tests {
+			license := &License{HardCap: test.hardCap, PeriodUsage: test.usage}
+			if got := hardCapAllowance(license, test.n); got != test.expect {
+				t.Errorf("hardCap %d usage %d: expected allowance %d but got %d", test.hardCap, test.usage, test.expect, got)
+			}
+		}
+	})
+
+	t.Run("sets headers for the reached cap", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		setSpendingCapHeaders(rr, &License{SoftCap: 80, HardCap: 100, PeriodUsage: 50})
+		if rr.Header().Get(spendingCapHeader) != "" {
+			t.Error("expected no spending cap header below the soft cap")
+		}
+
+		rr = httptest.NewRecorder()
+		setSpendingCapHeaders(rr, &License{SoftCap: 80, HardCap: 100, PeriodUsage: 85})
+		if rr.Header().Get(spendingCapHeader) != "soft" {
+			t.Errorf("expected soft cap header but got %q", rr.Header().Get(spendingCapHeader))
+		}
+		if rr.Header().Get(spendingCapUsageHeader) != "85/100" {
+			t.Errorf("unexpected usage header %q", rr.Header().Get(spendingCapUsageHeader))
+		}
+
+		rr = httptest.NewRecorder()
+		setSpendingCapHeaders(rr, &License{SoftCap: 80, HardCap: 100, PeriodUsage: 100})
+		if rr.Header().Get(spendingCapHeader) != "hard" {
+			t.Errorf("expected hard cap header but got %q", rr.Header().Get(spendingCapHeader))
+		}
+	})
+}
+
+func TestLicenseUsage(t *testing.T) {
+	ctx, err := getTestCtx()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	license := &License{ID: GenerateLicenseKey(), Email: "usage@example.com", IsValid: true, HardCap: 100}
+	if _, err = ctx.db.Model(license).Insert(); err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.db.Model(license).WherePK().Delete()
+
+	// Concurrent batches each read the license before billing it.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		stale := *license
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ctx.licenseStore.AddUsage(context.Background(), &stale, 1); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Changing the caps from a stale copy keeps the usage.
+	stale := *license
+	stale.SoftCap, stale.HardCap = 50, 200
+	if err = ctx.licenseStore.UpdateLicense(context.Background(), &stale, "soft_cap", "hard_cap", "soft_cap_notified"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ctx.licenseStore.GetLicenseByID(context.Background(), license.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.PeriodUsage != 20 || got.RequestCount != 20 || got.HardCap != 200 {
+		t.Fatalf("expected 20 images of usage under the new caps but got %+v", got)
+	}
+}
@@ -0,0 +1,145 @@
+package src
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// parseTLSVersion parses a TLS version such as "1.2" into its crypto/tls constant.
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version %q, expected \"1.2\" or \"1.3\"", version)
+}
+
+// certReloader serves a certificate from disk and reloads it when the
+// certificate or key file changes, so rotated certificates are picked up
+// without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+	logger   zerolog.Logger
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	certMod   time.Time
+	keyMod    time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile string, keyFile string, interval time.Duration, logger zerolog.Logger) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile, interval: interval, logger: logger}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// reload loads the certificate and key files. Callers must hold cr.mu or
+// have exclusive access to cr.
+func (cr *certReloader) reload() error {
+	certInfo, err := os.Stat(cr.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+
+	cr.cert = &cert
+	cr.certMod = certInfo.ModTime()
+	cr.keyMod = keyInfo.ModTime()
+	return nil
+}
+
+// changed reports whether the certificate or key file was modified since
+// it was last loaded.
+func (cr *certReloader) changed() bool {
+	certInfo, err := os.Stat(cr.certFile)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return false
+	}
+	return !certInfo.ModTime().Equal(cr.certMod) || !keyInfo.ModTime().Equal(cr.keyMod)
+}
+
+// GetCertificate implements tls.Config.GetCertificate. The files are checked
+// at most once per interval. If a changed certificate fails to load, the
+// previous one keeps being served.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(cr.lastCheck) >= cr.interval {
+		cr.lastCheck = now
+		if cr.changed() {
+			if err := cr.reload(); err != nil {
+				cr.logger.Error().Msgf("failed to reload TLS certificate, serving the previous one: %v", err)
+			} else {
+				cr.logger.Info().Msgf("reloaded TLS certificate %s", cr.certFile)
+			}
+		}
+	}
+
+	return cr.cert, nil
+}
+
+// newTLSConfig returns the server TLS configuration, or nil if TLS is not
+// configured. When a client CA is set, client certificates are verified
+// against it, and required if config.TLSRequireClient is set.
+func newTLSConfig(config Config, logger zerolog.Logger) (*tls.Config, error) {
+	if config.TLSCertFile == "" {
+		return nil, nil
+	}
+
+	reloader, err := newCertReloader(config.TLSCertFile, config.TLSKeyFile, config.TLSReloadInterval, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     config.TLSMinVersion,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if config.TLSClientCAFile != "" {
+		pem, err := os.ReadFile(config.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read TLS client CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("TLS client CA file contains no certificates")
+		}
+
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if config.TLSRequireClient {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,240 @@
+package src
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+	tls  tls.Certificate
+}
+
+// newTestCert generates a certificate signed by parent, or a self-signed CA
+// if parent is nil.
+func newTestCert(t *testing.T, serial int64, parent *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "purity-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signerCert, signerKey := tmpl, key
+	if parent != nil {
+		signerCert, signerKey = parent.cert, parent.key
+	} else {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signerCert, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{cert: cert, key: key, pem: certPEM, tls: pair}
+}
+
+// writeTestCert writes the certificate and key as PEM files in dir.
+func writeTestCert(t *testing.T, dir string, c *testCert) (string, string) {
+	t.Helper()
+
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, c.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCert(t, 1, nil)
+
+	startTLSServer := func(t *testing.T, config Config) string {
+		tlsConfig, err := newTLSConfig(config, zerolog.Nop())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stop := make(chan struct{})
+		done := make(chan error, 1)
+		ctx := appContext{logger: zerolog.Nop(), config: Config{ShutdownTimeout: time.Second}}
+		srv := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}),
+			TLSConfig: tlsConfig,
+		}
+		go func() {
+			done <- serve(ctx, srv, l, stop)
+		}()
+		t.Cleanup(func() {
+			close(stop)
+			<-done
+		})
+
+		return "https://" + l.Addr().String()
+	}
+
+	newClient := func(clientCert *testCert) *http.Client {
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.cert)
+		tlsConfig := &tls.Config{RootCAs: roots}
+		if clientCert != nil {
+			tlsConfig.Certificates = []tls.Certificate{clientCert.tls}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true}}
+	}
+
+	t.Run("TLS is off without a certificate", func(t *testing.T) {
+		tlsConfig, err := newTLSConfig(Config{}, zerolog.Nop())
+		if err != nil || tlsConfig != nil {
+			t.Fatalf("expected no TLS config, got %v, %v", tlsConfig, err)
+		}
+	})
+
+	t.Run("parses TLS versions", func(t *testing.T) {
+		if v, err := parseTLSVersion("1.3"); err != nil || v != tls.VersionTLS13 {
+			t.Errorf("expected TLS 1.3, got %d, %v", v, err)
+		}
+		if _, err := parseTLSVersion("1.0"); err == nil {
+			t.Error("expected TLS 1.0 to be rejected")
+		}
+	})
+
+	t.Run("serves and reloads the certificate", func(t *testing.T) {
+		dir := t.TempDir()
+		certFile, keyFile := writeTestCert(t, dir, newTestCert(t, 2, ca))
+
+		addr := startTLSServer(t, Config{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSMinVersion: tls.VersionTLS12})
+		client := newClient(nil)
+
+		res, err := client.Get(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if serial := res.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 2 {
+			t.Fatalf("expected certificate serial 2 but got %d", serial)
+		}
+
+		writeTestCert(t, dir, newTestCert(t, 3, ca))
+		later := time.Now().Add(time.Minute)
+		if err := os.Chtimes(certFile, later, later); err != nil {
+			t.Fatal(err)
+		}
+
+		res, err = client.Get(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if serial := res.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 3 {
+			t.Fatalf("expected reloaded certificate serial 3 but got %d", serial)
+		}
+	})
+
+	t.Run("enforces the minimum TLS version", func(t *testing.T) {
+		certFile, keyFile := writeTestCert(t, t.TempDir(), newTestCert(t, 4, ca))
+		addr := startTLSServer(t, Config{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSMinVersion: tls.VersionTLS13})
+
+		client := newClient(nil)
+		client.Transport.(*http.Transport).TLSClientConfig.MaxVersion = tls.VersionTLS12
+		if res, err := client.Get(addr); err == nil {
+			res.Body.Close()
+			t.Fatal("expected TLS 1.2 client to be rejected")
+		}
+	})
+
+	t.Run("verifies client certificates", func(t *testing.T) {
+		dir := t.TempDir()
+		certFile, keyFile := writeTestCert(t, dir, newTestCert(t, 5, ca))
+		caFile := filepath.Join(dir, "ca.pem")
+		if err := os.WriteFile(caFile, ca.pem, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		addr := startTLSServer(t, Config{
+			TLSCertFile:      certFile,
+			TLSKeyFile:       keyFile,
+			TLSMinVersion:    tls.VersionTLS12,
+			TLSClientCAFile:  caFile,
+			TLSRequireClient: true,
+		})
+
+		if res, err := newClient(nil).Get(addr); err == nil {
+			res.Body.Close()
+			t.Fatal("expected client without a certificate to be rejected")
+		}
+
+		untrusted := newTestCert(t, 6, newTestCert(t, 7, nil))
+		if res, err := newClient(untrusted).Get(addr); err == nil {
+			res.Body.Close()
+			t.Fatal("expected client with an untrusted certificate to be rejected")
+		}
+
+		res, err := newClient(newTestCert(t, 8, ca)).Get(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200 but got %d", res.StatusCode)
+		}
+	})
+}
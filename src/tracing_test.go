@@ -0,0 +1,93 @@
+package src
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	testProvider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	provider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(testProvider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+		// The package tracer keeps delegating to the first provider set, so
+		// shutting it down stops later tests from recording spans.
+		_ = testProvider.Shutdown(context.Background())
+	})
+
+	ctx := appContext{
+		logger:       zerolog.Nop(),
+		licenseStore: newFakeLicenseStore(&License{ID: testLicenseID, IsValid: true}),
+		rateLimiter:  NewMemoryRateLimitStore(),
+		config:       Config{IPRateLimit: RateLimit{Rate: 1, Burst: 100}},
+	}
+	router := newRouter(ctx)
+
+	t.Run("continues the caller's trace", func(t *testing.T) {
+		traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+		parentID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+
+		req := httptest.NewRequest("GET", "/v1/license/"+testLicenseID, nil)
+		req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+
+		spans := recorder.Ended()
+		if len(spans) == 0 {
+			t.Fatal("expected a server span")
+		}
+		span := spans[len(spans)-1]
+		if span.Name() != "GET /v1/license/{id}" {
+			t.Errorf("expected span named by route template but got %q", span.Name())
+		}
+		if span.SpanKind() != trace.SpanKindServer {
+			t.Errorf("expected a server span but got %s", span.SpanKind())
+		}
+		if span.SpanContext().TraceID() != traceID {
+			t.Errorf("expected trace %s but got %s", traceID, span.SpanContext().TraceID())
+		}
+		if span.Parent().SpanID() != parentID {
+			t.Errorf("expected parent span %s but got %s", parentID, span.Parent().SpanID())
+		}
+	})
+
+	t.Run("records the response status", func(t *testing.T) {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/license/"+testLicenseID, nil))
+
+		spans := recorder.Ended()
+		span := spans[len(spans)-1]
+		for _, attr := range span.Attributes() {
+			if attr.Key == "http.status_code" {
+				if attr.Value.AsInt64() != 200 {
+					t.Errorf("expected status 200 but got %d", attr.Value.AsInt64())
+				}
+				return
+			}
+		}
+		t.Error("expected an http.status_code attribute")
+	})
+
+	t.Run("leaves the license ID out of spans", func(t *testing.T) {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/license/"+testLicenseID, nil))
+
+		spans := recorder.Ended()
+		span := spans[len(spans)-1]
+		for _, attr := range span.Attributes() {
+			if strings.Contains(attr.Value.Emit(), testLicenseID) {
+				t.Errorf("expected no license ID in spans but %s is %q", attr.Key, attr.Value.Emit())
+			}
+		}
+	})
+}
@@ -2,6 +2,7 @@ package src
 
 import (
 	"bufio"
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
@@ -10,6 +11,7 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"time"
 )
 
 func Base64EncodeF(path string) (string, error) {
@@ -74,3 +76,12 @@ func StringSliceRemove(arr []string, i int) ([]string, error) {
 	arr = arr[:len(arr)-1]
 	return arr, nil
 }
+
+// withTimeout returns a copy of ctx that is cancelled after d. A zero d
+// leaves the deadline to ctx.
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
@@ -0,0 +1,86 @@
+package src
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// maxWorkerBacklog is the number of running background tasks above which the
+// workers are reported unhealthy.
+const maxWorkerBacklog = 1000
+
+// workerGroup tracks background work started by handlers so it can be
+// drained before the server exits.
+type workerGroup struct {
+	wg       sync.WaitGroup
+	active   atomic.Int64
+	draining atomic.Bool
+}
+
+func newWorkerGroup() *workerGroup {
+	return &workerGroup{}
+}
+
+// Go runs fn in the background. A nil group runs fn synchronously, which
+// keeps handlers usable from tests without a server.
+func (g *workerGroup) Go(fn func()) {
+	if g == nil {
+		fn()
+		return
+	}
+
+	g.wg.Add(1)
+	g.active.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer g.active.Add(-1)
+		fn()
+	}()
+}
+
+// Drain marks the group as draining for shutdown, so readiness fails while
+// in-flight requests and background work finish.
+func (g *workerGroup) Drain() {
+	if g == nil {
+		return
+	}
+	g.draining.Store(true)
+}
+
+// Wait blocks until all background work is done or ctx is done.
+func (g *workerGroup) Wait(ctx context.Context) error {
+	if g == nil {
+		return nil
+	}
+	g.Drain()
+
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Check returns an error if the workers are draining for shutdown or have
+// fallen too far behind.
+func (g *workerGroup) Check(context.Context) error {
+	if g == nil {
+		return nil
+	}
+	if g.draining.Load() {
+		return fmt.Errorf("draining for shutdown")
+	}
+	if active := g.active.Load(); active > maxWorkerBacklog {
+		return fmt.Errorf("%d background tasks running, more than %d", active, maxWorkerBacklog)
+	}
+	return nil
+}